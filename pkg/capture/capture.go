@@ -0,0 +1,192 @@
+// Package capture reads and writes session traffic captures, which record the framed ICD messages passing through
+// the controller in both directions
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+)
+
+// A capture file starts with the magic string and a format version, followed by a sequence of records. Each record
+// is encoded as:
+//
+//	timestamp   int64, little-endian, nanoseconds since the Unix epoch
+//	direction   uint8
+//	worker name uvarint length + bytes
+//	message     uvarint length + bytes (the full framed message, including the 8-byte ICD prefix)
+const (
+	magic   = "CARTACAP"
+	version = 1
+	// Upper bound on the size of a single record, to avoid huge allocations when reading a corrupt file
+	maxMessageSize = 1 << 30
+)
+
+var ErrBadMagic = errors.New("not a CARTA capture file")
+
+type Direction uint8
+
+const (
+	// ClientToController messages are received from the frontend
+	ClientToController Direction = iota
+	// ControllerToWorker messages are written to a worker, including those generated by the controller itself
+	ControllerToWorker
+	// WorkerToController messages are received from a worker
+	WorkerToController
+	// ControllerToClient messages are written to the frontend
+	ControllerToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToController:
+		return "client->controller"
+	case ControllerToWorker:
+		return "controller->worker"
+	case WorkerToController:
+		return "worker->controller"
+	case ControllerToClient:
+		return "controller->client"
+	default:
+		return fmt.Sprintf("direction(%d)", uint8(d))
+	}
+}
+
+type Record struct {
+	Time       time.Time
+	Direction  Direction
+	WorkerName string
+	// Message is the framed message, including the ICD prefix
+	Message []byte
+}
+
+// Prefix decodes the event type, ICD version and request ID of the recorded message
+func (r Record) Prefix() (cartaHelpers.MessagePrefix, error) {
+	return cartaHelpers.DecodeMessagePrefix(r.Message)
+}
+
+func (r Record) EventType() cartaDefinitions.EventType {
+	prefix, _ := r.Prefix()
+	return prefix.EventType
+}
+
+func (r Record) RequestId() uint32 {
+	prefix, _ := r.Prefix()
+	return prefix.RequestId
+}
+
+// Decode un-marshals the payload of the recorded message with cartaHelpers.UnmarshalMessage
+func (r Record) Decode() (proto.Message, error) {
+	prefix, err := r.Prefix()
+	if err != nil {
+		return nil, err
+	}
+	return cartaHelpers.UnmarshalMessage(prefix.EventType, r.Message[8:])
+}
+
+type Writer struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+// NewWriter writes the capture header and returns a Writer that appends records to w
+func NewWriter(w io.Writer) (*Writer, error) {
+	bw := bufio.NewWriter(w)
+	header := binary.LittleEndian.AppendUint16([]byte(magic), version)
+	if _, err := bw.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: bw}, nil
+}
+
+func (w *Writer) Write(r Record) error {
+	buf := w.buf[:0]
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.Time.UnixNano()))
+	buf = append(buf, byte(r.Direction))
+	buf = binary.AppendUvarint(buf, uint64(len(r.WorkerName)))
+	buf = append(buf, r.WorkerName...)
+	buf = binary.AppendUvarint(buf, uint64(len(r.Message)))
+	w.buf = buf
+
+	if _, err := w.w.Write(buf); err != nil {
+		return err
+	}
+	_, err := w.w.Write(r.Message)
+	return err
+}
+
+// Flush writes any buffered records to the underlying writer
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader checks the capture header and returns a Reader for the records that follow it
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrBadMagic
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, ErrBadMagic
+	}
+	if v := binary.LittleEndian.Uint16(header[len(magic):]); v != version {
+		return nil, fmt.Errorf("unsupported capture version %d", v)
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF once the capture has been read completely
+func (r *Reader) Next() (Record, error) {
+	var fixed [9]byte
+	if _, err := io.ReadFull(r.r, fixed[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Record{}, fmt.Errorf("truncated record: %w", err)
+		}
+		return Record{}, err
+	}
+
+	record := Record{
+		Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(fixed[0:8]))),
+		Direction: Direction(fixed[8]),
+	}
+
+	name, err := r.readBytes()
+	if err != nil {
+		return Record{}, err
+	}
+	record.WorkerName = string(name)
+
+	record.Message, err = r.readBytes()
+	if err != nil {
+		return Record{}, err
+	}
+	return record, nil
+}
+
+func (r *Reader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, fmt.Errorf("truncated record: %w", err)
+	}
+	if n > maxMessageSize {
+		return nil, fmt.Errorf("record too large: %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, fmt.Errorf("truncated record: %w", err)
+	}
+	return b, nil
+}
@@ -2,15 +2,25 @@ package cartaHelpers
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"strings"
 
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 
 	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
 )
 
+// IcdVersion is the native ICD version of the controller, used for any messages it generates itself
 const IcdVersion = 30
 
+// ErrUnsupportedIcdVersion is returned by DecodeMessagePrefix when a message uses an ICD version other than IcdVersion.
+// The decoded prefix is still returned, so callers that can handle other versions may check for it with errors.Is
+var ErrUnsupportedIcdVersion = errors.New("unsupported ICD version")
+
 type MessagePrefix struct {
 	EventType  cartaDefinitions.EventType
 	IcdVersion uint16
@@ -29,17 +39,22 @@ func DecodeMessagePrefix(data []byte) (prefix MessagePrefix, err error) {
 		RequestId:  binary.LittleEndian.Uint32(data[4:8]),
 	}
 	if prefix.IcdVersion != IcdVersion {
-		err = fmt.Errorf("invalid ICD version")
+		err = fmt.Errorf("%w: %d", ErrUnsupportedIcdVersion, prefix.IcdVersion)
 		return
 	}
 	return
 }
 
 func PrepareBinaryMessage(byteData []byte, eventType cartaDefinitions.EventType, requestId uint32) []byte {
+	return PrepareVersionedBinaryMessage(byteData, eventType, IcdVersion, requestId)
+}
+
+// PrepareVersionedBinaryMessage is PrepareBinaryMessage for peers that use an ICD version other than IcdVersion
+func PrepareVersionedBinaryMessage(byteData []byte, eventType cartaDefinitions.EventType, icdVersion uint16, requestId uint32) []byte {
 	// Prepend 8 bytes: first 2 bytes is event Type, next 2 bytes is ICD version, last 4 bytes is request ID
 	header := make([]byte, 8)
 	binary.LittleEndian.PutUint16(header[0:2], uint16(eventType))
-	binary.LittleEndian.PutUint16(header[2:4], IcdVersion)
+	binary.LittleEndian.PutUint16(header[2:4], icdVersion)
 	binary.LittleEndian.PutUint32(header[4:8], requestId)
 
 	// Prepend header to byteData
@@ -111,19 +126,49 @@ var messageTypeMap = map[cartaDefinitions.EventType]func() proto.Message{
 	cartaDefinitions.EventType_CATALOG_FILTER_REQUEST:        func() proto.Message { return &cartaDefinitions.CatalogFilterRequest{} },
 }
 
-// UnmarshalMessage Un-marshals raw message bytes into the appropriate protobuf message type based on EventType
-func UnmarshalMessage(eventType cartaDefinitions.EventType, rawMsg []byte) (proto.Message, error) {
+// messageTypeFromRegistry looks up the message type for event types that aren't in messageTypeMap, such as responses
+// and stream data. By convention, the message name is the event type name in CamelCase (e.g. OPEN_FILE_ACK -> OpenFileAck).
+func messageTypeFromRegistry(eventType cartaDefinitions.EventType) (func() proto.Message, bool) {
+	name := eventType.String()
+	parts := strings.Split(strings.ToLower(name), "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	packageName := (&cartaDefinitions.OpenFile{}).ProtoReflect().Descriptor().ParentFile().Package()
+	messageName := packageName.Append(protoreflect.Name(strings.Join(parts, "")))
+
+	messageType, err := protoregistry.GlobalTypes.FindMessageByName(messageName)
+	if err != nil {
+		return nil, false
+	}
+	return func() proto.Message { return messageType.New().Interface() }, true
+}
+
+// NewMessage creates an empty protobuf message of the type that corresponds to the EventType
+func NewMessage(eventType cartaDefinitions.EventType) (proto.Message, error) {
 	// Look up the message constructor in the map
 	constructor, ok := messageTypeMap[eventType]
+	if !ok {
+		constructor, ok = messageTypeFromRegistry(eventType)
+	}
 	if !ok {
 		return nil, fmt.Errorf("unknown event type: %v", eventType)
 	}
+	return constructor(), nil
+}
 
+// UnmarshalMessage Un-marshals raw message bytes into the appropriate protobuf message type based on EventType
+func UnmarshalMessage(eventType cartaDefinitions.EventType, rawMsg []byte) (proto.Message, error) {
 	// Create a new message instance
-	msg := constructor()
+	msg, err := NewMessage(eventType)
+	if err != nil {
+		return nil, err
+	}
 
 	// Unmarshal the message
-	err := proto.Unmarshal(rawMsg, msg)
+	err = proto.Unmarshal(rawMsg, msg)
 	if err != nil {
 		return nil, err
 	}
@@ -141,3 +186,140 @@ func ExtractFileIdFromBytes(eventType cartaDefinitions.EventType, rawMsg []byte)
 	// Extract fileId from the unmarshaled message
 	return ExtractFileId(msg)
 }
+
+// wireField locates a scalar field in the wire format of a message
+type wireField struct {
+	number protowire.Number
+	kind   protoreflect.Kind
+}
+
+// isInt32 reports whether the field can be read from the wire format as an int32
+func (f wireField) isInt32() bool {
+	return f.kind == protoreflect.Int32Kind || f.kind == protoreflect.Uint32Kind || f.kind == protoreflect.Sint32Kind
+}
+
+// wireFieldsNamed finds the field with the given name in the message type of every event type, for reading it
+// directly from the wire format
+func wireFieldsNamed(name protoreflect.Name) map[cartaDefinitions.EventType]wireField {
+	fields := make(map[cartaDefinitions.EventType]wireField)
+	for value := range cartaDefinitions.EventType_name {
+		eventType := cartaDefinitions.EventType(value)
+		msg, err := NewMessage(eventType)
+		if err != nil {
+			continue
+		}
+		fd := msg.ProtoReflect().Descriptor().Fields().ByName(name)
+		if fd == nil || fd.Cardinality() == protoreflect.Repeated {
+			continue
+		}
+		fields[eventType] = wireField{number: fd.Number(), kind: fd.Kind()}
+	}
+	return fields
+}
+
+var (
+	fileIdFields   = wireFieldsNamed("file_id")
+	regionIdFields = wireFieldsNamed("region_id")
+)
+
+// peekInt32 reads a 32-bit integer field directly from the wire format, without un-marshalling the message or
+// allocating. As in proto3, a missing field reads as zero and the last occurrence of a repeated one wins.
+func peekInt32(field wireField, rawMsg []byte) (int32, bool) {
+	var value int32
+	for len(rawMsg) > 0 {
+		num, typ, n := protowire.ConsumeTag(rawMsg)
+		if n < 0 {
+			return -1, false
+		}
+		rawMsg = rawMsg[n:]
+
+		if num == field.number && typ == protowire.VarintType {
+			v, m := protowire.ConsumeVarint(rawMsg)
+			if m < 0 {
+				return -1, false
+			}
+			rawMsg = rawMsg[m:]
+			if field.kind == protoreflect.Sint32Kind {
+				value = int32(protowire.DecodeZigZag(v & 0xffffffff))
+			} else {
+				value = int32(v)
+			}
+			continue
+		}
+
+		m := protowire.ConsumeFieldValue(num, typ, rawMsg)
+		if m < 0 {
+			return -1, false
+		}
+		rawMsg = rawMsg[m:]
+	}
+	return value, true
+}
+
+// PeekFileId is the fast path of ExtractFileIdFromBytes, for routing messages. It reads the fileId directly from the
+// wire format, using the field number from the message type's descriptor, and only falls back to un-marshalling the
+// message for types whose file ID is not a 32-bit integer.
+func PeekFileId(eventType cartaDefinitions.EventType, rawMsg []byte) (int32, bool) {
+	field, ok := fileIdFields[eventType]
+	switch {
+	case !ok:
+		return -1, false
+	case !field.isInt32():
+		return ExtractFileIdFromBytes(eventType, rawMsg)
+	}
+	return peekInt32(field, rawMsg)
+}
+
+// PeekRegionId reads the regionId of a message directly from the wire format, like PeekFileId. It returns false if
+// the message type has no 32-bit integer region ID or the message is malformed.
+func PeekRegionId(eventType cartaDefinitions.EventType, rawMsg []byte) (int32, bool) {
+	field, ok := regionIdFields[eventType]
+	if !ok || !field.isInt32() {
+		return -1, false
+	}
+	return peekInt32(field, rawMsg)
+}
+
+var rasterTileFields = (&cartaDefinitions.RasterTileData{}).ProtoReflect().Descriptor().Fields()
+
+var (
+	rasterTileFileIdField  = rasterTileFields.ByName("file_id").Number()
+	rasterTileChannelField = rasterTileFields.ByName("channel").Number()
+	rasterTileStokesField  = rasterTileFields.ByName("stokes").Number()
+)
+
+// PeekRasterTileChannel reads the file ID, channel and Stokes parameter of a RASTER_TILE_DATA message directly from
+// the wire format, without un-marshalling the (potentially large) tile data.
+func PeekRasterTileChannel(rawMsg []byte) (fileId int32, channel int32, stokes int32, ok bool) {
+	for len(rawMsg) > 0 {
+		num, typ, n := protowire.ConsumeTag(rawMsg)
+		if n < 0 {
+			return 0, 0, 0, false
+		}
+		rawMsg = rawMsg[n:]
+
+		if typ == protowire.VarintType && (num == rasterTileFileIdField || num == rasterTileChannelField || num == rasterTileStokesField) {
+			v, m := protowire.ConsumeVarint(rawMsg)
+			if m < 0 {
+				return 0, 0, 0, false
+			}
+			rawMsg = rawMsg[m:]
+			switch num {
+			case rasterTileFileIdField:
+				fileId = int32(v)
+			case rasterTileChannelField:
+				channel = int32(v)
+			case rasterTileStokesField:
+				stokes = int32(v)
+			}
+			continue
+		}
+
+		m := protowire.ConsumeFieldValue(num, typ, rawMsg)
+		if m < 0 {
+			return 0, 0, 0, false
+		}
+		rawMsg = rawMsg[m:]
+	}
+	return fileId, channel, stokes, true
+}
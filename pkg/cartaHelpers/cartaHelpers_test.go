@@ -0,0 +1,79 @@
+package cartaHelpers
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+)
+
+// routedMessages are typical client messages that the controller routes by file ID, including the high-rate cursor
+// and tile requests
+var routedMessages = []struct {
+	name      string
+	eventType cartaDefinitions.EventType
+	msg       proto.Message
+}{
+	{"SetCursor", cartaDefinitions.EventType_SET_CURSOR, &cartaDefinitions.SetCursor{
+		FileId: 3,
+		Point:  &cartaDefinitions.Point{X: 512.5, Y: 384.5},
+	}},
+	{"AddRequiredTiles", cartaDefinitions.EventType_ADD_REQUIRED_TILES, &cartaDefinitions.AddRequiredTiles{
+		FileId:             3,
+		Tiles:              []int32{0, 1, 2, 3, 4096, 4097, 4098, 4099, 8192, 8193, 8194, 8195, 12288, 12289, 12290, 12291},
+		CompressionType:    cartaDefinitions.CompressionType_ZFP,
+		CompressionQuality: 11,
+		CurrentTiles:       []int32{0, 1, 2, 3},
+	}},
+	{"SetSpatialRequirements", cartaDefinitions.EventType_SET_SPATIAL_REQUIREMENTS, &cartaDefinitions.SetSpatialRequirements{
+		FileId:   3,
+		RegionId: 2,
+	}},
+	{"NegativeFileId", cartaDefinitions.EventType_CLOSE_FILE, &cartaDefinitions.CloseFile{FileId: -1}},
+	{"NoFileId", cartaDefinitions.EventType_FILE_LIST_REQUEST, &cartaDefinitions.FileListRequest{Directory: "$BASE/images"}},
+}
+
+func marshalRouted(tb testing.TB, msg proto.Message) []byte {
+	tb.Helper()
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return raw
+}
+
+func TestPeekFileIdMatchesUnmarshal(t *testing.T) {
+	for _, m := range routedMessages {
+		raw := marshalRouted(t, m.msg)
+		wantId, wantOk := ExtractFileIdFromBytes(m.eventType, raw)
+		gotId, gotOk := PeekFileId(m.eventType, raw)
+		if gotId != wantId || gotOk != wantOk {
+			t.Errorf("%s: PeekFileId = (%d, %v), ExtractFileIdFromBytes = (%d, %v)", m.name, gotId, gotOk, wantId, wantOk)
+		}
+	}
+}
+
+func BenchmarkExtractFileIdFromBytes(b *testing.B) {
+	for _, m := range routedMessages {
+		raw := marshalRouted(b, m.msg)
+		b.Run(m.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				ExtractFileIdFromBytes(m.eventType, raw)
+			}
+		})
+	}
+}
+
+func BenchmarkPeekFileId(b *testing.B) {
+	for _, m := range routedMessages {
+		raw := marshalRouted(b, m.msg)
+		b.Run(m.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				PeekFileId(m.eventType, raw)
+			}
+		})
+	}
+}
@@ -35,16 +35,166 @@ type PAMConfig struct {
 	ServiceName string `mapstructure:"service_name"` // e.g. "login" or "carta"
 }
 
+// MessagePolicy restricts the ICD message types that members of the listed groups may send. "*" matches all users
+type MessagePolicy struct {
+	Groups []string `mapstructure:"groups"`
+	// If not empty, only these event types are allowed
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+}
+
+// WebSocketConfig holds the limits and options for one side of the proxied WebSocket connections
+type WebSocketConfig struct {
+	// Maximum size of a single incoming message in bytes. Connections that exceed it are closed. Zero means no limit
+	MaxMessageSize int64 `mapstructure:"max_message_size"`
+	// I/O buffer sizes in bytes. Zero uses the WebSocket library's defaults
+	ReadBufferSize  int `mapstructure:"read_buffer_size"`
+	WriteBufferSize int `mapstructure:"write_buffer_size"`
+	// Negotiate permessage-deflate compression with the peer
+	Compression bool `mapstructure:"compression"`
+}
+
+// TileCacheConfig sets the memory caps of the controller's raster tile cache, which answers repeated tile requests
+// without involving the workers
+type TileCacheConfig struct {
+	// Maximum number of bytes of tile data cached per session. Zero disables the cache
+	SessionBytes int `mapstructure:"session_bytes"`
+	// Maximum number of bytes cached across all sessions. Zero means that only the per-session limit applies
+	TotalBytes int `mapstructure:"total_bytes"`
+}
+
+// EventRateLimit limits how often sessions may send messages of one ICD event type
+type EventRateLimit struct {
+	EventType string `mapstructure:"event_type"`
+	// Sustained number of messages per second, and the number that may be sent at once above that rate. A burst of
+	// zero allows one second's worth of messages
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// RateLimitConfig sets the token bucket limits on messages from frontend clients. Messages over a limit are held back
+// for up to MaxDelay, and rejected if that is not long enough
+type RateLimitConfig struct {
+	// Sustained number of messages per second that a session may send, and the number that may be sent at once above
+	// that rate. A rate of zero means no session-wide limit
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+	// Limits for individual event types, which apply in addition to the session-wide limit
+	Events []EventRateLimit `mapstructure:"events"`
+	// How long a message may be held back to stay within the limits before it is rejected instead
+	MaxDelay time.Duration `mapstructure:"max_delay"`
+	// Maximum size of a single binary message in bytes. Larger messages are rejected, but unlike the client WebSocket
+	// max_message_size, the connection stays open. Zero means no limit
+	MaxFrameSize int `mapstructure:"max_frame_size"`
+	// Number of rejected messages within ViolationWindow after which the session is closed. Zero never closes sessions
+	MaxViolations   int           `mapstructure:"max_violations"`
+	ViolationWindow time.Duration `mapstructure:"violation_window"`
+}
+
+type SessionConfig struct {
+	// Interval between WebSocket ping frames sent to clients and workers. Zero disables heartbeats
+	PingInterval time.Duration `mapstructure:"ping_interval"`
+	// How long a peer may go without responding before its connection is considered dead
+	PongTimeout time.Duration `mapstructure:"pong_timeout"`
+	// Maximum number of messages and bytes queued for a peer before streamed data starts being dropped
+	SendQueueMessages int `mapstructure:"send_queue_messages"`
+	SendQueueBytes    int `mapstructure:"send_queue_bytes"`
+	// How long a single write to a peer may block before the peer is considered stuck
+	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	// Directory to record session traffic captures to. Recording is disabled if this is empty
+	CaptureDir string `mapstructure:"capture_dir"`
+	// ICD versions accepted from frontend clients
+	ClientIcdVersions []int `mapstructure:"client_icd_versions"`
+	// ICD versions to try, in order, when registering with a worker whose version is not yet known
+	WorkerIcdVersions []int `mapstructure:"worker_icd_versions"`
+	// How long to wait for a worker to acknowledge registration with each candidate ICD version
+	WorkerRegisterTimeout time.Duration `mapstructure:"worker_register_timeout"`
+	// Directories that users may access in addition to their base folder
+	AllowedRoots []string `mapstructure:"allowed_roots"`
+	// Directory that files may be written to, relative to the base folder unless absolute. Writes are unrestricted within
+	// the allowed roots if this is empty
+	OutputDir string `mapstructure:"output_dir"`
+	// Message type restrictions by group. A message must be allowed by every policy that applies to the user
+	MessagePolicies []MessagePolicy `mapstructure:"message_policies"`
+	// Maximum number of followers that may watch a single session through invite links. Zero disables following
+	MaxFollowers int `mapstructure:"max_followers"`
+	// How files are assigned to workers: "single" opens every file in the session's shared worker, "per_file" starts a
+	// worker for each file, "pool" spreads files over at most WorkerPoolSize workers, and "size" starts a worker for
+	// each file of at least DedicatedWorkerSize bytes and opens smaller files in the shared worker
+	WorkerAllocation    string `mapstructure:"worker_allocation"`
+	WorkerPoolSize      int    `mapstructure:"worker_pool_size"`
+	DedicatedWorkerSize int64  `mapstructure:"dedicated_worker_size"`
+	// Maximum number of times a worker that crashes is replaced within a session. Zero disables recovery
+	WorkerRecoveries int `mapstructure:"worker_recoveries"`
+	// How long to wait for the response to each message replayed into a replacement worker
+	ReplayTimeout time.Duration `mapstructure:"replay_timeout"`
+	// Requests that take longer than this to be answered are logged. Zero disables the logging
+	SlowRequestThreshold time.Duration `mapstructure:"slow_request_threshold"`
+	// Memory caps of the raster tile cache
+	TileCache TileCacheConfig `mapstructure:"tile_cache"`
+	// Limits on the rate and size of messages from frontend clients
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+	// Settings for WebSocket connections from frontend clients and to workers
+	ClientWebSocket WebSocketConfig `mapstructure:"client_websocket"`
+	WorkerWebSocket WebSocketConfig `mapstructure:"worker_websocket"`
+}
+
+type MetricsConfig struct {
+	// Serve metrics in the Prometheus text format at /metrics. The endpoint doesn't require a login, so this is off by
+	// default
+	Enabled bool `mapstructure:"enabled"`
+	// Record metrics labelled by user name. Every user adds its own series, so this is off by default
+	PerUser bool `mapstructure:"per_user"`
+}
+
+type TLSConfig struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// CA bundle used to verify client certificates. If set, clients must present a certificate signed by it
+	ClientCAFile string `mapstructure:"client_ca_file"`
+}
+
+// Enabled reports whether a certificate and key are configured, in which case the service serves HTTPS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// GroupFolder maps members of a group to a shared base folder, such as a project directory
+type GroupFolder struct {
+	Group  string `mapstructure:"group"`
+	Folder string `mapstructure:"folder"`
+}
+
 type ControllerConfig struct {
-	OIDC               OIDCConfig `mapstructure:"oidc"`
-	PAM                PAMConfig  `mapstructure:"pam"`
-	Port               int        `mapstructure:"port"`
-	Hostname           string     `mapstructure:"hostname"`
-	FrontendDir        string     `mapstructure:"frontend_dir"`
-	SpawnerAddress     string     `mapstructure:"spawner_address"`
-	BaseFolder         string     `mapstructure:"base_folder"`
-	AuthMode           AuthMode   `mapstructure:"auth_mode"`
-	DBConnectionString string     `mapstructure:"db_conn_string"`
+	OIDC               OIDCConfig    `mapstructure:"oidc"`
+	PAM                PAMConfig     `mapstructure:"pam"`
+	Port               int           `mapstructure:"port"`
+	Hostname           string        `mapstructure:"hostname"`
+	FrontendDir        string        `mapstructure:"frontend_dir"`
+	SpawnerAddress     string        `mapstructure:"spawner_address"`
+	BaseFolder         string        `mapstructure:"base_folder"`
+	GroupFolders       []GroupFolder `mapstructure:"group_folders"`
+	AuthMode           AuthMode      `mapstructure:"auth_mode"`
+	DBConnectionString string        `mapstructure:"db_conn_string"`
+	AdminGroups        []string      `mapstructure:"admin_groups"`
+	Session            SessionConfig `mapstructure:"session"`
+	// How long to wait for clients to disconnect after a shutdown is requested before terminating their sessions
+	ShutdownGracePeriod time.Duration `mapstructure:"shutdown_grace_period"`
+	// Origins that browsers may open WebSocket connections from, e.g. "https://carta.example.org". "*" allows any
+	// origin. If empty, only the controller's own origin is allowed
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	// URL prefix that the controller is served under behind a reverse proxy, e.g. "/carta"
+	BasePath string `mapstructure:"base_path"`
+	// Addresses and CIDR ranges of reverse proxies whose X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto
+	// headers are trusted
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+	TLS     TLSConfig     `mapstructure:"tls"`
+	Metrics MetricsConfig `mapstructure:"metrics"`
+	// CA bundle used to verify the spawner's certificate when it serves HTTPS. The system roots are used if empty
+	SpawnerCAFile string `mapstructure:"spawner_ca_file"`
+	// How long the scripting API waits for the response to a scripted message
+	ScriptingTimeout time.Duration `mapstructure:"scripting_timeout"`
 }
 
 type SpawnerConfig struct {
@@ -52,6 +202,7 @@ type SpawnerConfig struct {
 	Timeout    time.Duration `mapstructure:"timeout"`
 	Port       int           `mapstructure:"port"`
 	Hostname   string        `mapstructure:"hostname"`
+	TLS        TLSConfig     `mapstructure:"tls"`
 }
 
 // Config holds common configuration values shared across all services
@@ -78,6 +229,53 @@ func setControllerDefaults(v *viper.Viper) {
 	v.SetDefault("controller.oidc.client_secret", "")
 	v.SetDefault("controller.oidc.redirect_url", "")
 	v.SetDefault("controller.db_conn_string", "")
+	v.SetDefault("controller.admin_groups", []string{})
+
+	v.SetDefault("controller.shutdown_grace_period", 30*time.Second)
+	v.SetDefault("controller.allowed_origins", []string{})
+	v.SetDefault("controller.base_path", "")
+	v.SetDefault("controller.trusted_proxies", []string{})
+	v.SetDefault("controller.tls.cert_file", "")
+	v.SetDefault("controller.tls.key_file", "")
+	v.SetDefault("controller.tls.client_ca_file", "")
+	v.SetDefault("controller.spawner_ca_file", "")
+	v.SetDefault("controller.scripting_timeout", 30*time.Second)
+	v.SetDefault("controller.metrics.enabled", false)
+	v.SetDefault("controller.metrics.per_user", false)
+	v.SetDefault("controller.session.ping_interval", 30*time.Second)
+	v.SetDefault("controller.session.pong_timeout", 60*time.Second)
+	v.SetDefault("controller.session.send_queue_messages", 1000)
+	v.SetDefault("controller.session.send_queue_bytes", 64*1024*1024)
+	v.SetDefault("controller.session.write_timeout", 30*time.Second)
+	v.SetDefault("controller.session.capture_dir", "")
+	v.SetDefault("controller.session.client_icd_versions", []int{30})
+	v.SetDefault("controller.session.worker_icd_versions", []int{30})
+	v.SetDefault("controller.session.worker_register_timeout", 10*time.Second)
+	v.SetDefault("controller.session.allowed_roots", []string{})
+	v.SetDefault("controller.session.output_dir", "")
+	v.SetDefault("controller.session.max_followers", 20)
+	v.SetDefault("controller.session.worker_allocation", "per_file")
+	v.SetDefault("controller.session.worker_pool_size", 4)
+	v.SetDefault("controller.session.dedicated_worker_size", 1024*1024*1024)
+	v.SetDefault("controller.session.worker_recoveries", 3)
+	v.SetDefault("controller.session.replay_timeout", 60*time.Second)
+	v.SetDefault("controller.session.slow_request_threshold", 10*time.Second)
+	v.SetDefault("controller.session.tile_cache.session_bytes", 0)
+	v.SetDefault("controller.session.tile_cache.total_bytes", 0)
+	v.SetDefault("controller.session.rate_limit.rate", 200)
+	v.SetDefault("controller.session.rate_limit.burst", 500)
+	v.SetDefault("controller.session.rate_limit.max_delay", 250*time.Millisecond)
+	v.SetDefault("controller.session.rate_limit.max_frame_size", 4*1024*1024)
+	v.SetDefault("controller.session.rate_limit.max_violations", 100)
+	v.SetDefault("controller.session.rate_limit.violation_window", 10*time.Second)
+	v.SetDefault("controller.session.client_websocket.max_message_size", 32*1024*1024)
+	v.SetDefault("controller.session.client_websocket.read_buffer_size", 0)
+	v.SetDefault("controller.session.client_websocket.write_buffer_size", 0)
+	v.SetDefault("controller.session.client_websocket.compression", false)
+	v.SetDefault("controller.session.worker_websocket.max_message_size", 0)
+	v.SetDefault("controller.session.worker_websocket.read_buffer_size", 0)
+	v.SetDefault("controller.session.worker_websocket.write_buffer_size", 0)
+	v.SetDefault("controller.session.worker_websocket.compression", false)
 }
 
 func setSpawnerDefaults(v *viper.Viper) {
@@ -85,6 +283,9 @@ func setSpawnerDefaults(v *viper.Viper) {
 	v.SetDefault("spawner.timeout", 5*time.Second)
 	v.SetDefault("spawner.port", 8080)
 	v.SetDefault("spawner.hostname", "")
+	v.SetDefault("spawner.tls.cert_file", "")
+	v.SetDefault("spawner.tls.key_file", "")
+	v.SetDefault("spawner.tls.client_ca_file", "")
 }
 
 func setDefaults(v *viper.Viper) {
@@ -0,0 +1,102 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// DefaultTimeout bounds how long each readiness check may take
+const DefaultTimeout = 5 * time.Second
+
+// Check is a dependency that must be available for a service to be ready
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+type Result struct {
+	Status string `json:"status"`
+	// LatencyMs is how long the check took, in milliseconds
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("Error encoding health report", "err", err)
+	}
+}
+
+// LivenessHandler reports that the service is running. It doesn't check any dependencies, so that a supervisor
+// doesn't restart the service because something else is unavailable.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, Report{Status: StatusOK})
+	})
+}
+
+// Run runs the checks concurrently, each with its own timeout, and reports whether all of them passed
+func Run(ctx context.Context, timeout time.Duration, checks []Check) Report {
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Go(func() {
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Run(checkCtx)
+			result := Result{Status: StatusOK, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status = StatusFailed
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if err != nil {
+				report.Status = StatusFailed
+			}
+		})
+	}
+	wg.Wait()
+	return report
+}
+
+// ReadinessHandler reports whether the service can handle requests, by running its dependency checks. It responds
+// with 503 Service Unavailable if any check fails.
+func ReadinessHandler(timeout time.Duration, checks ...Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Run(r.Context(), timeout, checks)
+		for name, result := range report.Checks {
+			if result.Status != StatusOK {
+				slog.Warn("Readiness check failed", "check", name, "error", result.Error)
+			}
+		}
+		writeReport(w, report)
+	})
+}
@@ -0,0 +1,80 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	ok := Check{Name: "database", Run: func(ctx context.Context) error { return nil }}
+	failing := Check{Name: "spawner", Run: func(ctx context.Context) error { return errors.New("connection refused") }}
+	// Checks that hang are cut short by their timeout
+	hanging := Check{Name: "identity provider", Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+
+	tests := []struct {
+		name       string
+		checks     []Check
+		wantStatus int
+		wantFailed []string
+	}{
+		{"NoChecks", nil, http.StatusOK, nil},
+		{"AllPass", []Check{ok}, http.StatusOK, nil},
+		{"OneFails", []Check{ok, failing}, http.StatusServiceUnavailable, []string{"spawner"}},
+		{"TimesOut", []Check{ok, hanging}, http.StatusServiceUnavailable, []string{"identity provider"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			start := time.Now()
+			ReadinessHandler(50*time.Millisecond, tt.checks...).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %s, checks should time out after 50ms", elapsed)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			var report Report
+			if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Checks) != len(tt.checks) {
+				t.Errorf("got %d check results, want %d", len(report.Checks), len(tt.checks))
+			}
+			failed := 0
+			for name, result := range report.Checks {
+				if result.Status == StatusOK {
+					continue
+				}
+				failed++
+				if result.Error == "" {
+					t.Errorf("check %s failed without an error", name)
+				}
+			}
+			for _, name := range tt.wantFailed {
+				if report.Checks[name].Status != StatusFailed {
+					t.Errorf("check %s didn't fail", name)
+				}
+			}
+			if failed != len(tt.wantFailed) {
+				t.Errorf("%d checks failed, want %d", failed, len(tt.wantFailed))
+			}
+		})
+	}
+}
+
+func TestLivenessHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	LivenessHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("got status %d with Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+}
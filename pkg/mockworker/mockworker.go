@@ -0,0 +1,382 @@
+// Package mockworker implements a stand-in for carta_backend that speaks the ICD framing used by the controller. It
+// answers the messages needed to exercise the controller and spawner with synthetic or scripted responses, and can
+// inject faults such as delays, crashes and malformed frames.
+package mockworker
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+)
+
+// Faults configures the failures that the mock worker injects
+type Faults struct {
+	// Delay is added before every response
+	Delay time.Duration
+	// CrashAfter makes the worker crash after it has received this many binary messages. Zero disables it.
+	CrashAfter int
+	// CrashOn makes the worker crash as soon as it receives one of these event types
+	CrashOn []cartaDefinitions.EventType
+	// MalformedRate is the probability (0 to 1) that a response is replaced with a malformed frame
+	MalformedRate float64
+	// Seed for the random number generator used for malformed frames, so that runs can be reproduced
+	Seed uint64
+}
+
+type Options struct {
+	// BaseFolder is the top level folder reported in the readiness line and used for file listings
+	BaseFolder string
+	// TileSize is the width and height of synthetic raster tiles
+	TileSize int
+	// Script overrides the synthetic responses for some event types
+	Script *Script
+	Faults Faults
+	// OnCrash is called when an injected crash is triggered, after all connections have been dropped. A mock worker
+	// running as its own process would normally exit here.
+	OnCrash func()
+}
+
+type Worker struct {
+	opts     Options
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	conns    map[*websocket.Conn]struct{}
+	received int
+	crashed  bool
+	rng      *rand.Rand
+}
+
+func New(opts Options) *Worker {
+	if opts.TileSize <= 0 {
+		opts.TileSize = 256
+	}
+	return &Worker{
+		opts: opts,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns: make(map[*websocket.Conn]struct{}),
+		rng:   rand.New(rand.NewPCG(opts.Faults.Seed, opts.Faults.Seed)),
+	}
+}
+
+// Serve accepts WebSocket connections on the listener until it is closed
+func (w *Worker) Serve(l net.Listener) error {
+	err := http.Serve(l, w)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (w *Worker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	conn, err := w.upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		slog.Error("Problem with HTTP upgrade", "error", err)
+		return
+	}
+	defer helpers.CloseOrLog(conn)
+
+	w.mu.Lock()
+	if w.crashed {
+		w.mu.Unlock()
+		return
+	}
+	w.conns[conn] = struct{}{}
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		delete(w.conns, conn)
+		w.mu.Unlock()
+	}()
+
+	c := &connection{worker: w, conn: conn, files: make(map[int32]*fileState)}
+	c.run()
+}
+
+// Crash drops every connection without a close handshake, as a segfaulting backend would, and calls OnCrash
+func (w *Worker) Crash() {
+	w.mu.Lock()
+	if w.crashed {
+		w.mu.Unlock()
+		return
+	}
+	w.crashed = true
+	for conn := range w.conns {
+		_ = conn.NetConn().Close()
+	}
+	w.mu.Unlock()
+
+	slog.Warn("Injected crash")
+	if w.opts.OnCrash != nil {
+		w.opts.OnCrash()
+	}
+}
+
+// countMessage records a received message and reports whether it should trigger a crash
+func (w *Worker) countMessage(eventType cartaDefinitions.EventType) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.received++
+	if w.opts.Faults.CrashAfter > 0 && w.received >= w.opts.Faults.CrashAfter {
+		return true
+	}
+	for _, crashType := range w.opts.Faults.CrashOn {
+		if crashType == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// malformed returns a corrupted version of the frame if a malformed response should be injected
+func (w *Worker) malformed(frame []byte) ([]byte, bool) {
+	if w.opts.Faults.MalformedRate <= 0 {
+		return nil, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.rng.Float64() >= w.opts.Faults.MalformedRate {
+		return nil, false
+	}
+
+	switch w.rng.IntN(3) {
+	case 0:
+		// Too short to contain the message prefix
+		return frame[:min(len(frame), 5)], true
+	case 1:
+		// Unsupported ICD version
+		corrupted := append([]byte{}, frame...)
+		binary.LittleEndian.PutUint16(corrupted[2:4], cartaHelpers.IcdVersion+1)
+		return corrupted, true
+	default:
+		// Valid prefix followed by a payload that is not valid protobuf
+		corrupted := append([]byte{}, frame[:8]...)
+		return append(corrupted, 0xff, 0xff, 0xff, 0xff, 0xff), true
+	}
+}
+
+type fileState struct {
+	channel int32
+	stokes  int32
+}
+
+// connection handles the messages from a single client, which in practice is the controller
+type connection struct {
+	worker *Worker
+	conn   *websocket.Conn
+	files  map[int32]*fileState
+}
+
+func (c *connection) run() {
+	for {
+		messageType, message, err := c.conn.ReadMessage()
+		if err != nil {
+			slog.Debug("Connection closed", "error", err)
+			return
+		}
+
+		if messageType == websocket.TextMessage && string(message) == "PING" {
+			if err := c.conn.WriteMessage(websocket.TextMessage, []byte("PONG")); err != nil {
+				slog.Error("Failed to send pong message", "error", err)
+			}
+			continue
+		}
+
+		if messageType != websocket.BinaryMessage {
+			slog.Warn("Ignoring non-binary message", "type", messageType)
+			continue
+		}
+
+		prefix, err := cartaHelpers.DecodeMessagePrefix(message)
+		if err != nil {
+			slog.Warn("Ignoring invalid message", "error", err)
+			continue
+		}
+		slog.Debug("Received message", "eventType", prefix.EventType, "requestId", prefix.RequestId)
+
+		if c.worker.countMessage(prefix.EventType) {
+			c.worker.Crash()
+			return
+		}
+
+		if err := c.handle(prefix, message[8:]); err != nil {
+			slog.Error("Error handling message", "eventType", prefix.EventType, "error", err)
+		}
+	}
+}
+
+func (c *connection) send(msg proto.Message, eventType cartaDefinitions.EventType, requestId uint32, delay time.Duration) error {
+	if total := delay + c.worker.opts.Faults.Delay; total > 0 {
+		time.Sleep(total)
+	}
+
+	frame, err := cartaHelpers.PrepareMessagePayload(msg, eventType, requestId)
+	if err != nil {
+		return err
+	}
+	if corrupted, ok := c.worker.malformed(frame); ok {
+		slog.Debug("Injecting malformed frame", "eventType", eventType)
+		frame = corrupted
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+func (c *connection) handle(prefix cartaHelpers.MessagePrefix, payload []byte) error {
+	if responses, ok := c.worker.opts.Script.lookup(prefix.EventType); ok {
+		for _, r := range responses {
+			if err := c.send(r.message, r.eventType, prefix.RequestId, r.delay); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch prefix.EventType {
+	case cartaDefinitions.EventType_REGISTER_VIEWER:
+		var req cartaDefinitions.RegisterViewer
+		if err := proto.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		return c.send(&cartaDefinitions.RegisterViewerAck{
+			SessionId: req.SessionId,
+			Success:   true,
+		}, cartaDefinitions.EventType_REGISTER_VIEWER_ACK, prefix.RequestId, 0)
+
+	case cartaDefinitions.EventType_OPEN_FILE:
+		var req cartaDefinitions.OpenFile
+		if err := proto.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		c.files[req.FileId] = &fileState{}
+		return c.send(&cartaDefinitions.OpenFileAck{
+			Success: true,
+			FileId:  req.FileId,
+		}, cartaDefinitions.EventType_OPEN_FILE_ACK, prefix.RequestId, 0)
+
+	case cartaDefinitions.EventType_CLOSE_FILE:
+		// The backend doesn't acknowledge closed files
+		var req cartaDefinitions.CloseFile
+		if err := proto.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		delete(c.files, req.FileId)
+		return nil
+
+	case cartaDefinitions.EventType_FILE_LIST_REQUEST:
+		var req cartaDefinitions.FileListRequest
+		if err := proto.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		parent := ""
+		if req.Directory != "" && req.Directory != "." {
+			parent = filepath.Dir(req.Directory)
+		}
+		return c.send(&cartaDefinitions.FileListResponse{
+			Success:   true,
+			Directory: req.Directory,
+			Parent:    parent,
+		}, cartaDefinitions.EventType_FILE_LIST_RESPONSE, prefix.RequestId, 0)
+
+	case cartaDefinitions.EventType_SET_IMAGE_CHANNELS:
+		var req cartaDefinitions.SetImageChannels
+		if err := proto.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		file := c.file(req.FileId)
+		file.channel = req.Channel
+		file.stokes = req.Stokes
+		if req.RequiredTiles == nil {
+			return nil
+		}
+		return c.sendTiles(req.RequiredTiles)
+
+	case cartaDefinitions.EventType_ADD_REQUIRED_TILES:
+		var req cartaDefinitions.AddRequiredTiles
+		if err := proto.Unmarshal(payload, &req); err != nil {
+			return err
+		}
+		return c.sendTiles(&req)
+
+	default:
+		slog.Debug("No mock response for event type", "eventType", prefix.EventType)
+		return nil
+	}
+}
+
+func (c *connection) file(fileId int32) *fileState {
+	file, ok := c.files[fileId]
+	if !ok {
+		file = &fileState{}
+		c.files[fileId] = file
+	}
+	return file
+}
+
+// sendTiles answers a tile request like the backend does: a sync message, one RASTER_TILE_DATA per tile, and a
+// closing sync message
+func (c *connection) sendTiles(req *cartaDefinitions.AddRequiredTiles) error {
+	file := c.file(req.FileId)
+	sync := &cartaDefinitions.RasterTileSync{
+		FileId:  req.FileId,
+		Channel: file.channel,
+		Stokes:  file.stokes,
+	}
+	if err := c.send(sync, cartaDefinitions.EventType_RASTER_TILE_SYNC, 0, 0); err != nil {
+		return err
+	}
+
+	size := int32(c.worker.opts.TileSize)
+	for _, encoded := range req.Tiles {
+		// Tiles are encoded as (layer << 24) | (y << 12) | x
+		tile := &cartaDefinitions.TileData{
+			Layer:     encoded >> 24,
+			Y:         (encoded >> 12) & 0xfff,
+			X:         encoded & 0xfff,
+			Width:     size,
+			Height:    size,
+			ImageData: syntheticImage(size, file.channel),
+		}
+		err := c.send(&cartaDefinitions.RasterTileData{
+			FileId:             req.FileId,
+			Channel:            file.channel,
+			Stokes:             file.stokes,
+			CompressionType:    req.CompressionType,
+			CompressionQuality: req.CompressionQuality,
+			Tiles:              []*cartaDefinitions.TileData{tile},
+		}, cartaDefinitions.EventType_RASTER_TILE_DATA, 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	sync.EndSync = true
+	return c.send(sync, cartaDefinitions.EventType_RASTER_TILE_SYNC, 0, 0)
+}
+
+// syntheticImage returns uncompressed float32 pixel data with a gradient that differs per channel
+func syntheticImage(size int32, channel int32) []byte {
+	data := make([]byte, 4*size*size)
+	for i := int32(0); i < size*size; i++ {
+		value := float32(i%size+i/size) + float32(channel)
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(value))
+	}
+	return data
+}
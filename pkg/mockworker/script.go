@@ -0,0 +1,113 @@
+package mockworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+)
+
+// Script replaces the synthetic responses for some event types with fixed ones. It is loaded from a JSON file of
+// the form:
+//
+//	{
+//	  "responses": {
+//	    "OPEN_FILE": [
+//	      {"eventType": "OPEN_FILE_ACK", "delay": "50ms", "message": {"success": false, "message": "File not found"}}
+//	    ]
+//	  }
+//	}
+//
+// Each message is given in the protobuf JSON mapping, and is sent with the request ID of the message that
+// triggered it.
+type Script struct {
+	responses map[cartaDefinitions.EventType][]scriptedResponse
+}
+
+type scriptedResponse struct {
+	eventType cartaDefinitions.EventType
+	delay     time.Duration
+	message   proto.Message
+}
+
+type scriptFile struct {
+	Responses map[string][]struct {
+		EventType string          `json:"eventType"`
+		Delay     string          `json:"delay"`
+		Message   json.RawMessage `json:"message"`
+	} `json:"responses"`
+}
+
+func parseEventType(name string) (cartaDefinitions.EventType, error) {
+	value, ok := cartaDefinitions.EventType_value[strings.ToUpper(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("unknown event type %q", name)
+	}
+	return cartaDefinitions.EventType(value), nil
+}
+
+// LoadScript reads a response script from a JSON file
+func LoadScript(path string) (*Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file scriptFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid script: %w", err)
+	}
+
+	script := &Script{responses: make(map[cartaDefinitions.EventType][]scriptedResponse)}
+	for requestName, responses := range file.Responses {
+		requestType, err := parseEventType(requestName)
+		if err != nil {
+			return nil, err
+		}
+
+		// An empty list is valid, and means that the request should not be answered
+		script.responses[requestType] = []scriptedResponse{}
+		for i, r := range responses {
+			response := scriptedResponse{}
+			response.eventType, err = parseEventType(r.EventType)
+			if err != nil {
+				return nil, fmt.Errorf("response %d to %s: %w", i, requestName, err)
+			}
+
+			if r.Delay != "" {
+				response.delay, err = time.ParseDuration(r.Delay)
+				if err != nil {
+					return nil, fmt.Errorf("response %d to %s: invalid delay: %w", i, requestName, err)
+				}
+			}
+
+			response.message, err = cartaHelpers.NewMessage(response.eventType)
+			if err != nil {
+				return nil, fmt.Errorf("response %d to %s: %w", i, requestName, err)
+			}
+			if len(r.Message) > 0 {
+				if err := protojson.Unmarshal(r.Message, response.message); err != nil {
+					return nil, fmt.Errorf("response %d to %s: invalid message: %w", i, requestName, err)
+				}
+			}
+			script.responses[requestType] = append(script.responses[requestType], response)
+		}
+	}
+	return script, nil
+}
+
+// lookup returns the scripted responses for a request, and whether the request type is scripted at all
+func (s *Script) lookup(eventType cartaDefinitions.EventType) ([]scriptedResponse, bool) {
+	if s == nil {
+		return nil, false
+	}
+	responses, ok := s.responses[eventType]
+	return responses, ok
+}
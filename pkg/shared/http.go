@@ -0,0 +1,24 @@
+package helpers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// WriteJSON writes data as a JSON response with the given status code
+func WriteJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		slog.Error("Error encoding JSON response", "err", err)
+	}
+}
+
+// WriteError writes a JSON error response with the status code and a message for the client
+func WriteError(w http.ResponseWriter, status int, message string) {
+	WriteJSON(w, status, map[string]any{
+		"status_code": status,
+		"message":     message,
+	})
+}
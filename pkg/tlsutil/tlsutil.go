@@ -0,0 +1,165 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/CARTAvis/go-carta/pkg/config"
+)
+
+// reloadDelay coalesces the bursts of file events produced when certificates are rotated
+const reloadDelay = 500 * time.Millisecond
+
+// Reloader holds a server certificate and optional client CA pool, and reloads them when their files change on disk
+type Reloader struct {
+	cfg config.TLSConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func NewReloader(cfg config.TLSConfig) (*Reloader, error) {
+	r := &Reloader{cfg: cfg}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		clientCAs, err = LoadCertPool(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	return nil
+}
+
+// ServerConfig returns a TLS configuration for an HTTP server that always uses the most recently loaded files.
+// Clients must present a certificate signed by the client CA if one is configured.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				c.ClientCAs = r.clientCAs
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}
+}
+
+// ClientCertificate returns the most recently loaded certificate, for presenting to servers that require client
+// certificates
+func (r *Reloader) ClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate, key and client CA when their files change, until ctx is done. The directories
+// containing the files are watched rather than the files themselves, so that files that are replaced rather than
+// rewritten, as with Kubernetes secret mounts, are picked up as well. If reloading fails, the previous files stay
+// in use.
+func (r *Reloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	var dirs []string
+	for _, file := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		dir := filepath.Dir(file)
+		if slices.Contains(dirs, dir) {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return fmt.Errorf("error watching %s: %w", dir, err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	go func() {
+		defer func() {
+			if err := watcher.Close(); err != nil {
+				slog.Error("Error closing certificate watcher", "error", err)
+			}
+		}()
+
+		reload := time.NewTimer(reloadDelay)
+		reload.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) {
+					continue
+				}
+				reload.Reset(reloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Certificate watcher error", "error", err)
+			case <-reload.C:
+				if err := r.reload(); err != nil {
+					slog.Error("Failed to reload TLS certificate, keeping the previous one", "error", err)
+					continue
+				}
+				slog.Info("Reloaded TLS certificate", "certFile", r.cfg.CertFile)
+			}
+		}
+	}()
+	return nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,220 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CARTAvis/go-carta/pkg/config"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate and key signed by the CA to the given files
+func (ca *testCA) issue(t *testing.T, serial int64, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedSerial connects to a server and returns the serial number of its certificate
+func servedSerial(t *testing.T, client *http.Client, url string) int64 {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+}
+
+func startServer(t *testing.T, r *Reloader) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = r.ServerConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testClient(ca *testCA, cert func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, GetClientCertificate: cert},
+		DisableKeepAlives: true,
+	}}
+}
+
+func TestReloaderServesCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cfg := config.TLSConfig{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	ca.issue(t, 2, cfg.CertFile, cfg.KeyFile)
+
+	r, err := NewReloader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, r)
+	if serial := servedSerial(t, testClient(ca, nil), server.URL); serial != 2 {
+		t.Errorf("served certificate %d, want 2", serial)
+	}
+}
+
+func TestReloaderRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cfg := config.TLSConfig{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	ca.issue(t, 2, cfg.CertFile, cfg.KeyFile)
+	writeFile(t, cfg.ClientCAFile, ca.pem)
+
+	r, err := NewReloader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, r)
+	if _, err := testClient(ca, nil).Get(server.URL); err == nil {
+		t.Error("connected without a client certificate")
+	}
+	// The server's own certificate is signed by the same CA, so it can be presented as a client certificate as well
+	if serial := servedSerial(t, testClient(ca, r.ClientCertificate), server.URL); serial != 2 {
+		t.Errorf("served certificate %d, want 2", serial)
+	}
+}
+
+func TestReloaderWatchesFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cfg := config.TLSConfig{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	ca.issue(t, 2, cfg.CertFile, cfg.KeyFile)
+
+	r, err := NewReloader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := r.Watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, r)
+	client := testClient(ca, nil)
+
+	// Rotated files are picked up
+	ca.issue(t, 3, cfg.CertFile, cfg.KeyFile)
+	waitForSerial(t, client, server.URL, 3)
+
+	// A broken certificate is not, and the previous one stays in use
+	writeFile(t, cfg.CertFile, []byte("not a certificate"))
+	time.Sleep(2 * reloadDelay)
+	if serial := servedSerial(t, client, server.URL); serial != 3 {
+		t.Errorf("served certificate %d after a failed reload, want 3", serial)
+	}
+}
+
+func waitForSerial(t *testing.T, client *http.Client, url string, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial(t, client, url) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for certificate %d to be served", want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNewReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	ca.issue(t, 2, certFile, keyFile)
+	emptyCA := filepath.Join(dir, "empty.crt")
+	writeFile(t, emptyCA, nil)
+
+	for name, cfg := range map[string]config.TLSConfig{
+		"MissingCertificate": {CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile},
+		"MissingClientCA":    {CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "missing.crt")},
+		"EmptyClientCA":      {CertFile: certFile, KeyFile: keyFile, ClientCAFile: emptyCA},
+	} {
+		if _, err := NewReloader(cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
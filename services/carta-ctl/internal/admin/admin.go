@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/session"
+)
+
+// AdminConfig holds the settings for the admin API, which is used by operators to inspect and manage live sessions
+type AdminConfig struct {
+	// Groups whose members are allowed to use the admin API
+	AllowedGroups []string
+}
+
+// requireAdmin rejects requests from users that are not members of one of the admin groups
+func (h *AdminConfig) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := r.Context().Value(session.UserContextKey).(*auth.User)
+		if !user.InGroup(h.AllowedGroups...) {
+			slog.Warn("Rejected admin API request", "user", user, "method", r.Method, "path", r.URL.Path)
+			helpers.WriteError(w, http.StatusForbidden, "Admin access required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *AdminConfig) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := session.List()
+	summaries := make([]session.Summary, 0, len(sessions))
+	for _, s := range sessions {
+		summaries = append(summaries, s.Summary())
+	}
+	helpers.WriteJSON(w, http.StatusOK, summaries)
+}
+
+func (h *AdminConfig) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := session.Get(r.PathValue("id"))
+	if !ok {
+		helpers.WriteError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	helpers.WriteJSON(w, http.StatusOK, s.Details())
+}
+
+func (h *AdminConfig) handleTerminateSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := session.Get(r.PathValue("id"))
+	if !ok {
+		helpers.WriteError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "Session terminated by administrator"
+	}
+
+	user, _ := r.Context().Value(session.UserContextKey).(*auth.User)
+	slog.Info("Admin terminating session", "admin", user.Username, "sessionId", s.ID, "reason", reason)
+
+	if err := s.Terminate(reason); err != nil {
+		helpers.WriteError(w, http.StatusInternalServerError, "Failed to terminate session: "+err.Error())
+		return
+	}
+	helpers.WriteJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
+
+func (h *AdminConfig) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Message == "" {
+		helpers.WriteError(w, http.StatusBadRequest, "Request body must be a JSON object with a non-empty message")
+		return
+	}
+
+	user, _ := r.Context().Value(session.UserContextKey).(*auth.User)
+	slog.Info("Admin broadcasting maintenance notice", "admin", user.Username, "message", body.Message)
+
+	delivered := session.Broadcast(cartaDefinitions.ErrorSeverity_WARNING, []string{"maintenance"}, body.Message)
+	helpers.WriteJSON(w, http.StatusOK, map[string]any{
+		"success":   true,
+		"delivered": delivered,
+	})
+}
+
+func (h *AdminConfig) Router() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /sessions", http.HandlerFunc(h.handleListSessions))
+	mux.Handle("GET /session/{id}", http.HandlerFunc(h.handleGetSession))
+	mux.Handle("DELETE /session/{id}", http.HandlerFunc(h.handleTerminateSession))
+	mux.Handle("POST /broadcast", http.HandlerFunc(h.handleBroadcast))
+
+	return h.requireAdmin(mux)
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"time"
+
+	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+)
+
+// API serves the endpoints that the frontend uses to refresh and end logins
+type API struct {
+	// Managers are the authenticators whose session cookies are refreshed and cleared. If there are none, logins
+	// never expire.
+	Managers []SessionManager
+	// OnLogout is called with the user of each login that is ended, so that its live sessions can be closed
+	OnLogout func(u *User)
+}
+
+type refreshResponse struct {
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+	// ExpiresIn is the number of seconds until the login expires
+	ExpiresIn int64 `json:"expiresIn,omitempty"`
+}
+
+func (a API) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if len(a.Managers) == 0 {
+		helpers.WriteJSON(w, http.StatusOK, refreshResponse{Username: "anonymous"})
+		return
+	}
+
+	for _, m := range a.Managers {
+		user, expiry, err := m.RefreshSession(w, r)
+		if errors.Is(err, ErrNoSession) {
+			continue
+		}
+		if err != nil {
+			slog.Warn("Failed to refresh session", "error", err)
+			helpers.WriteError(w, http.StatusUnauthorized, "Session could not be refreshed")
+			return
+		}
+		slog.Debug("Refreshed session", "username", user.Username, "source", user.Source, "expiresAt", expiry)
+		helpers.WriteJSON(w, http.StatusOK, refreshResponse{
+			Username:  user.Username,
+			ExpiresAt: expiry,
+			ExpiresIn: int64(time.Until(expiry).Seconds()),
+		})
+		return
+	}
+	helpers.WriteError(w, http.StatusUnauthorized, "Not logged in")
+}
+
+func (a API) handleLogout(w http.ResponseWriter, r *http.Request) {
+	for _, m := range a.Managers {
+		user := m.EndSession(w, r)
+		if user == nil {
+			continue
+		}
+		slog.Info("User logged out", "username", user.Username, "source", user.Source)
+		if a.OnLogout != nil {
+			a.OnLogout(user)
+		}
+	}
+
+	// Browsers that logged out through the confirmation page are sent back to the login page
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+		http.Redirect(w, r, Path("/"), http.StatusSeeOther)
+		return
+	}
+	helpers.WriteJSON(w, http.StatusOK, map[string]any{
+		"status_code": http.StatusOK,
+		"message":     "Logged out",
+	})
+}
+
+var logoutPage = template.Must(template.New("logout").Parse(`<!doctype html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <title>Log out of CARTA</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+  </head>
+  <body>
+    <form method="POST" action="{{ . }}">
+      <p>Logging out closes all of your CARTA sessions.</p>
+      <button type="submit">Log out</button>
+    </form>
+  </body>
+</html>
+`))
+
+// handleLogoutPage asks the user to confirm logging out. The frontend navigates to the logout address, but so could
+// any other site, as the session cookies are sent with top-level navigations. Logging out is therefore left to the
+// form's POST request, which browsers don't send the cookies with from other sites.
+func (a API) handleLogoutPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := logoutPage.Execute(w, Path("/api/auth/logout")); err != nil {
+		slog.Error("Failed to render logout page", "error", err)
+	}
+}
+
+// Router returns the handler for the auth API, which expects paths relative to /api/auth
+func (a API) Router() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("POST /refresh", http.HandlerFunc(a.handleRefresh))
+	mux.Handle("GET /logout", http.HandlerFunc(a.handleLogoutPage))
+	mux.Handle("POST /logout", http.HandlerFunc(a.handleLogout))
+
+	return mux
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeManager is a SessionManager whose login is always held by the same user
+type fakeManager struct {
+	ended int
+}
+
+func (m *fakeManager) RefreshSession(w http.ResponseWriter, r *http.Request) (*User, time.Time, error) {
+	return &User{Username: "alice"}, time.Now().Add(time.Hour), nil
+}
+
+func (m *fakeManager) EndSession(w http.ResponseWriter, r *http.Request) *User {
+	m.ended++
+	return &User{Username: "alice", LoginID: "login"}
+}
+
+func TestLogoutNeedsPost(t *testing.T) {
+	manager := &fakeManager{}
+	var loggedOut []string
+	api := API{
+		Managers: []SessionManager{manager},
+		OnLogout: func(u *User) { loggedOut = append(loggedOut, u.LoginID) },
+	}
+	router := api.Router()
+
+	// Other sites can make browsers navigate to the logout address, so a GET only asks for confirmation
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/logout", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<form method="POST"`) {
+		t.Errorf("GET /logout returned %d without a confirmation form", rec.Code)
+	}
+	if manager.ended != 0 || len(loggedOut) != 0 {
+		t.Fatal("GET /logout ended the login")
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/logout", nil))
+	if rec.Code != http.StatusOK || manager.ended != 1 || len(loggedOut) != 1 {
+		t.Errorf("POST /logout returned %d and ended %d logins, want 200 and 1", rec.Code, manager.ended)
+	}
+
+	// The confirmation form is sent back to the login page
+	request := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(""))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, request)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != Path("/") {
+		t.Errorf("form POST /logout returned %d to %q, want a redirect to the login page", rec.Code, rec.Header().Get("Location"))
+	}
+}
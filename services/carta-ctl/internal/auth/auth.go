@@ -2,9 +2,28 @@
 package auth
 
 import (
+	"errors"
 	"net/http"
+	"time"
+
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/proxy"
 )
 
+// BasePath is the URL prefix that the controller is served under, without a trailing slash. It is set at startup
+var BasePath string
+
+// Path prefixes an absolute path on the controller with BasePath, for use in redirects and cookie paths
+func Path(p string) string {
+	return BasePath + p
+}
+
+// SecureCookie reports whether cookies set in response to a request should be marked as HTTPS-only, which is the
+// case when the client reached the controller over HTTPS, directly or through a trusted proxy
+func SecureCookie(r *http.Request) bool {
+	return proxy.Scheme(r) == "https"
+}
+
 type Source string
 
 const (
@@ -12,18 +31,45 @@ const (
 	SourceOIDC Source = "oidc"
 )
 
+var logins = metrics.NewCounterVec("carta_auth_logins_total", "Number of login attempts by source and result", "source", "result")
+
+// RecordLogin counts a login attempt, which failed if err is not nil
+func RecordLogin(source Source, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	logins.WithLabelValues(string(source), result).Inc()
+}
+
 type User struct {
 	Username string
 	UID      string
 	Groups   []string
 	Source   Source
 	Claims   map[string]any
+	// LoginID identifies the login that the user authenticated with, so that its sessions can be found on logout.
+	// It is empty for anonymous users.
+	LoginID string
 }
 
 type Authenticator interface {
 	AuthenticateHTTP(w http.ResponseWriter, r *http.Request) (*User, error)
 }
 
+// ErrNoSession is returned by a SessionManager when the request doesn't carry its session cookie
+var ErrNoSession = errors.New("no session cookie")
+
+// SessionManager is implemented by authenticators that keep logins in a session cookie, which can be refreshed and
+// revoked through the auth API
+type SessionManager interface {
+	// RefreshSession extends the login in the request's session cookie and returns its user and new expiry
+	RefreshSession(w http.ResponseWriter, r *http.Request) (*User, time.Time, error)
+	// EndSession clears the session cookie and revokes its login. It returns the user that was logged in, or nil if
+	// the cookie didn't hold a valid login.
+	EndSession(w http.ResponseWriter, r *http.Request) *User
+}
+
 // NoopAuthenticator – used when authMode=none
 type NoopAuthenticator struct{}
 
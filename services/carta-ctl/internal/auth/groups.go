@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"os/user"
+	"slices"
+)
+
+// LookupUnixUser returns the UID and group names of a local system user
+func LookupUnixUser(username string) (string, []string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return "", nil, err
+	}
+
+	gids, err := u.GroupIds()
+	if err != nil {
+		return u.Uid, nil, err
+	}
+
+	groups := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return u.Uid, groups, nil
+}
+
+// InGroup checks whether the user belongs to any of the given groups
+func (u *User) InGroup(groups ...string) bool {
+	if u == nil {
+		return false
+	}
+	for _, g := range groups {
+		if slices.Contains(u.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
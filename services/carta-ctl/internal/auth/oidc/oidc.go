@@ -3,10 +3,14 @@ package oidc
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	gooidc "github.com/coreos/go-oidc/v3/oidc"
@@ -14,14 +18,36 @@ import (
 
 	"github.com/CARTAvis/go-carta/pkg/config"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/proxy"
 )
 
 const sessionCookieName = "carta_oidc"
 
 type OIDCAuthenticator struct {
-	provider *gooidc.Provider
-	verifier *gooidc.IDTokenVerifier
-	oauth2   *oauth2.Config
+	issuerURL string
+	provider  *gooidc.Provider
+	verifier  *gooidc.IDTokenVerifier
+	oauth2    *oauth2.Config
+
+	// logins holds the login behind each ID token issued as a session cookie, keyed by tokenKey. Tokens that have
+	// been refreshed or logged out stay tied to their login until it expires, so that they are revoked with it
+	mu     sync.Mutex
+	logins map[string]*oidcLogin
+}
+
+// oidcLogin is a browser login, which keeps its ID across refreshes of its ID token. Its fields other than id are
+// guarded by the authenticator's mu
+type oidcLogin struct {
+	id           string
+	username     string
+	refreshToken string
+	expiry       time.Time
+}
+
+// tokenKey identifies an ID token without keeping the token itself
+func tokenKey(rawIDToken string) string {
+	sum := sha256.Sum256([]byte(rawIDToken))
+	return hex.EncodeToString(sum[:])
 }
 
 func New(cfg config.OIDCConfig) *OIDCAuthenticator {
@@ -52,12 +78,20 @@ func New(cfg config.OIDCConfig) *OIDCAuthenticator {
 	}
 
 	return &OIDCAuthenticator{
-		provider: provider,
-		verifier: verifier,
-		oauth2:   oauth2cfg,
+		issuerURL: cfg.IssuerURL,
+		provider:  provider,
+		verifier:  verifier,
+		oauth2:    oauth2cfg,
+		logins:    make(map[string]*oidcLogin),
 	}
 }
 
+// CheckDiscovery fetches the provider's discovery document, to check that logins can be handled
+func (o *OIDCAuthenticator) CheckDiscovery(ctx context.Context) error {
+	_, err := gooidc.NewProvider(ctx, o.issuerURL)
+	return err
+}
+
 // AuthenticateHTTP implements auth.Authenticator.
 //
 // Behaviour for browser flows:
@@ -100,17 +134,27 @@ func (o *OIDCAuthenticator) AuthenticateHTTP(w http.ResponseWriter, r *http.Requ
 	}
 
 	// 3. No session → redirect browser to login
-	http.Redirect(w, r, "/oidc/login", http.StatusFound)
+	http.Redirect(w, r, auth.Path("/oidc/login"), http.StatusFound)
 	return nil, fmt.Errorf("no OIDC session")
 }
 
+// redirectURLOptions derives the callback URL from the request when no redirect URL is configured, using the public
+// scheme and host reported by a trusted proxy if there is one
+func (o *OIDCAuthenticator) redirectURLOptions(r *http.Request) []oauth2.AuthCodeOption {
+	if o.oauth2.RedirectURL != "" {
+		return nil
+	}
+	callback := fmt.Sprintf("%s://%s%s", proxy.Scheme(r), r.Host, auth.Path("/oidc/callback"))
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("redirect_uri", callback)}
+}
+
 // LoginHandler redirects the user to Keycloak's authorization endpoint.
 func (o *OIDCAuthenticator) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	// You can generate and store a proper state value; for now use a fixed one
 	// or something simple. In production, use a random per-session value.
 	state := "carta-state"
 
-	url := o.oauth2.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	url := o.oauth2.AuthCodeURL(state, append(o.redirectURLOptions(r), oauth2.AccessTypeOffline)...)
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
@@ -122,21 +166,24 @@ func (o *OIDCAuthenticator) CallbackHandler(w http.ResponseWriter, r *http.Reque
 
 	if errParam := r.URL.Query().Get("error"); errParam != "" {
 		desc := r.URL.Query().Get("error_description")
+		auth.RecordLogin(auth.SourceOIDC, errors.New(errParam))
 		http.Error(w, fmt.Sprintf("OIDC error: %s (%s)", errParam, desc), http.StatusUnauthorized)
 		return
 	}
 
 	code := r.URL.Query().Get("code")
 	if code == "" {
+		auth.RecordLogin(auth.SourceOIDC, errors.New("missing code"))
 		http.Error(w, "Missing code", http.StatusBadRequest)
 		return
 	}
 
 	// TODO: validate 'state' if you generate a random one in LoginHandler
 
-	oauth2Token, err := o.oauth2.Exchange(ctx, code)
+	oauth2Token, err := o.oauth2.Exchange(ctx, code, o.redirectURLOptions(r)...)
 	if err != nil {
 		slog.Error("OIDC: code exchange failed", "error", err)
+		auth.RecordLogin(auth.SourceOIDC, err)
 		http.Error(w, "Code exchange failed", http.StatusUnauthorized)
 		return
 	}
@@ -144,6 +191,7 @@ func (o *OIDCAuthenticator) CallbackHandler(w http.ResponseWriter, r *http.Reque
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok || rawIDToken == "" {
 		slog.Error("OIDC: no id_token in token response")
+		auth.RecordLogin(auth.SourceOIDC, errors.New("no id_token"))
 		http.Error(w, "No id_token in token response", http.StatusUnauthorized)
 		return
 	}
@@ -152,32 +200,171 @@ func (o *OIDCAuthenticator) CallbackHandler(w http.ResponseWriter, r *http.Reque
 	user, err := o.verifyRawToken(ctx, rawIDToken)
 	if err != nil {
 		slog.Error("OIDC: id_token verification failed", "error", err)
+		auth.RecordLogin(auth.SourceOIDC, err)
 		http.Error(w, "Invalid id_token", http.StatusUnauthorized)
 		return
 	}
 
-	// Store the raw ID token in a session cookie. It's already signed by Keycloak;
-	// we will re-verify it on each request via verifySessionCookie.
-	expiry := time.Now().Add(8 * time.Hour)
+	o.setSessionCookie(w, r, rawIDToken, &oidcLogin{
+		id:           auth.NewLoginID(),
+		username:     user.Username,
+		refreshToken: oauth2Token.RefreshToken,
+	})
+
+	slog.Info("OIDC: login successful", "username", user.Username)
+	auth.RecordLogin(auth.SourceOIDC, nil)
+
+	http.Redirect(w, r, auth.Path("/"), http.StatusFound)
+}
+
+// setSessionCookie stores the raw ID token in a session cookie and remembers the login that it belongs to. The token
+// is already signed by Keycloak; we will re-verify it on each request via verifySessionCookie.
+func (o *OIDCAuthenticator) setSessionCookie(w http.ResponseWriter, r *http.Request, rawIDToken string, login *oidcLogin) {
+	now := time.Now()
+	expiry := now.Add(auth.SessionLifetime)
+
+	o.mu.Lock()
+	login.expiry = expiry
+	for key, l := range o.logins {
+		if now.After(l.expiry) {
+			delete(o.logins, key)
+		}
+	}
+	o.logins[tokenKey(rawIDToken)] = login
+	o.mu.Unlock()
 
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    rawIDToken,
-		Path:     "/",
+		Path:     auth.Path("/"),
 		HttpOnly: true,
-		Secure:   false, // set true if you serve over HTTPS
+		Secure:   auth.SecureCookie(r),
 		SameSite: http.SameSiteLaxMode,
 		Expires:  expiry,
 	})
+}
 
-	slog.Info("OIDC: login successful", "username", user.Username)
-
-	http.Redirect(w, r, "/", http.StatusFound)
+// loginID returns the ID of the login that an ID token was issued for. Tokens issued before the controller restarted
+// are identified by the token itself.
+func (o *OIDCAuthenticator) loginID(rawIDToken string) string {
+	key := tokenKey(rawIDToken)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if login, ok := o.logins[key]; ok {
+		return login.id
+	}
+	return key
 }
 
 // verifySessionCookie takes the cookie value (raw ID token) and verifies it.
 func (o *OIDCAuthenticator) verifySessionCookie(ctx context.Context, rawIDToken string) (*auth.User, error) {
-	return o.verifyRawToken(ctx, rawIDToken)
+	user, err := o.verifyRawToken(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	user.LoginID = o.loginID(rawIDToken)
+	if auth.LoginRevoked(user.LoginID) {
+		return nil, fmt.Errorf("session revoked")
+	}
+	return user, nil
+}
+
+// RefreshSession implements auth.SessionManager. It uses the login's refresh token to obtain a new ID token, which
+// replaces the one in the session cookie, and returns the new token's expiry.
+func (o *OIDCAuthenticator) RefreshSession(w http.ResponseWriter, r *http.Request) (*auth.User, time.Time, error) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil || c.Value == "" {
+		return nil, time.Time{}, auth.ErrNoSession
+	}
+
+	key := tokenKey(c.Value)
+	o.mu.Lock()
+	login, ok := o.logins[key]
+	var refreshToken string
+	var expiry time.Time
+	if ok {
+		refreshToken, expiry = login.refreshToken, login.expiry
+	}
+	o.mu.Unlock()
+	if !ok || time.Now().After(expiry) {
+		return nil, time.Time{}, errors.New("unknown or expired OIDC login")
+	}
+	if auth.LoginRevoked(login.id) {
+		return nil, time.Time{}, errors.New("session revoked")
+	}
+	if refreshToken == "" {
+		return nil, time.Time{}, errors.New("OIDC provider did not issue a refresh token")
+	}
+
+	ctx := r.Context()
+	oauth2Token, err := o.oauth2.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("token refresh failed: %w", err)
+	}
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, time.Time{}, errors.New("no id_token in token response")
+	}
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("id_token verification failed: %w", err)
+	}
+	user, err := newUser(idToken)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// The new token joins the old one in the login, so that logging out with either revokes both. Providers may
+	// rotate refresh tokens, in which case the old one can't be used again
+	o.mu.Lock()
+	login.username = user.Username
+	if oauth2Token.RefreshToken != "" {
+		login.refreshToken = oauth2Token.RefreshToken
+	}
+	o.mu.Unlock()
+	o.setSessionCookie(w, r, rawIDToken, login)
+
+	user.LoginID = login.id
+	return user, idToken.Expiry, nil
+}
+
+// EndSession implements auth.SessionManager by clearing the session cookie and revoking its login
+func (o *OIDCAuthenticator) EndSession(w http.ResponseWriter, r *http.Request) *auth.User {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     auth.Path("/"),
+		HttpOnly: true,
+		Secure:   auth.SecureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+
+	// The login is kept, so that every token issued for it is still recognised as revoked
+	key := tokenKey(c.Value)
+	o.mu.Lock()
+	login, ok := o.logins[key]
+	var username string
+	if ok {
+		username = login.username
+	}
+	o.mu.Unlock()
+	if ok {
+		auth.RevokeLogin(login.id)
+		return &auth.User{Username: username, Source: auth.SourceOIDC, LoginID: login.id}
+	}
+
+	user, err := o.verifyRawToken(r.Context(), c.Value)
+	if err != nil {
+		return nil
+	}
+	user.LoginID = key
+	auth.RevokeLogin(key)
+	return user
 }
 
 // verifyRawToken verifies an ID token string and builds an auth.User from it.
@@ -186,6 +373,11 @@ func (o *OIDCAuthenticator) verifyRawToken(ctx context.Context, raw string) (*au
 	if err != nil {
 		return nil, fmt.Errorf("verifyRawToken: %w", err)
 	}
+	return newUser(idToken)
+}
+
+// newUser builds an auth.User from the claims of a verified ID token
+func newUser(idToken *gooidc.IDToken) (*auth.User, error) {
 
 	var claims struct {
 		Email         string `json:"email"`
@@ -214,9 +406,21 @@ func (o *OIDCAuthenticator) verifyRawToken(ctx context.Context, raw string) (*au
 		allClaims = map[string]any{}
 	}
 
+	// Group membership is conventionally provided as a "groups" claim containing a list of strings
+	var groups []string
+	if rawGroups, ok := allClaims["groups"].([]any); ok {
+		for _, g := range rawGroups {
+			if name, ok := g.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	}
+
 	// Be careful not to blow up logs; but store claims in the User struct.
 	user := &auth.User{
 		Username: username,
+		UID:      idToken.Subject,
+		Groups:   groups,
 		Source:   auth.SourceOIDC,
 		Claims:   allClaims,
 	}
@@ -0,0 +1,139 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+)
+
+const (
+	testIssuer   = "https://issuer.example"
+	testClientID = "carta"
+)
+
+// testProvider signs ID tokens and answers refresh requests like an OIDC provider
+type testProvider struct {
+	t      *testing.T
+	key    *rsa.PrivateKey
+	issued atomic.Int64
+}
+
+// idToken returns a new signed ID token for a user. Each token is different, as it carries its own ID.
+func (p *testProvider) idToken(username string) string {
+	p.t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":                testIssuer,
+		"aud":                testClientID,
+		"sub":                username,
+		"preferred_username": username,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"jti":                p.issued.Add(1),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newTestAuthenticator returns an authenticator that trusts the provider, and refreshes logins through it
+func newTestAuthenticator(t *testing.T) (*OIDCAuthenticator, *testProvider) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{t: t, key: key}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "access",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"refresh_token": "rotated",
+			"id_token":      p.idToken("alice"),
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	keySet := &gooidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&key.PublicKey}}
+	return &OIDCAuthenticator{
+		issuerURL: testIssuer,
+		verifier:  gooidc.NewVerifier(testIssuer, keySet, &gooidc.Config{ClientID: testClientID}),
+		oauth2:    &oauth2.Config{ClientID: testClientID, Endpoint: oauth2.Endpoint{TokenURL: server.URL}},
+		logins:    make(map[string]*oidcLogin),
+	}, p
+}
+
+// withCookie returns a request carrying an ID token in the session cookie
+func withCookie(rawIDToken string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: rawIDToken})
+	return r
+}
+
+// sessionCookie returns the session cookie set in a response
+func sessionCookie(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			return c.Value
+		}
+	}
+	t.Fatal("no session cookie was set")
+	return ""
+}
+
+func TestLogoutAfterRefreshRevokesEarlierTokens(t *testing.T) {
+	o, provider := newTestAuthenticator(t)
+	original := provider.idToken("alice")
+	o.setSessionCookie(httptest.NewRecorder(), withCookie(""), original, &oidcLogin{id: auth.NewLoginID(), username: "alice", refreshToken: "refresh"})
+
+	rec := httptest.NewRecorder()
+	user, _, err := o.RefreshSession(rec, withCookie(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed := sessionCookie(t, rec)
+	if refreshed == original {
+		t.Fatal("refresh kept the same ID token")
+	}
+	before, err := o.verifySessionCookie(t.Context(), original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.LoginID != user.LoginID {
+		t.Errorf("token from before the refresh has login %q, want the login %q it was refreshed in", before.LoginID, user.LoginID)
+	}
+
+	ended := o.EndSession(httptest.NewRecorder(), withCookie(refreshed))
+	if ended == nil || ended.LoginID != user.LoginID {
+		t.Fatalf("EndSession returned %+v, want the refreshed login", ended)
+	}
+	for name, token := range map[string]string{"original": original, "refreshed": refreshed} {
+		if _, err := o.verifySessionCookie(t.Context(), token); err == nil || !strings.Contains(err.Error(), "revoked") {
+			t.Errorf("%s token accepted after logging out, error %v", name, err)
+		}
+	}
+	if _, _, err := o.RefreshSession(httptest.NewRecorder(), withCookie(original)); err == nil {
+		t.Error("token from before the refresh could be refreshed after logging out")
+	}
+}
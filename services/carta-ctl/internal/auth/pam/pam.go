@@ -16,6 +16,8 @@ import (
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
 )
 
+const sessionCookieName = "carta_session"
+
 type PAMAuthenticator struct {
 	serviceName string
 }
@@ -45,26 +47,36 @@ func (p *PAMAuthenticator) AuthenticateCredentials(ctx context.Context, username
 		return nil, err
 	}
 
-	// You can look up UID/groups here if you want.
-	return &auth.User{
+	return newUser(username), nil
+}
+
+// newUser builds an auth.User for a PAM-authenticated user, including their UID and groups from the local system
+func newUser(username string) *auth.User {
+	user := &auth.User{
 		Username: username,
 		Source:   auth.SourcePAM,
 		Claims:   map[string]any{},
-	}, nil
+	}
+
+	uid, groups, err := auth.LookupUnixUser(username)
+	if err != nil {
+		log.Printf("PAM: failed to look up groups for %s: %v", username, err)
+	}
+	user.UID = uid
+	user.Groups = groups
+	return user
 }
 
 // AuthenticateHTTP implements the auth.Authenticator interface.
 // It checks for a valid session cookie; if missing/invalid, redirects to /pam-login.
 func (p *PAMAuthenticator) AuthenticateHTTP(w http.ResponseWriter, r *http.Request) (*auth.User, error) {
 	// 1. Check session cookie
-	if c, err := r.Cookie("carta_session"); err == nil {
-		username, err := auth.VerifySessionToken(c.Value)
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		claims, err := auth.VerifySessionToken(c.Value)
 		if err == nil {
-			return &auth.User{
-				Username: username,
-				Source:   auth.SourcePAM,
-				Claims:   map[string]any{},
-			}, nil
+			user := newUser(claims.Username)
+			user.LoginID = claims.LoginID
+			return user, nil
 		}
 		log.Printf("PAM session cookie invalid: %v", err)
 	}
@@ -72,7 +84,7 @@ func (p *PAMAuthenticator) AuthenticateHTTP(w http.ResponseWriter, r *http.Reque
 	// 2. No valid session → redirect to login page
 	// Avoid infinite loop: don't redirect /pam-login to itself.
 	if r.URL.Path != "/pam-login" {
-		http.Redirect(w, r, "/pam-login", http.StatusFound)
+		http.Redirect(w, r, auth.Path("/pam-login"), http.StatusFound)
 	} else {
 		// If somehow we get here for /pam-login itself, just let the handler deal with it.
 		w.WriteHeader(http.StatusUnauthorized)
@@ -81,21 +93,71 @@ func (p *PAMAuthenticator) AuthenticateHTTP(w http.ResponseWriter, r *http.Reque
 }
 
 // Helper: sets session cookie for a user.
-func SetPAMSessionCookie(w http.ResponseWriter, username string) error {
-	expiry := time.Now().Add(8 * time.Hour)
-	token, err := auth.GenerateSessionToken(username, expiry)
+func SetPAMSessionCookie(w http.ResponseWriter, r *http.Request, username string) error {
+	_, err := setSessionCookie(w, r, username, auth.NewLoginID())
+	return err
+}
+
+// setSessionCookie issues a session token for a login and returns its expiry
+func setSessionCookie(w http.ResponseWriter, r *http.Request, username, loginID string) (time.Time, error) {
+	expiry := time.Now().Add(auth.SessionLifetime)
+	token, err := auth.GenerateSessionToken(username, loginID, expiry)
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 
 	http.SetCookie(w, &http.Cookie{
-		Name:     "carta_session",
+		Name:     sessionCookieName,
 		Value:    token,
-		Path:     "/",
+		Path:     auth.Path("/"),
 		HttpOnly: true,
-		Secure:   false, // set true if serving over HTTPS
+		Secure:   auth.SecureCookie(r),
 		SameSite: http.SameSiteLaxMode,
 		Expires:  expiry,
 	})
-	return nil
+	return expiry, nil
+}
+
+// RefreshSession implements auth.SessionManager by reissuing the session token with a new expiry
+func (p *PAMAuthenticator) RefreshSession(w http.ResponseWriter, r *http.Request) (*auth.User, time.Time, error) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil || c.Value == "" {
+		return nil, time.Time{}, auth.ErrNoSession
+	}
+	claims, err := auth.VerifySessionToken(c.Value)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	expiry, err := setSessionCookie(w, r, claims.Username, claims.LoginID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	user := newUser(claims.Username)
+	user.LoginID = claims.LoginID
+	return user, expiry, nil
+}
+
+// EndSession implements auth.SessionManager by clearing the session cookie and revoking its login
+func (p *PAMAuthenticator) EndSession(w http.ResponseWriter, r *http.Request) *auth.User {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     auth.Path("/"),
+		HttpOnly: true,
+		Secure:   auth.SecureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+
+	claims, err := auth.VerifySessionToken(c.Value)
+	if err != nil {
+		return nil
+	}
+	auth.RevokeLogin(claims.LoginID)
+	return &auth.User{Username: claims.Username, Source: auth.SourcePAM, LoginID: claims.LoginID}
 }
@@ -15,6 +15,7 @@ var ErrUnsupported = errors.New("PAM auth is only supported on Linux")
 // Authenticator is what main.go needs.
 type Authenticator interface {
 	auth.Authenticator
+	auth.SessionManager
 	AuthenticateCredentials(ctx context.Context, username, password string) (*auth.User, error)
 }
 
@@ -22,7 +23,7 @@ func New(cfg config.PAMConfig) (Authenticator, error) {
 	return newImpl(cfg)
 }
 
-func SetSessionCookie(w http.ResponseWriter, username string) error {
+func SetSessionCookie(w http.ResponseWriter, r *http.Request, username string) error {
 	slog.Debug("Setting PAM session cookie")
-	return setSessionCookieImpl(w, username)
+	return setSessionCookieImpl(w, r, username)
 }
@@ -13,6 +13,6 @@ func newImpl(cfg config.PAMConfig) (Authenticator, error) {
 	return authpam.New(cfg), nil
 }
 
-func setSessionCookieImpl(w http.ResponseWriter, username string) error {
-	return authpam.SetPAMSessionCookie(w, username)
+func setSessionCookieImpl(w http.ResponseWriter, r *http.Request, username string) error {
+	return authpam.SetPAMSessionCookie(w, r, username)
 }
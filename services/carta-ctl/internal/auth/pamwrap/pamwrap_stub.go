@@ -12,6 +12,6 @@ func newImpl(cfg config.PAMConfig) (Authenticator, error) {
 	return nil, ErrUnsupported
 }
 
-func setSessionCookieImpl(w http.ResponseWriter, username string) error {
+func setSessionCookieImpl(w http.ResponseWriter, r *http.Request, username string) error {
 	return ErrUnsupported
 }
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// revokedLogins holds the logins that have been logged out, until every token issued for them has expired
+var revokedLogins = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+// RevokeLogin rejects any further use of a login's tokens. Tokens are refreshed for SessionLifetime at most, so the
+// login is remembered for that long.
+func RevokeLogin(loginID string) {
+	if loginID == "" {
+		return
+	}
+	now := time.Now()
+
+	revokedLogins.Lock()
+	defer revokedLogins.Unlock()
+	for id, until := range revokedLogins.until {
+		if now.After(until) {
+			delete(revokedLogins.until, id)
+		}
+	}
+	revokedLogins.until[loginID] = now.Add(SessionLifetime)
+}
+
+// LoginRevoked reports whether a login has been logged out
+func LoginRevoked(loginID string) bool {
+	revokedLogins.Lock()
+	defer revokedLogins.Unlock()
+	until, ok := revokedLogins.until[loginID]
+	return ok && time.Now().Before(until)
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevokedLoginTokensAreRejected(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	token, err := GenerateSessionToken("alice", "login-1", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A refreshed token keeps the login's ID
+	refreshed, err := GenerateSessionToken("alice", "login-1", expiry.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateSessionToken("alice", "login-2", expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := VerifySessionToken(token); err != nil || claims.LoginID != "login-1" {
+		t.Fatalf("VerifySessionToken = %+v, %v before logging out", claims, err)
+	}
+
+	RevokeLogin("login-1")
+	t.Cleanup(func() {
+		revokedLogins.Lock()
+		delete(revokedLogins.until, "login-1")
+		revokedLogins.Unlock()
+	})
+	for _, tok := range []string{token, refreshed} {
+		if _, err := VerifySessionToken(tok); err == nil {
+			t.Error("token of a revoked login was accepted")
+		}
+	}
+	if _, err := VerifySessionToken(other); err != nil {
+		t.Errorf("token of another login was rejected: %v", err)
+	}
+}
+
+func TestRevocationsExpire(t *testing.T) {
+	revokedLogins.Lock()
+	revokedLogins.until["expired"] = time.Now().Add(-time.Second)
+	revokedLogins.Unlock()
+	if LoginRevoked("expired") {
+		t.Error("login is still revoked after its tokens have expired")
+	}
+
+	// Expired revocations are forgotten when another login is revoked
+	RevokeLogin("login-3")
+	t.Cleanup(func() {
+		revokedLogins.Lock()
+		delete(revokedLogins.until, "login-3")
+		revokedLogins.Unlock()
+	})
+	revokedLogins.Lock()
+	_, kept := revokedLogins.until["expired"]
+	revokedLogins.Unlock()
+	if kept {
+		t.Error("expired revocation was not forgotten")
+	}
+	if LoginRevoked("") {
+		t.Error("empty login ID is revoked")
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
@@ -13,9 +14,25 @@ import (
 // TODO: in production, load this from config or env, not hard-coded.
 var sessionSecret = []byte("CHANGE-ME-TO-A-RANDOM-SECRET")
 
-// GenerateSessionToken creates a signed token for a username with an expiry time.
-func GenerateSessionToken(username string, expiry time.Time) (string, error) {
-	payload := fmt.Sprintf("%s|%d", username, expiry.Unix())
+// SessionLifetime is how long a login lasts before it has to be refreshed
+const SessionLifetime = 8 * time.Hour
+
+// SessionClaims are the contents of a verified session token
+type SessionClaims struct {
+	Username string
+	// LoginID identifies the login that the token was issued for. It stays the same when the token is refreshed
+	LoginID string
+	Expiry  time.Time
+}
+
+// NewLoginID generates a random identifier for a new login
+func NewLoginID() string {
+	return rand.Text()
+}
+
+// GenerateSessionToken creates a signed token for a user's login with an expiry time.
+func GenerateSessionToken(username, loginID string, expiry time.Time) (string, error) {
+	payload := fmt.Sprintf("%s|%s|%d", username, loginID, expiry.Unix())
 	log.Printf("Generating session token with payload: %s", payload)
 	mac := hmac.New(sha256.New, sessionSecret)
 	mac.Write([]byte(payload))
@@ -25,27 +42,28 @@ func GenerateSessionToken(username string, expiry time.Time) (string, error) {
 	return base64.RawURLEncoding.EncodeToString([]byte(token)), nil
 }
 
-// VerifySessionToken checks the token signature and expiry and returns the username.
-func VerifySessionToken(token string) (string, error) {
+// VerifySessionToken checks the token signature, expiry and revocation and returns its claims.
+func VerifySessionToken(token string) (SessionClaims, error) {
 	raw, err := base64.RawURLEncoding.DecodeString(token)
 	if err != nil {
-		return "", fmt.Errorf("bad token encoding")
+		return SessionClaims{}, fmt.Errorf("bad token encoding")
 	}
 
 	parts := strings.Split(string(raw), "|")
-	if len(parts) != 3 {
-		return "", fmt.Errorf("bad token format")
+	if len(parts) != 4 {
+		return SessionClaims{}, fmt.Errorf("bad token format")
 	}
 	username := parts[0]
-	expiryStr := parts[1]
-	sigB64 := parts[2]
+	loginID := parts[1]
+	expiryStr := parts[2]
+	sigB64 := parts[3]
 
 	sig, err := base64.RawURLEncoding.DecodeString(sigB64)
 	if err != nil {
-		return "", fmt.Errorf("bad sig encoding")
+		return SessionClaims{}, fmt.Errorf("bad sig encoding")
 	}
 
-	payload := username + "|" + expiryStr
+	payload := username + "|" + loginID + "|" + expiryStr
 
 	log.Printf("Verifying session token with payload: %s", payload)
 	mac := hmac.New(sha256.New, sessionSecret)
@@ -53,17 +71,20 @@ func VerifySessionToken(token string) (string, error) {
 	expected := mac.Sum(nil)
 
 	if !hmac.Equal(sig, expected) {
-		return "", fmt.Errorf("invalid signature")
+		return SessionClaims{}, fmt.Errorf("invalid signature")
 	}
 
 	var expiryUnix int64
 	_, err = fmt.Sscanf(expiryStr, "%d", &expiryUnix)
 	if err != nil {
-		return "", fmt.Errorf("bad expiry")
+		return SessionClaims{}, fmt.Errorf("bad expiry")
 	}
 	if time.Now().Unix() > expiryUnix {
-		return "", fmt.Errorf("session expired")
+		return SessionClaims{}, fmt.Errorf("session expired")
+	}
+	if LoginRevoked(loginID) {
+		return SessionClaims{}, fmt.Errorf("session revoked")
 	}
 
-	return username, nil
+	return SessionClaims{Username: username, LoginID: loginID, Expiry: time.Unix(expiryUnix, 0)}, nil
 }
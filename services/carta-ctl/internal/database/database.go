@@ -1,10 +1,13 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"database/sql"
 	"github.com/jmoiron/sqlx"
@@ -15,6 +18,7 @@ import (
 	"github.com/santhosh-tekuri/jsonschema/v6"
 
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/session"
 )
 
@@ -131,6 +135,11 @@ func (h *DbConfig) InitDb() {
 	}
 }
 
+// Ping checks that the database connection is usable
+func (h *DbConfig) Ping(ctx context.Context) error {
+	return h.db.PingContext(ctx)
+}
+
 func getUsername(r *http.Request) string {
 	ctx := r.Context()
 	user, ok := ctx.Value(session.UserContextKey).(*auth.User)
@@ -730,5 +739,38 @@ func (h *DbConfig) Router() http.Handler {
 	mux.Handle("PUT /workspace", http.HandlerFunc(notImplemented))
 	mux.Handle("DELETE /workspace", http.HandlerFunc(notImplemented))
 
-	return mux
+	return instrument(mux)
+}
+
+var (
+	dbRequests        = metrics.NewCounterVec("carta_database_requests_total", "Number of database API requests by route and status code", "route", "status")
+	dbRequestDuration = metrics.NewHistogramVec("carta_database_request_duration_seconds", "Time taken to handle database API requests", metrics.DefaultBuckets, "route")
+)
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument records the count and latency of requests to the database API. Requests are labelled by the route
+// pattern that matched them rather than the path, so that IDs in paths don't create new series
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		// The mux sets the request's pattern when it routes it
+		mux.ServeHTTP(rec, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		dbRequests.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+		dbRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
 }
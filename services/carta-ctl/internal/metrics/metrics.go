@@ -0,0 +1,395 @@
+// Package metrics provides lightweight counters and gauges for the controller, which can be written out in the
+// Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Collector is implemented by every metric family that can be registered
+type Collector interface {
+	Name() string
+	write(w io.Writer) error
+}
+
+var registry = struct {
+	sync.Mutex
+	collectors map[string]Collector
+}{collectors: make(map[string]Collector)}
+
+// Register adds a collector to the default registry. Registering two collectors with the same name panics, as
+// that is always a programming error.
+func Register(c Collector) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, exists := registry.collectors[c.Name()]; exists {
+		panic(fmt.Sprintf("metric %s registered twice", c.Name()))
+	}
+	registry.collectors[c.Name()] = c
+}
+
+// WriteText writes all registered metrics in the Prometheus text exposition format, ordered by name
+func WriteText(w io.Writer) error {
+	registry.Lock()
+	collectors := make([]Collector, 0, len(registry.collectors))
+	for _, c := range registry.collectors {
+		collectors = append(collectors, c)
+	}
+	registry.Unlock()
+
+	slices.SortFunc(collectors, func(a, b Collector) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// value is a float64 that can be updated atomically
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := v.bits.Load()
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if v.bits.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	v.bits.Store(math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+// family holds the labelled children of a metric
+type family[T any] struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+
+	mu       sync.RWMutex
+	children map[string]*T
+	values   map[string][]string
+	newChild func() *T
+}
+
+func newFamily[T any](name, help, metricType string, labels []string, newChild func() *T) *family[T] {
+	return &family[T]{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		children:   make(map[string]*T),
+		values:     make(map[string][]string),
+		newChild:   newChild,
+	}
+}
+
+func (f *family[T]) Name() string {
+	return f.name
+}
+
+func (f *family[T]) withLabelValues(labelValues ...string) *T {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.RLock()
+	child, ok := f.children[key]
+	f.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if child, ok = f.children[key]; !ok {
+		child = f.newChild()
+		f.children[key] = child
+		f.values[key] = slices.Clone(labelValues)
+	}
+	return child
+}
+
+// DeleteLabelValues removes the child with the given label values, so that it is no longer written out. It reports
+// whether the child existed.
+func (f *family[T]) DeleteLabelValues(labelValues ...string) bool {
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.children[key]; !ok {
+		return false
+	}
+	delete(f.children, key)
+	delete(f.values, key)
+	return true
+}
+
+// each calls fn for every child, ordered by label values so that the output is stable
+func (f *family[T]) each(fn func(labelValues []string, child *T) error) error {
+	f.mu.RLock()
+	keys := make([]string, 0, len(f.children))
+	for key := range f.children {
+		keys = append(keys, key)
+	}
+	f.mu.RUnlock()
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		f.mu.RLock()
+		child, labelValues := f.children[key], f.values[key]
+		f.mu.RUnlock()
+		if err := fn(labelValues, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *family[T]) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.metricType)
+	return err
+}
+
+// formatLabels renders label pairs as {a="x",b="y"}, including any extra pairs such as histogram bucket bounds
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.ToValidUTF8(s, "�")
+}
+
+func formatValue(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return fmt.Sprintf("%g", f)
+	}
+}
+
+// Counter is a value that only ever increases
+type Counter struct {
+	v value
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increases the counter. Negative values are ignored, as counters may only increase.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.v.add(delta)
+}
+
+func (c *Counter) Value() float64 {
+	return c.v.get()
+}
+
+type CounterVec struct {
+	*family[Counter]
+}
+
+// NewCounterVec creates and registers a counter partitioned by the given labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newFamily(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	Register(c)
+	return c
+}
+
+func (c *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return c.withLabelValues(labelValues...)
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	if err := c.writeHeader(w); err != nil {
+		return err
+	}
+	return c.each(func(labelValues []string, child *Counter) error {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, labelValues), formatValue(child.Value()))
+		return err
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v value
+}
+
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.v.get()
+}
+
+type GaugeVec struct {
+	*family[Gauge]
+}
+
+// NewGaugeVec creates and registers a gauge partitioned by the given labels
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newFamily(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	Register(g)
+	return g
+}
+
+func (g *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return g.withLabelValues(labelValues...)
+}
+
+func (g *GaugeVec) write(w io.Writer) error {
+	if err := g.writeHeader(w); err != nil {
+		return err
+	}
+	return g.each(func(labelValues []string, child *Gauge) error {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, labelValues), formatValue(child.Value()))
+		return err
+	})
+}
+
+// GaugeFunc is a gauge whose value is computed by a function each time the metrics are written, for values that are
+// easier to count on demand than to keep up to date
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge that takes its value from fn
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	Register(g)
+	return g
+}
+
+func (g *GaugeFunc) Name() string {
+	return g.name
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, escapeHelp(g.help), g.name, g.name, formatValue(g.fn()))
+	return err
+}
+
+// DefaultBuckets are histogram bucket upper bounds in seconds, suitable for request latencies from milliseconds up to
+// a minute
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Histogram counts observations in buckets, and tracks their sum
+type Histogram struct {
+	upperBounds []float64
+	// buckets holds the number of observations in each bucket, with the last one counting those above every bound.
+	// They are made cumulative when written out
+	buckets []atomic.Uint64
+	sum     value
+}
+
+func (h *Histogram) Observe(f float64) {
+	i, _ := slices.BinarySearch(h.upperBounds, f)
+	h.buckets[i].Add(1)
+	h.sum.add(f)
+}
+
+type HistogramVec struct {
+	*family[Histogram]
+	upperBounds []float64
+}
+
+// NewHistogramVec creates and registers a histogram partitioned by the given labels. Buckets are the upper bounds of
+// the histogram's buckets, and DefaultBuckets is used if it is empty
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	upperBounds := slices.Clone(buckets)
+	slices.Sort(upperBounds)
+	h := &HistogramVec{
+		family: newFamily(name, help, "histogram", labels, func() *Histogram {
+			return &Histogram{upperBounds: upperBounds, buckets: make([]atomic.Uint64, len(upperBounds)+1)}
+		}),
+		upperBounds: upperBounds,
+	}
+	Register(h)
+	return h
+}
+
+func (h *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return h.withLabelValues(labelValues...)
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	return h.each(func(labelValues []string, child *Histogram) error {
+		// Observations may arrive while the buckets are being written, so the total is taken from the buckets
+		// themselves to keep the output consistent
+		var cumulative uint64
+		for i := range child.buckets {
+			cumulative += child.buckets[i].Load()
+			bound := math.Inf(1)
+			if i < len(h.upperBounds) {
+				bound = h.upperBounds[i]
+			}
+			_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", formatValue(bound)), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+		labels := formatLabels(h.labels, labelValues)
+		_, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, labels, formatValue(child.sum.get()), h.name, labels, cumulative)
+		return err
+	})
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeleteLabelValues(t *testing.T) {
+	// The gauge isn't registered, so that the test can run more than once in a process
+	g := &GaugeVec{newFamily("test_delete_label_values", "Gauge for TestDeleteLabelValues", "gauge", []string{"user"}, func() *Gauge { return &Gauge{} })}
+	g.WithLabelValues("alice").Set(2)
+	g.WithLabelValues("bob").Set(1)
+
+	if !g.DeleteLabelValues("bob") {
+		t.Fatal("DeleteLabelValues(bob) = false for an existing series")
+	}
+	if g.DeleteLabelValues("carol") {
+		t.Error("DeleteLabelValues(carol) = true for a series that was never created")
+	}
+
+	var out strings.Builder
+	if err := g.write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `test_delete_label_values{user="alice"} 2`) {
+		t.Errorf("remaining series missing from output:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "bob") {
+		t.Errorf("deleted series still written:\n%s", out.String())
+	}
+
+	// A deleted series starts again from zero if it is used again
+	if v := g.WithLabelValues("bob").Value(); v != 0 {
+		t.Errorf("recreated series has value %v, want 0", v)
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies holds the addresses of reverse proxies whose X-Forwarded-* headers are believed
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses a list of IP addresses and CIDR ranges
+func ParseTrustedProxies(entries []string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy range %q: %w", entry, err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy address %q: %w", entry, err)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) trusts(ip string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware applies the X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers of requests from trusted
+// proxies, so that handlers see the client's address, the public host name and the public scheme. The scheme is
+// stored in r.URL.Scheme, which is otherwise empty for server requests. Headers from other clients are ignored.
+func (t TrustedProxies) Middleware(next http.Handler) http.Handler {
+	if len(t) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !t.trusts(host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		// Proxies may append their own X-Forwarded-For header rather than extend the existing one
+		if forwardedFor := strings.Join(r.Header.Values("X-Forwarded-For"), ","); forwardedFor != "" {
+			if client, ok := t.clientIP(forwardedFor); ok {
+				r.RemoteAddr = net.JoinHostPort(client, "0")
+			}
+		}
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			r.Host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+		}
+		if forwardedProto := r.Header.Get("X-Forwarded-Proto"); forwardedProto != "" {
+			proto := strings.ToLower(strings.TrimSpace(strings.Split(forwardedProto, ",")[0]))
+			if proto == "http" || proto == "https" {
+				r.URL.Scheme = proto
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP finds the client in an X-Forwarded-For chain. Each proxy appends the address it received the request
+// from, so the client is the rightmost address that isn't a trusted proxy. Anything further left could have been
+// supplied by the client itself. It returns false if that address isn't a valid IP address, in which case the
+// proxy's own address is the best that is known about the client.
+func (t TrustedProxies) clientIP(forwardedFor string) (string, bool) {
+	hops := strings.Split(forwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if t.trusts(hop) {
+			continue
+		}
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			return "", false
+		}
+		return addr.Unmap().String(), true
+	}
+	// Every hop is a trusted proxy, so the first one received the request from the client
+	return strings.TrimSpace(hops[0]), true
+}
+
+// Scheme returns the scheme that the client used to reach the controller
+func Scheme(r *http.Request) string {
+	if r.URL.Scheme != "" {
+		return r.URL.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
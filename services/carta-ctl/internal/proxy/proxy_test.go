@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.1", "192.168.1.7/24", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1":         true,
+		"10.0.0.2":         false,
+		"192.168.1.200":    true,
+		"::1":              true,
+		"::ffff:10.0.0.1":  true,
+		"not an address":   false,
+		"192.168.2.1":      false,
+		" 192.168.1.1 ":    true,
+		"10.0.0.1:8080":    false,
+		"[10.0.0.1]:8080":  false,
+		"fe80::1%eth0":     false,
+		"2001:db8::1":      false,
+		"192.168.1.0":      true,
+		"192.168.1.255":    true,
+		"192.168.0.255":    false,
+		"10.0.0.1/32":      false,
+		"":                 false,
+		"::ffff:192.168.1": false,
+	} {
+		if got := proxies.trusts(ip); got != want {
+			t.Errorf("trusts(%q) = %v, want %v", ip, got, want)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0", "10.0.0.1/33", "proxy.example"} {
+		if _, err := ParseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("ParseTrustedProxies accepted %q", entry)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		// header lines, each of which may hold several comma separated entries
+		forwardedFor []string
+		host         string
+		proto        string
+		wantAddr     string
+		wantHost     string
+		wantScheme   string
+	}{
+		{"UntrustedPeer", "203.0.113.9:4000", []string{"198.51.100.1"}, "evil.example", "https", "203.0.113.9:4000", "carta.internal", "http"},
+		{"TrustedPeer", "10.0.0.1:4000", []string{"198.51.100.1"}, "carta.example", "https", "198.51.100.1:0", "carta.example", "https"},
+		{"MultiHop", "10.0.0.1:4000", []string{"198.51.100.1, 10.0.0.3, 10.0.0.2"}, "", "", "198.51.100.1:0", "carta.internal", "http"},
+		{"SpoofedLeftOfClient", "10.0.0.1:4000", []string{"192.0.2.66, 198.51.100.1, 10.0.0.2"}, "", "", "198.51.100.1:0", "carta.internal", "http"},
+		{"SeparateHeaderLines", "10.0.0.1:4000", []string{"192.0.2.66", "198.51.100.1", "10.0.0.2"}, "", "", "198.51.100.1:0", "carta.internal", "http"},
+		{"OnlyProxies", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "", "", "10.0.0.3:0", "carta.internal", "http"},
+		{"MappedIPv4", "10.0.0.1:4000", []string{"::ffff:198.51.100.1"}, "", "", "198.51.100.1:0", "carta.internal", "http"},
+		{"IPv6Client", "10.0.0.1:4000", []string{"2001:db8::1"}, "", "", "[2001:db8::1]:0", "carta.internal", "http"},
+		{"MalformedClient", "10.0.0.1:4000", []string{"198.51.100.1, garbage"}, "", "", "10.0.0.1:4000", "carta.internal", "http"},
+		{"EmptyEntry", "10.0.0.1:4000", []string{"198.51.100.1,"}, "", "", "10.0.0.1:4000", "carta.internal", "http"},
+		{"ClientWithPort", "10.0.0.1:4000", []string{"198.51.100.1:5000"}, "", "", "10.0.0.1:4000", "carta.internal", "http"},
+		{"FirstForwardedHost", "10.0.0.1:4000", nil, "carta.example, internal.example", "HTTPS, http", "10.0.0.1:4000", "carta.example", "https"},
+		{"UnknownProto", "10.0.0.1:4000", nil, "", "gopher", "10.0.0.1:4000", "carta.internal", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			handler := proxies.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Host = "carta.internal"
+			for _, line := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", line)
+			}
+			if tt.host != "" {
+				r.Header.Set("X-Forwarded-Host", tt.host)
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got.RemoteAddr != tt.wantAddr || got.Host != tt.wantHost || Scheme(got) != tt.wantScheme {
+				t.Errorf("got %s, %s and %s, want %s, %s and %s", got.RemoteAddr, got.Host, Scheme(got), tt.wantAddr, tt.wantHost, tt.wantScheme)
+			}
+		})
+	}
+}
+
+func TestMiddlewareWithoutTrustedProxies(t *testing.T) {
+	var got *http.Request
+	handler := TrustedProxies(nil).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got.RemoteAddr != "10.0.0.1:4000" {
+		t.Errorf("headers were applied without any trusted proxies, got address %s", got.RemoteAddr)
+	}
+}
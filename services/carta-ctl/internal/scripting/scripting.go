@@ -0,0 +1,125 @@
+package scripting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/session"
+)
+
+// ScriptingConfig holds the settings for the scripting API, which lets scripts drive a user's open session by
+// injecting messages into it
+type ScriptingConfig struct {
+	// How long to wait for the response to a scripted message
+	Timeout time.Duration
+}
+
+type actionRequest struct {
+	// Session is the ID of the target session, which must belong to the requesting user
+	Session   string `json:"session"`
+	EventType string `json:"eventType"`
+	// Message is the protobuf message body in its JSON encoding
+	Message json.RawMessage `json:"message"`
+}
+
+type actionResponse struct {
+	Success   bool            `json:"success"`
+	RequestId uint32          `json:"requestId"`
+	EventType string          `json:"eventType,omitempty"`
+	Response  json.RawMessage `json:"response,omitempty"`
+}
+
+func (h *ScriptingConfig) handleAction(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value(session.UserContextKey).(*auth.User)
+
+	var body actionRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		helpers.WriteError(w, http.StatusBadRequest, "Request body must be a JSON object with session, eventType and message")
+		return
+	}
+
+	// Scripts may only drive sessions opened by the same user
+	var target *session.Session
+	for _, s := range session.ForUser(user) {
+		if s.ID == body.Session {
+			target = s
+		}
+	}
+	if target == nil {
+		helpers.WriteError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	value, ok := cartaDefinitions.EventType_value[strings.ToUpper(body.EventType)]
+	if !ok {
+		helpers.WriteError(w, http.StatusBadRequest, "Unknown event type "+body.EventType)
+		return
+	}
+	eventType := cartaDefinitions.EventType(value)
+	msg, err := cartaHelpers.NewMessage(eventType)
+	if err != nil {
+		helpers.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body.Message) > 0 {
+		if err := protojson.Unmarshal(body.Message, msg); err != nil {
+			helpers.WriteError(w, http.StatusBadRequest, "Invalid "+eventType.String()+" message: "+err.Error())
+			return
+		}
+	}
+
+	ctx := r.Context()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	slog.Info("Scripting action", "username", user.Username, "sessionId", target.ID, "eventType", eventType)
+	result, err := target.Script(ctx, eventType, msg)
+	switch {
+	case errors.Is(err, session.ErrNotRegistered):
+		helpers.WriteError(w, http.StatusConflict, err.Error())
+		return
+	case errors.Is(err, session.ErrNotScriptable):
+		helpers.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, session.ErrScriptNoResponse):
+		helpers.WriteError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	case err != nil:
+		slog.Warn("Scripting action failed", "sessionId", target.ID, "eventType", eventType, "error", err)
+		helpers.WriteError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	response := actionResponse{Success: true, RequestId: result.RequestId}
+	if result.Message != nil {
+		response.EventType = result.EventType.String()
+		response.Response, err = protojson.Marshal(result.Message)
+		if err != nil {
+			helpers.WriteError(w, http.StatusInternalServerError, "Error encoding response: "+err.Error())
+			return
+		}
+	}
+	helpers.WriteJSON(w, http.StatusOK, response)
+}
+
+func (h *ScriptingConfig) Router() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("POST /action", http.HandlerFunc(h.handleAction))
+
+	return mux
+}
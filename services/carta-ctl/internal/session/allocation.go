@@ -0,0 +1,144 @@
+package session
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/config"
+)
+
+// allocator decides which worker opens each file, trading the memory isolation of separate workers against the
+// overhead of starting them
+type allocator interface {
+	// allocate returns the worker that should open the file, or nil if a new worker should be started for it. It is
+	// called with the session's mu held, and workers that are still being started for other files are counted in
+	// the session's startingWorkers. The size of the file is only determined for allocators that use it, and is
+	// negative otherwise or if it is unknown.
+	allocate(s *Session, file *cartaDefinitions.OpenFile, size int64) *SessionWorker
+}
+
+// workerAllocator is the allocation strategy used by all sessions. It is set once at startup by Configure
+var workerAllocator allocator = perFileAllocator{}
+
+func newAllocator(cfg config.SessionConfig) (allocator, error) {
+	switch cfg.WorkerAllocation {
+	case "single":
+		return singleAllocator{}, nil
+	case "", "per_file":
+		return perFileAllocator{}, nil
+	case "pool":
+		if cfg.WorkerPoolSize < 1 {
+			return nil, fmt.Errorf("worker_pool_size must be at least 1, got %d", cfg.WorkerPoolSize)
+		}
+		return poolAllocator{size: cfg.WorkerPoolSize}, nil
+	case "size":
+		return sizeAllocator{threshold: cfg.DedicatedWorkerSize}, nil
+	default:
+		return nil, fmt.Errorf("unknown worker allocation %q, expected single, per_file, pool or size", cfg.WorkerAllocation)
+	}
+}
+
+// singleAllocator opens every file in the session's shared worker
+type singleAllocator struct{}
+
+func (singleAllocator) allocate(s *Session, _ *cartaDefinitions.OpenFile, _ int64) *SessionWorker {
+	return s.sharedWorker
+}
+
+// perFileAllocator starts a worker for every file
+type perFileAllocator struct{}
+
+func (perFileAllocator) allocate(_ *Session, _ *cartaDefinitions.OpenFile, _ int64) *SessionWorker {
+	return nil
+}
+
+// poolAllocator spreads files over a bounded pool of workers, including the shared worker. New workers are started
+// until the pool is full, and after that each file goes to the worker with the fewest open files.
+type poolAllocator struct {
+	size int
+}
+
+func (a poolAllocator) allocate(s *Session, _ *cartaDefinitions.OpenFile, _ int64) *SessionWorker {
+	// The shared worker comes first, then the others by their lowest file ID, so that ties are broken consistently
+	var pool []*SessionWorker
+	load := make(map[*SessionWorker]int)
+	if s.sharedWorker != nil {
+		pool = append(pool, s.sharedWorker)
+		load[s.sharedWorker] = 0
+	}
+	for _, fileId := range slices.Sorted(maps.Keys(s.fileMap)) {
+		w := s.fileMap[fileId]
+		if _, ok := load[w]; !ok {
+			pool = append(pool, w)
+		}
+		load[w]++
+	}
+	slices.SortStableFunc(pool, func(a, b *SessionWorker) int {
+		return cmp.Compare(load[a], load[b])
+	})
+
+	if len(pool) > 0 && (load[pool[0]] == 0 || len(pool)+s.startingWorkers >= a.size) {
+		return pool[0]
+	}
+	return nil
+}
+
+// sizeAllocator starts a worker for each file of at least threshold bytes, and opens smaller files in the shared
+// worker
+type sizeAllocator struct {
+	threshold int64
+}
+
+func (a sizeAllocator) allocate(s *Session, _ *cartaDefinitions.OpenFile, size int64) *SessionWorker {
+	// Files of unknown size go to the shared worker, which reports the problem with the file when it tries to open it
+	if size >= a.threshold {
+		return nil
+	}
+	return s.sharedWorker
+}
+
+// imageSize returns the size of the file that a request opens, or -1 if it can't be determined. Images may be large
+// directories on network storage, so this must not be called with the session's mu held.
+func (s *Session) imageSize(file *cartaDefinitions.OpenFile) int64 {
+	path := s.pathPolicy().resolve(file.Directory, file.File)
+	size, err := fileSize(path)
+	if err != nil {
+		slog.Debug("Could not determine file size", "path", path, "error", err)
+		return -1
+	}
+	return size
+}
+
+// fileSize returns the size of an image, which may be a directory, as it is for CASA and MIRIAD images
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+
+	var size int64
+	err = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
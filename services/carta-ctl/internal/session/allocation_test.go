@@ -0,0 +1,160 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/mockworker"
+)
+
+// poolSession returns a session with a shared worker and the given number of files open in each of the other
+// workers, with file IDs assigned in order
+func poolSession(shared int, others ...int) (*Session, []*SessionWorker) {
+	s := &Session{sharedWorker: &SessionWorker{}, fileMap: make(map[int32]*SessionWorker)}
+	workers := []*SessionWorker{s.sharedWorker}
+	var fileId int32
+	for i := 0; i < shared; i++ {
+		s.fileMap[fileId] = s.sharedWorker
+		fileId++
+	}
+	for _, n := range others {
+		w := &SessionWorker{}
+		workers = append(workers, w)
+		for i := 0; i < n; i++ {
+			s.fileMap[fileId] = w
+			fileId++
+		}
+	}
+	return s, workers
+}
+
+func TestPoolAllocator(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		shared int
+		others []int
+		// index of the expected worker, or -1 if a new one should be started
+		want int
+	}{
+		{"IdleSharedWorker", 3, 0, nil, 0},
+		{"StartWhileNotFull", 3, 1, []int{1}, -1},
+		{"LeastLoadedWhenFull", 3, 2, []int{1, 3}, 1},
+		{"TiesGoToSharedWorker", 2, 1, []int{1}, 0},
+		{"TiesGoToLowestFileId", 3, 2, []int{1, 1}, 1},
+		{"SingleWorkerPool", 1, 4, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, workers := poolSession(tt.shared, tt.others...)
+			got := poolAllocator{size: tt.size}.allocate(s, &cartaDefinitions.OpenFile{}, -1)
+			if tt.want < 0 {
+				if got != nil {
+					t.Errorf("allocated worker %d, want a new worker", indexOf(workers, got))
+				}
+				return
+			}
+			if got != workers[tt.want] {
+				t.Errorf("allocated worker %d, want %d", indexOf(workers, got), tt.want)
+			}
+		})
+	}
+}
+
+func indexOf(workers []*SessionWorker, w *SessionWorker) int {
+	for i, candidate := range workers {
+		if candidate == w {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestSizeAllocator(t *testing.T) {
+	s, _ := poolSession(0)
+	a := sizeAllocator{threshold: 1000}
+	if got := a.allocate(s, nil, 1000); got != nil {
+		t.Error("file at the threshold was not given its own worker")
+	}
+	if got := a.allocate(s, nil, 999); got != s.sharedWorker {
+		t.Error("small file was not opened in the shared worker")
+	}
+	if got := a.allocate(s, nil, -1); got != s.sharedWorker {
+		t.Error("file of unknown size was not opened in the shared worker")
+	}
+}
+
+func TestImageSize(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "image.fits"), make([]byte, 2880), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// CASA images are directories of tables
+	casa := filepath.Join(dir, "image.im")
+	if err := os.MkdirAll(filepath.Join(casa, "logtable"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"table.f0": 4096, "table.dat": 100, "logtable/table.f0": 50} {
+		if err := os.WriteFile(filepath.Join(casa, name), make([]byte, size), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Session{BaseFolder: dir}
+	tests := []struct {
+		file string
+		want int64
+	}{
+		{"image.fits", 2880},
+		{"image.im", 4246},
+		{"missing.fits", -1},
+	}
+	for _, tt := range tests {
+		if got := s.imageSize(&cartaDefinitions.OpenFile{Directory: basePlaceholder, File: tt.file}); got != tt.want {
+			t.Errorf("imageSize(%s) = %d, want %d", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestPoolAllocatorCountsStartingWorkers(t *testing.T) {
+	s, workers := poolSession(1, 1)
+	a := poolAllocator{size: 3}
+	if got := a.allocate(s, &cartaDefinitions.OpenFile{}, -1); got != nil {
+		t.Fatalf("allocated worker %d, want a new worker", indexOf(workers, got))
+	}
+	// The third worker is already being started for another file, so the pool is full
+	s.startingWorkers = 1
+	if got := a.allocate(s, &cartaDefinitions.OpenFile{}, -1); got != workers[0] {
+		t.Errorf("allocated worker %d, want the least loaded worker 0", indexOf(workers, got))
+	}
+}
+
+func TestConcurrentOpensStayWithinPool(t *testing.T) {
+	base := imageFolder(t)
+	saved := workerAllocator
+	t.Cleanup(func() { workerAllocator = saved })
+	workerAllocator = poolAllocator{size: 2}
+
+	spawner := newTestSpawner(t, mockworker.Options{BaseFolder: base})
+	server := newTestServer(t, spawner, base)
+	client := dialTestClient(t, server.url)
+	client.register()
+
+	// The shared worker opens the first file, and the rest arrive together while the second worker is starting
+	client.send(cartaDefinitions.EventType_OPEN_FILE, 2, &cartaDefinitions.OpenFile{Directory: basePlaceholder, File: "m51.fits", FileId: 0})
+	client.expect(cartaDefinitions.EventType_OPEN_FILE_ACK, nil)
+	for fileId := int32(1); fileId <= 4; fileId++ {
+		client.send(cartaDefinitions.EventType_OPEN_FILE, uint32(fileId)+2, &cartaDefinitions.OpenFile{Directory: basePlaceholder, File: "m51.fits", FileId: fileId})
+	}
+	for range 4 {
+		var ack cartaDefinitions.OpenFileAck
+		if client.expect(cartaDefinitions.EventType_OPEN_FILE_ACK, &ack); !ack.Success {
+			t.Errorf("opening file %d failed", ack.FileId)
+		}
+	}
+	if n := spawner.started(); n != 2 {
+		t.Errorf("started %d workers for a pool of 2", n)
+	}
+}
@@ -0,0 +1,62 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/CARTAvis/go-carta/pkg/config"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+)
+
+// ResolveBaseFolder determines the base folder for a user's workers. Users in one of the configured groups are given
+// that group's folder, using the first mapping that matches, and everyone else is given the default folder. Folders
+// may contain the {username} and {home} placeholders, which are replaced with the user's name and home directory. An
+// empty folder is returned as is, leaving the choice of folder to the worker.
+func ResolveBaseFolder(folder string, groupFolders []config.GroupFolder, u *auth.User) (string, error) {
+	for _, mapping := range groupFolders {
+		if u.InGroup(mapping.Group) {
+			folder = mapping.Folder
+			break
+		}
+	}
+	if folder == "" {
+		return "", nil
+	}
+
+	if strings.Contains(folder, "{username}") {
+		if u == nil || u.Username == "" {
+			return "", fmt.Errorf("base folder %q requires an authenticated user", folder)
+		}
+		// Usernames come from external identity providers, so they must not be able to change the folder hierarchy
+		if strings.ContainsRune(u.Username, filepath.Separator) || u.Username == "." || u.Username == ".." {
+			return "", fmt.Errorf("username %q can't be used in a folder name", u.Username)
+		}
+		folder = strings.ReplaceAll(folder, "{username}", u.Username)
+	}
+
+	if strings.Contains(folder, "{home}") {
+		home, err := homeFolder(u)
+		if err != nil {
+			return "", fmt.Errorf("could not determine home folder: %w", err)
+		}
+		folder = strings.ReplaceAll(folder, "{home}", home)
+	}
+
+	return filepath.Clean(folder), nil
+}
+
+// homeFolder returns the home directory of an authenticated user's system account. Anonymous users share the home
+// directory of the account the controller runs as.
+func homeFolder(u *auth.User) (string, error) {
+	if u == nil || u.Source == "" {
+		return os.UserHomeDir()
+	}
+	account, err := user.Lookup(u.Username)
+	if err != nil {
+		return "", err
+	}
+	return account.HomeDir, nil
+}
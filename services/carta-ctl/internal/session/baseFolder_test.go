@@ -0,0 +1,57 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/CARTAvis/go-carta/pkg/config"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+)
+
+func TestResolveBaseFolder(t *testing.T) {
+	groupFolders := []config.GroupFolder{{Group: "survey", Folder: "/data/survey/{username}"}}
+	// An OIDC user without a local account, whose home folder can't be looked up
+	oidcUser := &auth.User{Username: "jane.doe@example.org", Source: auth.SourceOIDC}
+
+	tests := []struct {
+		name   string
+		folder string
+		user   *auth.User
+		want   string
+	}{
+		{"EmptyAnonymous", "", nil, ""},
+		{"EmptyWithoutLocalAccount", "", oidcUser, ""},
+		{"Fixed", "/data/shared/", oidcUser, "/data/shared"},
+		{"Username", "/data/{username}", oidcUser, "/data/jane.doe@example.org"},
+		{"GroupFolder", "", &auth.User{Username: "sam", Groups: []string{"survey"}}, "/data/survey/sam"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveBaseFolder(tt.folder, groupFolders, tt.user)
+			if err != nil {
+				t.Fatalf("ResolveBaseFolder(%q) failed: %v", tt.folder, err)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveBaseFolder(%q) = %q, want %q", tt.folder, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveBaseFolderRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		folder string
+		user   *auth.User
+	}{
+		{"UsernameWithoutUser", "/data/{username}", nil},
+		{"UsernameWithSeparator", "/data/{username}", &auth.User{Username: "../etc", Source: auth.SourceOIDC}},
+		{"HomeWithoutLocalAccount", "{home}", &auth.User{Username: "no-such-user-for-carta-tests", Source: auth.SourceOIDC}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ResolveBaseFolder(tt.folder, nil, tt.user); err == nil {
+				t.Errorf("ResolveBaseFolder(%q) = %q, want an error", tt.folder, got)
+			}
+		})
+	}
+}
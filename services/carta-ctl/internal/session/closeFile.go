@@ -0,0 +1,62 @@
+package session
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
+)
+
+// allFiles is the file ID that the frontend uses to close every open file at once
+const allFiles = -1
+
+// CloseFile is proxied to the worker holding the file, and workers other than the shared worker are shut down once
+// they have no files left open
+func (s *Session) handleCloseFile(eventType cartaDefinitions.EventType, requestId uint32, msg []byte) error {
+	var payload cartaDefinitions.CloseFile
+	err := s.checkAndParse(&payload, requestId, msg)
+	if err != nil {
+		return fmt.Errorf("error parsing message: %v", err)
+	}
+
+	if payload.FileId != allFiles {
+		err = s.handleProxiedMessage(eventType, requestId, msg)
+	} else {
+		for _, w := range s.workers() {
+			if proxyErr := w.proxyMessageToWorker(eventType, requestId, msg); proxyErr != nil {
+				err = proxyErr
+			}
+		}
+		s.recordState(nil, eventType, requestId, msg)
+	}
+
+	s.mu.Lock()
+	closing := make(map[*SessionWorker]bool)
+	for fileId, w := range s.fileMap {
+		if payload.FileId == allFiles || fileId == payload.FileId {
+			closing[w] = true
+			delete(s.fileMap, fileId)
+			delete(s.fileRequests, fileId)
+		}
+	}
+	for _, w := range s.fileMap {
+		delete(closing, w)
+	}
+	delete(closing, s.sharedWorker)
+	if payload.FileId == allFiles {
+		clear(s.openImages)
+	} else {
+		delete(s.openImages, payload.FileId)
+	}
+	s.mu.Unlock()
+
+	for w := range closing {
+		slog.Info("Shutting down worker with no open files", "workerName", w.name(), "workerId", w.info.WorkerId)
+		w.disconnect()
+		if shutdownErr := spawnerHelpers.RequestWorkerShutdown(w.info.WorkerId, s.SpawnerAddress); shutdownErr != nil {
+			slog.Error("Error shutting down file worker", "workerId", w.info.WorkerId, "error", shutdownErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+)
+
+var (
+	// draining is set once the controller starts shutting down, after which no new sessions should be accepted
+	draining atomic.Bool
+	// liveSessions counts sessions that have not finished shutting down their workers yet
+	liveSessions atomic.Int64
+)
+
+// drainPollInterval is how often Drain checks whether all sessions have closed
+const drainPollInterval = 100 * time.Millisecond
+
+// Draining reports whether the controller is shutting down
+func Draining() bool {
+	return draining.Load()
+}
+
+// Drain notifies all sessions that the controller is shutting down, then waits up to the grace period for their
+// clients to disconnect. Sessions that are still connected afterwards are terminated. Drain returns once every session
+// has shut down its workers, or when ctx is done.
+func Drain(ctx context.Context, grace time.Duration) {
+	draining.Store(true)
+	if liveSessions.Load() == 0 {
+		return
+	}
+
+	message := fmt.Sprintf("The server is shutting down. Please save your work, you will be disconnected in %s", grace.Round(time.Second))
+	notified := Broadcast(cartaDefinitions.ErrorSeverity_WARNING, []string{"shutdown"}, message)
+	slog.Info("Waiting for sessions to close", "sessions", notified, "gracePeriod", grace)
+
+	graceCtx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+	if waitForSessions(graceCtx) {
+		return
+	}
+
+	// Sessions are terminated in parallel, as each waits for its client to take the messages queued for it
+	var terminating sync.WaitGroup
+	for _, s := range List() {
+		terminating.Go(func() {
+			if err := s.Terminate("server shutting down"); err != nil {
+				slog.Warn("Failed to terminate session", "sessionId", s.ID, "error", err)
+			}
+		})
+	}
+	terminating.Wait()
+	if !waitForSessions(ctx) {
+		slog.Warn("Timed out waiting for sessions to shut down their workers", "sessions", liveSessions.Load())
+	}
+}
+
+// waitForSessions waits until all sessions have closed, returning false if ctx is done first
+func waitForSessions(ctx context.Context) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for liveSessions.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+)
+
+// drainingSession starts a session, and waits for sessions left over from other tests to close, as Drain waits for
+// every session
+func drainingSession(t *testing.T) (*testSpawner, *testClient) {
+	t.Helper()
+	t.Cleanup(func() { draining.Store(false) })
+	waitFor(t, "earlier sessions to close", func() bool { return liveSessions.Load() == 0 })
+
+	spawner := newTestSpawner(t)
+	server := newTestServer(t, spawner, "")
+	client := dialTestClient(t, server.url)
+	client.register()
+	return spawner, client
+}
+
+func TestDrainWaitsForClientsToLeave(t *testing.T) {
+	spawner, client := drainingSession(t)
+
+	done := make(chan struct{})
+	go func() {
+		Drain(context.Background(), time.Minute)
+		close(done)
+	}()
+
+	var notice cartaDefinitions.ErrorData
+	client.expect(cartaDefinitions.EventType_ERROR_DATA, &notice)
+	if !strings.Contains(notice.Message, "shutting down") {
+		t.Errorf("got notice %q, want a shutdown warning", notice.Message)
+	}
+	if !Draining() {
+		t.Error("not draining after Drain was called")
+	}
+	_ = client.conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain did not return after the client left")
+	}
+	if !spawner.stopped(1) {
+		t.Error("worker was not shut down")
+	}
+}
+
+func TestDrainTerminatesRemainingSessions(t *testing.T) {
+	spawner, client := drainingSession(t)
+
+	Drain(context.Background(), 100*time.Millisecond)
+	if n := liveSessions.Load(); n != 0 {
+		t.Errorf("%d sessions still live after Drain returned", n)
+	}
+	if !spawner.stopped(1) {
+		t.Error("worker was not shut down")
+	}
+
+	// The client is warned, then disconnected once the grace period is over
+	client.expect(cartaDefinitions.EventType_ERROR_DATA, nil)
+	if _, _, err := client.conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("got %v after the warning, want the close frame", err)
+	}
+}
+
+func TestDrainWithoutSessions(t *testing.T) {
+	t.Cleanup(func() { draining.Store(false) })
+	waitFor(t, "earlier sessions to close", func() bool { return liveSessions.Load() == 0 })
+
+	start := time.Now()
+	Drain(context.Background(), time.Minute)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Drain took %s with no sessions", elapsed)
+	}
+	if !Draining() {
+		t.Error("not draining after Drain was called")
+	}
+}
@@ -0,0 +1,337 @@
+package session
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+)
+
+var (
+	ErrInviteNotFound   = errors.New("invite not found")
+	ErrTooManyFollowers = errors.New("session has too many followers")
+	ErrFollowerSession  = errors.New("follower sessions cannot be shared")
+)
+
+// Invite allows other users to follow a session in read-only mode
+type Invite struct {
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"createdAt"`
+	Followers int       `json:"followers"`
+}
+
+// CreateInvite creates a new invite link token for the session
+func (s *Session) CreateInvite() (Invite, error) {
+	if s.leader != nil {
+		return Invite{}, ErrFollowerSession
+	}
+	invite := Invite{Token: rand.Text(), CreatedAt: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.invites == nil {
+		s.invites = make(map[string]Invite)
+	}
+	s.invites[invite.Token] = invite
+	slog.Info("Created invite for session", "sessionId", s.ID)
+	return invite, nil
+}
+
+// Invites returns the session's invites, with the number of followers that joined through each of them
+func (s *Session) Invites() []Invite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites := make([]Invite, 0, len(s.invites))
+	for _, invite := range s.invites {
+		for _, f := range s.followers {
+			if f.invite == invite.Token {
+				invite.Followers++
+			}
+		}
+		invites = append(invites, invite)
+	}
+	slices.SortFunc(invites, func(a, b Invite) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return invites
+}
+
+// RevokeInvite deletes an invite and disconnects the followers that joined through it
+func (s *Session) RevokeInvite(token string) error {
+	s.mu.Lock()
+	if _, ok := s.invites[token]; !ok {
+		s.mu.Unlock()
+		return ErrInviteNotFound
+	}
+	delete(s.invites, token)
+	var followers []*Session
+	for _, f := range s.followers {
+		if f.invite == token {
+			followers = append(followers, f)
+		}
+	}
+	s.mu.Unlock()
+
+	slog.Info("Revoked invite for session", "sessionId", s.ID, "followers", len(followers))
+	for _, f := range followers {
+		if err := f.Terminate("Invite revoked"); err != nil {
+			slog.Warn("Failed to terminate follower", "sessionId", f.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// FindInvite looks up the live session that an invite token belongs to
+func FindInvite(token string) (*Session, bool) {
+	for _, s := range List() {
+		s.mu.Lock()
+		_, ok := s.invites[token]
+		s.mu.Unlock()
+		if ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// NewFollowerSession creates a read-only session that receives everything the leader's workers send to the leader.
+// Follower sessions have no workers of their own, and the messages their clients send are not passed on.
+func NewFollowerSession(conn *websocket.Conn, remoteAddr string, leader *Session, token string, user *auth.User) (*Session, error) {
+	s := &Session{
+		ID:          uuid.New().String(),
+		RemoteAddr:  remoteAddr,
+		ConnectedAt: time.Now(),
+		WebSocket:   conn,
+		User:        user,
+		leader:      leader,
+		invite:      token,
+	}
+
+	leader.mu.Lock()
+	_, ok := leader.invites[token]
+	switch {
+	case !ok || leader.closed:
+		leader.mu.Unlock()
+		return nil, ErrInviteNotFound
+	case len(leader.followers) >= settings.MaxFollowers:
+		leader.mu.Unlock()
+		return nil, ErrTooManyFollowers
+	}
+	if leader.followers == nil {
+		leader.followers = make(map[string]*Session)
+	}
+	leader.followers[s.ID] = s
+	leader.mu.Unlock()
+
+	s.Context, s.Cancel = context.WithCancel(context.Background())
+	register(s)
+	slog.Info("Follower joined session", "sessionId", s.ID, "leaderSessionId", leader.ID, "user", user)
+	return s, nil
+}
+
+// fanOut sends a message from one of the session's workers to its followers, in each follower's ICD version. The
+// images that the message opens are remembered for followers who join later.
+func (s *Session) fanOut(message []byte) {
+	s.trackOpenImages(message)
+
+	s.mu.Lock()
+	if len(s.followers) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	followers := make([]*Session, 0, len(s.followers))
+	for _, f := range s.followers {
+		followers = append(followers, f)
+	}
+	version := s.clientIcdVersion
+	s.mu.Unlock()
+
+	// Followers didn't send the leader's requests, so responses reach them as unsolicited messages
+	if len(message) >= 8 && binary.LittleEndian.Uint32(message[4:8]) != 0 {
+		message = slices.Clone(message)
+		binary.LittleEndian.PutUint32(message[4:8], 0)
+	}
+
+	for _, f := range followers {
+		f.mu.Lock()
+		followerVersion := f.clientIcdVersion
+		f.mu.Unlock()
+
+		translated := message
+		if followerVersion != 0 && followerVersion != version {
+			var err error
+			translated, err = translateMessage(message, version, followerVersion)
+			if err != nil {
+				continue
+			}
+		}
+		// Followers that fall behind lose streamed data first, and are disconnected if they get stuck, without
+		// affecting the leader
+		_ = f.sendToClient(translated)
+	}
+}
+
+// trackOpenImages records the images opened by a message from one of the session's workers, which is in the client's
+// ICD version
+func (s *Session) trackOpenImages(message []byte) {
+	prefix, err := cartaHelpers.DecodeMessagePrefix(message)
+	if (err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion)) || !imageOpeningEvents[prefix.EventType] {
+		return
+	}
+	msg, err := cartaHelpers.UnmarshalMessage(prefix.EventType, message[8:])
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ack := range openFileAcks(msg) {
+		if !ack.Success {
+			continue
+		}
+		if s.openImages == nil {
+			s.openImages = make(map[int32]*cartaDefinitions.OpenFileAck)
+		}
+		s.openImages[ack.FileId] = ack
+	}
+}
+
+// sendLeaderState tells a new follower's client about the images and regions open in the leader's session, so that
+// the data streamed from the leader's workers refers to images that the client knows about. Each image is followed by
+// its regions, with the leader's region IDs.
+func (s *Session) sendLeaderState() error {
+	s.leader.mu.Lock()
+	images := slices.SortedFunc(maps.Values(s.leader.openImages), func(a, b *cartaDefinitions.OpenFileAck) int {
+		return cmp.Compare(a.FileId, b.FileId)
+	})
+	s.leader.mu.Unlock()
+
+	regions := make(map[int32]map[int32]*cartaDefinitions.RegionInfo)
+	for _, w := range s.leader.workers() {
+		for _, e := range w.state.snapshot() {
+			if e.eventType != cartaDefinitions.EventType_SET_REGION {
+				continue
+			}
+			var region cartaDefinitions.SetRegion
+			if err := proto.Unmarshal(e.body, &region); err != nil || region.RegionInfo == nil {
+				continue
+			}
+			if regions[region.FileId] == nil {
+				regions[region.FileId] = make(map[int32]*cartaDefinitions.RegionInfo)
+			}
+			regions[region.FileId][region.RegionId] = region.RegionInfo
+		}
+	}
+
+	for _, ack := range images {
+		if err := s.sendUnsolicited(ack, cartaDefinitions.EventType_OPEN_FILE_ACK); err != nil {
+			return err
+		}
+		if len(regions[ack.FileId]) == 0 {
+			continue
+		}
+		importAck := &cartaDefinitions.ImportRegionAck{Success: true, Regions: regions[ack.FileId]}
+		if err := s.sendUnsolicited(importAck, cartaDefinitions.EventType_IMPORT_REGION_ACK); err != nil {
+			return err
+		}
+	}
+	slog.Debug("Sent leader's state to follower", "sessionId", s.ID, "leaderSessionId", s.leader.ID, "images", len(images))
+	return nil
+}
+
+// sendUnsolicited sends a message generated by the controller to the client without a request ID
+func (s *Session) sendUnsolicited(msg proto.Message, eventType cartaDefinitions.EventType) error {
+	reply, err := s.prepareClientMessage(msg, eventType, 0)
+	if err != nil {
+		return err
+	}
+	return s.sendToClient(reply)
+}
+
+// removeFollower is called when a follower disconnects
+func (s *Session) removeFollower(f *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.followers, f.ID)
+}
+
+// endFollowers disconnects all followers when the leader's session ends
+func (s *Session) endFollowers() {
+	s.mu.Lock()
+	followers := make([]*Session, 0, len(s.followers))
+	for _, f := range s.followers {
+		followers = append(followers, f)
+	}
+	s.invites = nil
+	s.mu.Unlock()
+
+	for _, f := range followers {
+		if err := f.SendNotice(cartaDefinitions.ErrorSeverity_WARNING, []string{"follow"}, "The session you were following has ended"); err != nil {
+			slog.Warn("Failed to notify follower", "sessionId", f.ID, "error", err)
+		}
+		if err := f.Terminate("Leader session ended"); err != nil {
+			slog.Warn("Failed to terminate follower", "sessionId", f.ID, "error", err)
+		}
+	}
+}
+
+// handleFollowerMessage answers the messages sent by a follower's client. Registration succeeds so that the frontend
+// can start up, but every other request is refused, as followers can't control the leader's session.
+func (s *Session) handleFollowerMessage(eventType cartaDefinitions.EventType, requestId uint32, body []byte) error {
+	var response proto.Message
+	var responseType cartaDefinitions.EventType
+
+	switch {
+	case eventType == cartaDefinitions.EventType_REGISTER_VIEWER:
+		var payload cartaDefinitions.RegisterViewer
+		if err := proto.Unmarshal(body, &payload); err != nil {
+			return fmt.Errorf("error parsing message: %v", err)
+		}
+		response, responseType = &cartaDefinitions.RegisterViewerAck{
+			SessionId: payload.SessionId,
+			Success:   true,
+			Message:   "Following a shared session in read-only mode",
+		}, cartaDefinitions.EventType_REGISTER_VIEWER_ACK
+	case len(responseEventTypes(eventType)) > 0:
+		message := fmt.Sprintf("%s is not available while following a shared session", strings.ToLower(eventType.String()))
+		response, responseType = failureResponse(eventType, message)
+	default:
+		slog.Debug("Dropping message from follower", "sessionId", s.ID, "eventType", eventType)
+		return nil
+	}
+
+	reply, err := s.prepareClientMessage(response, responseType, requestId)
+	if err != nil {
+		return err
+	}
+	if err := s.sendToClient(reply); err != nil {
+		return err
+	}
+	if eventType == cartaDefinitions.EventType_REGISTER_VIEWER {
+		return s.sendLeaderState()
+	}
+	return nil
+}
+
+// Following returns the ID of the session that this session follows, or "" if it isn't a follower
+func (s *Session) Following() string {
+	if s.leader == nil {
+		return ""
+	}
+	return s.leader.ID
+}
@@ -0,0 +1,91 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/mockworker"
+)
+
+// regionScript makes the mock worker acknowledge new regions with region ID 1
+func regionScript(t *testing.T) *mockworker.Script {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.json")
+	script := `{"responses": {"SET_REGION": [{"eventType": "SET_REGION_ACK", "message": {"success": true, "regionId": 1}}]}}`
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := mockworker.LoadScript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFollowerReceivesLeaderState(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.MaxFollowers = 1
+
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "images"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "m51.fits"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	spawner := newTestSpawner(t, mockworker.Options{BaseFolder: base, Script: regionScript(t)})
+	server := newTestServer(t, spawner, base)
+	leader := dialTestClient(t, server.url)
+	leader.register()
+
+	leader.send(cartaDefinitions.EventType_OPEN_FILE, 2, &cartaDefinitions.OpenFile{Directory: basePlaceholder, File: "m51.fits", FileId: 0})
+	leader.expect(cartaDefinitions.EventType_OPEN_FILE_ACK, nil)
+	region := &cartaDefinitions.RegionInfo{
+		RegionType:    cartaDefinitions.RegionType_RECTANGLE,
+		ControlPoints: []*cartaDefinitions.Point{{X: 10, Y: 20}, {X: 4, Y: 6}},
+	}
+	leader.send(cartaDefinitions.EventType_SET_REGION, 3, &cartaDefinitions.SetRegion{FileId: 0, RegionId: -1, RegionInfo: region})
+	leader.expect(cartaDefinitions.EventType_SET_REGION_ACK, nil)
+
+	invite, err := server.session(t, 1).CreateInvite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := dialTestClient(t, server.url+"?follow="+invite.Token)
+	follower.register()
+
+	// The leader's open image and its regions follow the registration, without the leader's request IDs
+	prefix, body := follower.next()
+	if prefix.EventType != cartaDefinitions.EventType_OPEN_FILE_ACK || prefix.RequestId != 0 {
+		t.Fatalf("follower got %s with request %d after registering, want OPEN_FILE_ACK with request 0", prefix.EventType, prefix.RequestId)
+	}
+	var ack cartaDefinitions.OpenFileAck
+	if err := proto.Unmarshal(body, &ack); err != nil || !ack.Success || ack.FileId != 0 {
+		t.Errorf("follower got open file acknowledgement %v", &ack)
+	}
+	prefix, body = follower.next()
+	if prefix.EventType != cartaDefinitions.EventType_IMPORT_REGION_ACK || prefix.RequestId != 0 {
+		t.Fatalf("follower got %s with request %d after the image, want IMPORT_REGION_ACK with request 0", prefix.EventType, prefix.RequestId)
+	}
+	var regions cartaDefinitions.ImportRegionAck
+	if err := proto.Unmarshal(body, &regions); err != nil {
+		t.Fatal(err)
+	}
+	if got := regions.Regions[1]; got == nil || len(got.ControlPoints) != 2 || got.ControlPoints[0].X != 10 {
+		t.Errorf("follower got regions %v, want the leader's rectangle as region 1", regions.Regions)
+	}
+
+	// Live responses to the leader's requests reach the follower as unsolicited messages
+	leader.send(cartaDefinitions.EventType_FILE_LIST_REQUEST, 4, &cartaDefinitions.FileListRequest{Directory: basePlaceholder + "/images"})
+	if prefix := leader.expect(cartaDefinitions.EventType_FILE_LIST_RESPONSE, nil); prefix.RequestId != 4 {
+		t.Errorf("leader got file list with request %d, want 4", prefix.RequestId)
+	}
+	if prefix := follower.expect(cartaDefinitions.EventType_FILE_LIST_RESPONSE, nil); prefix.RequestId != 0 {
+		t.Errorf("follower got file list with the leader's request %d", prefix.RequestId)
+	}
+}
@@ -0,0 +1,314 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/pkg/mockworker"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
+)
+
+// testSpawner stands in for the spawner, starting an in-process mock worker on a local port for each worker request
+type testSpawner struct {
+	url string
+
+	mu      sync.Mutex
+	options []mockworker.Options
+	workers []*testWorker
+	// unreachable holds the numbers of the workers that stop listening as soon as they are started
+	unreachable map[int]bool
+}
+
+type testWorker struct {
+	id       string
+	worker   *mockworker.Worker
+	listener net.Listener
+	stopped  bool
+}
+
+// newTestSpawner starts a spawner whose workers use the given options in turn, the last of them for any further
+// workers
+func newTestSpawner(t *testing.T, options ...mockworker.Options) *testSpawner {
+	t.Helper()
+	if len(options) == 0 {
+		options = []mockworker.Options{{}}
+	}
+	sp := &testSpawner{options: options}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sp.mu.Lock()
+		opts := sp.options[min(len(sp.workers), len(sp.options)-1)]
+		tw := &testWorker{id: fmt.Sprint(len(sp.workers) + 1), worker: mockworker.New(opts), listener: l}
+		sp.workers = append(sp.workers, tw)
+		unreachable := sp.unreachable[len(sp.workers)]
+		sp.mu.Unlock()
+
+		if unreachable {
+			_ = l.Close()
+		} else {
+			go func() { _ = tw.worker.Serve(l) }()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(spawnerHelpers.WorkerInfo{
+			Port:     l.Addr().(*net.TCPAddr).Port,
+			Address:  "127.0.0.1",
+			WorkerId: tw.id,
+		})
+	})
+	mux.HandleFunc("DELETE /worker/{id}", func(w http.ResponseWriter, r *http.Request) {
+		sp.mu.Lock()
+		defer sp.mu.Unlock()
+		for _, tw := range sp.workers {
+			if tw.id == r.PathValue("id") {
+				_ = tw.listener.Close()
+				tw.stopped = true
+			}
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		server.Close()
+		sp.mu.Lock()
+		defer sp.mu.Unlock()
+		for _, tw := range sp.workers {
+			_ = tw.listener.Close()
+			tw.worker.Crash()
+		}
+	})
+	sp.url = server.URL
+	return sp
+}
+
+// worker returns the mock worker started for the nth worker request, counting from 1
+func (sp *testSpawner) worker(t *testing.T, n int) *mockworker.Worker {
+	t.Helper()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if n > len(sp.workers) {
+		t.Fatalf("worker %d was never started, only %d were", n, len(sp.workers))
+	}
+	return sp.workers[n-1].worker
+}
+
+// makeUnreachable makes the nth worker, counting from 1, stop listening as soon as it is started
+func (sp *testSpawner) makeUnreachable(n int) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.unreachable == nil {
+		sp.unreachable = make(map[int]bool)
+	}
+	sp.unreachable[n] = true
+}
+
+// stopped reports whether the nth worker has been shut down through the spawner
+func (sp *testSpawner) stopped(n int) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return n <= len(sp.workers) && sp.workers[n-1].stopped
+}
+
+// started returns the number of workers started so far
+func (sp *testSpawner) started() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.workers)
+}
+
+// testServer accepts client connections like the controller's WebSocket handler, creating a session for each of
+// them, or a follower session when the follow parameter names an invite
+type testServer struct {
+	url string
+
+	mu       sync.Mutex
+	sessions []*Session
+}
+
+func newTestServer(t *testing.T, spawner *testSpawner, baseFolder string) *testServer {
+	t.Helper()
+	ts := &testServer{}
+	var handlers sync.WaitGroup
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = c.Close() }()
+
+		var s *Session
+		if invite := r.URL.Query().Get("follow"); invite != "" {
+			leader, ok := FindInvite(invite)
+			if !ok {
+				return
+			}
+			if s, err = NewFollowerSession(c, r.RemoteAddr, leader, invite, nil); err != nil {
+				return
+			}
+		} else {
+			s = NewSession(c, r.RemoteAddr, spawner.url, baseFolder, nil)
+		}
+		ts.mu.Lock()
+		ts.sessions = append(ts.sessions, s)
+		ts.mu.Unlock()
+
+		s.HandleConnection()
+		defer s.HandleDisconnect()
+		for {
+			messageType, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			go func() { _ = s.HandleMessage(message) }()
+		}
+	}))
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+		handlers.Wait()
+	})
+	ts.url = "ws" + strings.TrimPrefix(server.URL, "http")
+	return ts
+}
+
+// session returns the nth session created by the server, counting from 1
+func (ts *testServer) session(t *testing.T, n int) *Session {
+	t.Helper()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if n > len(ts.sessions) {
+		t.Fatalf("session %d was never created, only %d were", n, len(ts.sessions))
+	}
+	return ts.sessions[n-1]
+}
+
+// testClient plays the part of the frontend
+type testClient struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	version uint16
+}
+
+func dialTestClient(t *testing.T, url string) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testClient{t: t, conn: conn, version: cartaHelpers.IcdVersion}
+}
+
+// send frames a message in the client's ICD version and sends it
+func (c *testClient) send(eventType cartaDefinitions.EventType, requestId uint32, msg proto.Message) {
+	c.t.Helper()
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	message := cartaHelpers.PrepareVersionedBinaryMessage(body, eventType, c.version, requestId)
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// register registers the client as a viewer and returns the acknowledgement
+func (c *testClient) register() *cartaDefinitions.RegisterViewerAck {
+	c.t.Helper()
+	c.send(cartaDefinitions.EventType_REGISTER_VIEWER, 1, &cartaDefinitions.RegisterViewer{})
+	var ack cartaDefinitions.RegisterViewerAck
+	c.expect(cartaDefinitions.EventType_REGISTER_VIEWER_ACK, &ack)
+	if !ack.Success {
+		c.t.Fatalf("registration failed: %s", ack.Message)
+	}
+	return &ack
+}
+
+// next reads the next binary message, failing the test if none arrives in time
+func (c *testClient) next() (cartaHelpers.MessagePrefix, []byte) {
+	c.t.Helper()
+	if err := c.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		messageType, message, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("no message from server: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		// Messages in other ICD versions are decoded too, as some tests use them
+		prefix, err := cartaHelpers.DecodeMessagePrefix(message)
+		if err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+			c.t.Fatalf("malformed message from server: %v", err)
+		}
+		return prefix, message[8:]
+	}
+}
+
+// expect skips messages until one of the given type arrives, and unmarshals it into msg. It returns the message's
+// prefix.
+func (c *testClient) expect(eventType cartaDefinitions.EventType, msg proto.Message) cartaHelpers.MessagePrefix {
+	c.t.Helper()
+	for {
+		prefix, body := c.next()
+		if prefix.EventType != eventType {
+			continue
+		}
+		if msg != nil {
+			if err := proto.Unmarshal(body, msg); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return prefix
+	}
+}
+
+// imageFolder returns a base folder with an image in it
+func imageFolder(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "m51.fits"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+// waitFor polls a condition until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
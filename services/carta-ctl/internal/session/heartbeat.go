@@ -0,0 +1,73 @@
+package session
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/CARTAvis/go-carta/pkg/config"
+)
+
+// settings holds the session configuration shared by all sessions. It is set once at startup by Configure
+var settings config.SessionConfig
+
+// Configure sets the configuration used by all sessions created afterwards
+func Configure(cfg config.SessionConfig) error {
+	policies, err := compileMessagePolicies(cfg.MessagePolicies)
+	if err != nil {
+		return err
+	}
+	alloc, err := newAllocator(cfg)
+	if err != nil {
+		return err
+	}
+	rateLimits, err := compileEventRateLimits(cfg.RateLimit.Events)
+	if err != nil {
+		return err
+	}
+	settings = cfg
+	messagePolicies = policies
+	workerAllocator = alloc
+	eventRateLimits = rateLimits
+	checkIcdVersions()
+	return nil
+}
+
+// startHeartbeat sends WebSocket ping frames to the peer at the configured interval and enforces a read deadline
+// that is extended each time a pong arrives. If the peer stops responding, the blocked read on the
+// connection fails, which lets the owning read loop clean up. The heartbeat stops when done is closed or a ping
+// can no longer be written.
+func startHeartbeat(conn *websocket.Conn, name string, done <-chan struct{}) {
+	if settings.PingInterval <= 0 || settings.PongTimeout <= 0 {
+		return
+	}
+
+	extendDeadline := func() {
+		if err := conn.SetReadDeadline(time.Now().Add(settings.PongTimeout)); err != nil {
+			slog.Debug("Failed to extend read deadline", "name", name, "error", err)
+		}
+	}
+	extendDeadline()
+	conn.SetPongHandler(func(string) error {
+		extendDeadline()
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(settings.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(settings.PingInterval))
+				if err != nil {
+					slog.Debug("Stopping heartbeat", "name", name, "error", err)
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,99 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+)
+
+// icdShim translates the body of a message from one ICD version to an adjacent one. It may also change the event
+// type, for messages that were renamed or replaced between the two versions.
+type icdShim func(eventType cartaDefinitions.EventType, body []byte) (cartaDefinitions.EventType, []byte, error)
+
+type icdVersionPair struct {
+	from, to uint16
+}
+
+// icdShims holds the translation shims between adjacent ICD versions. Shims are registered with registerIcdShim from
+// init functions alongside their translation code. Clients and workers with different versions can only be proxied
+// between when a shim exists in each direction.
+var icdShims = map[icdVersionPair]icdShim{}
+
+// registerIcdShim registers the shim used to translate messages from one ICD version to the next or previous version
+func registerIcdShim(from, to uint16, shim icdShim) {
+	if from+1 != to && to+1 != from {
+		panic(fmt.Sprintf("ICD shims must translate between adjacent versions, not %d and %d", from, to))
+	}
+	icdShims[icdVersionPair{from, to}] = shim
+}
+
+// canTranslate reports whether messages can be proxied in both directions between the two versions
+func canTranslate(a, b uint16) bool {
+	if a == b {
+		return true
+	}
+	_, forward := icdShims[icdVersionPair{a, b}]
+	_, backward := icdShims[icdVersionPair{b, a}]
+	return forward && backward
+}
+
+// translateMessage rewrites a framed message from one ICD version to another
+func translateMessage(message []byte, from, to uint16) ([]byte, error) {
+	if from == to {
+		return message, nil
+	}
+	shim, ok := icdShims[icdVersionPair{from, to}]
+	if !ok {
+		return nil, fmt.Errorf("no translation from ICD version %d to %d", from, to)
+	}
+	prefix, err := cartaHelpers.DecodeMessagePrefix(message)
+	if err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+		return nil, err
+	}
+	eventType, body, err := shim(prefix.EventType, message[8:])
+	if err != nil {
+		return nil, fmt.Errorf("error translating %s from ICD version %d to %d: %w", prefix.EventType, from, to, err)
+	}
+	return cartaHelpers.PrepareVersionedBinaryMessage(body, eventType, to, prefix.RequestId), nil
+}
+
+// acceptedClientIcdVersions returns the ICD versions that clients may use
+func acceptedClientIcdVersions() []uint16 {
+	if len(settings.ClientIcdVersions) == 0 {
+		return []uint16{cartaHelpers.IcdVersion}
+	}
+	versions := make([]uint16, 0, len(settings.ClientIcdVersions))
+	for _, v := range settings.ClientIcdVersions {
+		versions = append(versions, uint16(v))
+	}
+	return versions
+}
+
+// workerIcdCandidates returns the ICD versions to try when registering with a worker on behalf of a client, in
+// order of preference. The client's own version is tried first, as it needs no translation.
+func workerIcdCandidates(clientVersion uint16) []uint16 {
+	candidates := []uint16{clientVersion}
+	for _, v := range settings.WorkerIcdVersions {
+		version := uint16(v)
+		if !slices.Contains(candidates, version) && canTranslate(clientVersion, version) {
+			candidates = append(candidates, version)
+		}
+	}
+	return candidates
+}
+
+// checkIcdVersions warns about accepted client versions that no configured worker version can serve
+func checkIcdVersions() {
+	for _, clientVersion := range acceptedClientIcdVersions() {
+		if len(workerIcdCandidates(clientVersion)) > 1 || len(settings.WorkerIcdVersions) == 0 {
+			continue
+		}
+		if !slices.Contains(settings.WorkerIcdVersions, int(clientVersion)) {
+			slog.Warn("No translation between client ICD version and any worker ICD version", "clientVersion", clientVersion, "workerVersions", settings.WorkerIcdVersions)
+		}
+	}
+}
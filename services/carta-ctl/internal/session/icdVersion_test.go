@@ -0,0 +1,228 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/pkg/mockworker"
+)
+
+// nextIcdVersion is a made-up ICD version after the one the controller speaks, for testing translation
+const nextIcdVersion = cartaHelpers.IcdVersion + 1
+
+// withIcdShims registers shims between the current and next ICD versions for the duration of a test
+func withIcdShims(t *testing.T, forward, backward icdShim) {
+	t.Helper()
+	registerIcdShim(cartaHelpers.IcdVersion, nextIcdVersion, forward)
+	registerIcdShim(nextIcdVersion, cartaHelpers.IcdVersion, backward)
+	t.Cleanup(func() {
+		delete(icdShims, icdVersionPair{cartaHelpers.IcdVersion, nextIcdVersion})
+		delete(icdShims, icdVersionPair{nextIcdVersion, cartaHelpers.IcdVersion})
+	})
+}
+
+func identityShim(eventType cartaDefinitions.EventType, body []byte) (cartaDefinitions.EventType, []byte, error) {
+	return eventType, body, nil
+}
+
+func TestTranslateMessage(t *testing.T) {
+	// In the next version, SET_CURSOR is pretend-renamed to SET_SPATIAL_REQUIREMENTS and its body is reversed
+	withIcdShims(t,
+		func(eventType cartaDefinitions.EventType, body []byte) (cartaDefinitions.EventType, []byte, error) {
+			if eventType == cartaDefinitions.EventType_SET_CURSOR {
+				eventType = cartaDefinitions.EventType_SET_SPATIAL_REQUIREMENTS
+			}
+			reversed := slices.Clone(body)
+			slices.Reverse(reversed)
+			return eventType, reversed, nil
+		},
+		func(eventType cartaDefinitions.EventType, body []byte) (cartaDefinitions.EventType, []byte, error) {
+			if eventType == cartaDefinitions.EventType_SET_SPATIAL_REQUIREMENTS {
+				eventType = cartaDefinitions.EventType_SET_CURSOR
+			}
+			reversed := slices.Clone(body)
+			slices.Reverse(reversed)
+			return eventType, reversed, nil
+		},
+	)
+	if !canTranslate(cartaHelpers.IcdVersion, nextIcdVersion) {
+		t.Fatal("canTranslate = false with shims in both directions")
+	}
+
+	body := []byte{1, 2, 3}
+	original := cartaHelpers.PrepareBinaryMessage(body, cartaDefinitions.EventType_SET_CURSOR, 42)
+	translated, err := translateMessage(original, cartaHelpers.IcdVersion, nextIcdVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := cartaHelpers.PrepareVersionedBinaryMessage([]byte{3, 2, 1}, cartaDefinitions.EventType_SET_SPATIAL_REQUIREMENTS, nextIcdVersion, 42)
+	if !bytes.Equal(translated, want) {
+		t.Errorf("translated to the next version as %v, want %v", translated, want)
+	}
+
+	back, err := translateMessage(translated, nextIcdVersion, cartaHelpers.IcdVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back, original) {
+		t.Errorf("translated back as %v, want the original %v", back, original)
+	}
+
+	if _, err := translateMessage(original, cartaHelpers.IcdVersion, nextIcdVersion+1); err == nil {
+		t.Error("translated between versions without a shim")
+	}
+}
+
+func TestCanTranslateNeedsBothDirections(t *testing.T) {
+	registerIcdShim(cartaHelpers.IcdVersion, nextIcdVersion, identityShim)
+	t.Cleanup(func() { delete(icdShims, icdVersionPair{cartaHelpers.IcdVersion, nextIcdVersion}) })
+
+	if canTranslate(cartaHelpers.IcdVersion, nextIcdVersion) {
+		t.Error("canTranslate = true with a shim in only one direction")
+	}
+}
+
+func TestRegisterFallsBackToWorkerIcdVersion(t *testing.T) {
+	withIcdShims(t, identityShim, identityShim)
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.ClientIcdVersions = []int{nextIcdVersion}
+	settings.WorkerIcdVersions = []int{nextIcdVersion, cartaHelpers.IcdVersion}
+	settings.WorkerRegisterTimeout = 200 * time.Millisecond
+
+	// The mock worker ignores messages in any version other than its own, like an older backend would
+	spawner := newTestSpawner(t, mockworker.Options{BaseFolder: t.TempDir()})
+	server := newTestServer(t, spawner, "")
+	client := dialTestClient(t, server.url)
+	client.version = nextIcdVersion
+
+	client.send(cartaDefinitions.EventType_REGISTER_VIEWER, 1, &cartaDefinitions.RegisterViewer{})
+	var ack cartaDefinitions.RegisterViewerAck
+	prefix := client.expect(cartaDefinitions.EventType_REGISTER_VIEWER_ACK, &ack)
+	if !ack.Success {
+		t.Fatalf("registration failed: %s", ack.Message)
+	}
+	if prefix.IcdVersion != nextIcdVersion || prefix.RequestId != 1 {
+		t.Errorf("acknowledged with ICD version %d and request %d, want %d and 1", prefix.IcdVersion, prefix.RequestId, nextIcdVersion)
+	}
+
+	s := server.session(t, 1)
+	s.mu.Lock()
+	workerVersion := s.sharedWorker.icdVersion
+	s.mu.Unlock()
+	if workerVersion != cartaHelpers.IcdVersion {
+		t.Errorf("registered with the worker using ICD version %d, want %d", workerVersion, cartaHelpers.IcdVersion)
+	}
+
+	// Later requests and responses are translated in both directions
+	client.send(cartaDefinitions.EventType_FILE_LIST_REQUEST, 2, &cartaDefinitions.FileListRequest{Directory: "images"})
+	var list cartaDefinitions.FileListResponse
+	prefix = client.expect(cartaDefinitions.EventType_FILE_LIST_RESPONSE, &list)
+	if prefix.IcdVersion != nextIcdVersion || prefix.RequestId != 2 || list.Directory != "images" {
+		t.Errorf("got file list for %q with ICD version %d and request %d", list.Directory, prefix.IcdVersion, prefix.RequestId)
+	}
+}
+
+// registrationWorker accepts a single connection and hands each REGISTER_VIEWER it receives to answer, which may
+// reply on the connection. It returns a SessionWorker connected to it, and a channel that is closed once the
+// connection has been closed from the controller's side.
+func registrationWorker(t *testing.T, answer func(conn *websocket.Conn, prefix cartaHelpers.MessagePrefix)) (*SessionWorker, chan struct{}) {
+	t.Helper()
+	closed := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		defer close(closed)
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			prefix, err := cartaHelpers.DecodeMessagePrefix(message)
+			if err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+				t.Errorf("malformed message from controller: %v", err)
+				return
+			}
+			answer(conn, prefix)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &SessionWorker{conn: conn, clientIcdVersion: nextIcdVersion}, closed
+}
+
+func registrationAck(version uint16, requestId uint32) []byte {
+	body, _ := proto.Marshal(&cartaDefinitions.RegisterViewerAck{Success: true})
+	return cartaHelpers.PrepareVersionedBinaryMessage(body, cartaDefinitions.EventType_REGISTER_VIEWER_ACK, version, requestId)
+}
+
+func TestRegisterIgnoresLateAcknowledgement(t *testing.T) {
+	withIcdShims(t, identityShim, identityShim)
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.WorkerIcdVersions = []int{nextIcdVersion, cartaHelpers.IcdVersion}
+	settings.WorkerRegisterTimeout = 100 * time.Millisecond
+
+	// The worker answers the first probe only after the second has been sent, and the second after that
+	var probes sync.WaitGroup
+	probes.Add(2)
+	var writes sync.Mutex
+	sw, _ := registrationWorker(t, func(conn *websocket.Conn, prefix cartaHelpers.MessagePrefix) {
+		probes.Done()
+		go func() {
+			probes.Wait()
+			if prefix.IcdVersion == cartaHelpers.IcdVersion {
+				time.Sleep(50 * time.Millisecond)
+			}
+			writes.Lock()
+			defer writes.Unlock()
+			_ = conn.WriteMessage(websocket.BinaryMessage, registrationAck(prefix.IcdVersion, prefix.RequestId))
+		}()
+	})
+
+	if _, err := sw.register(t.Context(), nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if sw.icdVersion != cartaHelpers.IcdVersion {
+		t.Errorf("registered with ICD version %d from the late acknowledgement, want %d", sw.icdVersion, cartaHelpers.IcdVersion)
+	}
+}
+
+func TestFailedRegisterStopsReading(t *testing.T) {
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.WorkerIcdVersions = nil
+	settings.WorkerRegisterTimeout = 50 * time.Millisecond
+
+	sw, closed := registrationWorker(t, func(*websocket.Conn, cartaHelpers.MessagePrefix) {})
+	if _, err := sw.register(t.Context(), nil, 1); err == nil {
+		t.Fatal("registered with a worker that never answered")
+	}
+	// The connection is closed, which is the only way to stop the registration's reader
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to the worker is still open after registration failed")
+	}
+}
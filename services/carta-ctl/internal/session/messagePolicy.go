@@ -0,0 +1,118 @@
+package session
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/pkg/config"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+)
+
+// everyone matches all users, including anonymous users, in a message policy's groups
+const everyone = "*"
+
+// messagePolicy restricts the message types that members of its groups may send
+type messagePolicy struct {
+	groups []string
+	allow  []cartaDefinitions.EventType
+	deny   []cartaDefinitions.EventType
+}
+
+// messagePolicies is compiled from the session configuration by Configure
+var messagePolicies []messagePolicy
+
+func compileMessagePolicies(cfg []config.MessagePolicy) ([]messagePolicy, error) {
+	policies := make([]messagePolicy, 0, len(cfg))
+	for i, c := range cfg {
+		if len(c.Groups) == 0 {
+			return nil, fmt.Errorf("message policy %d has no groups", i)
+		}
+		allow, err := parseEventTypes(c.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("message policy %d: %w", i, err)
+		}
+		deny, err := parseEventTypes(c.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("message policy %d: %w", i, err)
+		}
+		policies = append(policies, messagePolicy{groups: c.Groups, allow: allow, deny: deny})
+	}
+	return policies, nil
+}
+
+func parseEventTypes(names []string) ([]cartaDefinitions.EventType, error) {
+	eventTypes := make([]cartaDefinitions.EventType, 0, len(names))
+	for _, name := range names {
+		value, ok := cartaDefinitions.EventType_value[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		eventTypes = append(eventTypes, cartaDefinitions.EventType(value))
+	}
+	return eventTypes, nil
+}
+
+func (p messagePolicy) appliesTo(u *auth.User) bool {
+	return slices.Contains(p.groups, everyone) || u.InGroup(p.groups...)
+}
+
+// messageAllowed reports whether a user may send messages of the given type. Every policy that applies to the user
+// must allow the message: it is denied if any of them lists it as denied, or has an allow list that doesn't include it.
+func messageAllowed(u *auth.User, eventType cartaDefinitions.EventType) bool {
+	for _, p := range messagePolicies {
+		if !p.appliesTo(u) {
+			continue
+		}
+		if slices.Contains(p.deny, eventType) {
+			return false
+		}
+		if len(p.allow) > 0 && !slices.Contains(p.allow, eventType) {
+			return false
+		}
+	}
+	return true
+}
+
+// responseEventTypes returns the event types of the X_ACK and X_RESPONSE messages that answer a request, if it has any
+func responseEventTypes(eventType cartaDefinitions.EventType) []cartaDefinitions.EventType {
+	name := eventType.String()
+	var responseTypes []cartaDefinitions.EventType
+	for _, candidate := range []string{name + "_ACK", strings.TrimSuffix(name, "_REQUEST") + "_RESPONSE"} {
+		if value, ok := cartaDefinitions.EventType_value[candidate]; ok {
+			responseTypes = append(responseTypes, cartaDefinitions.EventType(value))
+		}
+	}
+	return responseTypes
+}
+
+// failureResponse builds the response that the frontend expects for a request that could not be handled, so that it
+// can report the failure rather than waiting indefinitely. Requests are answered with a failed X_ACK or X_RESPONSE
+// message where one exists, and ERROR_DATA otherwise.
+func failureResponse(eventType cartaDefinitions.EventType, message string) (proto.Message, cartaDefinitions.EventType) {
+	for _, responseType := range responseEventTypes(eventType) {
+		response, err := cartaHelpers.NewMessage(responseType)
+		if err != nil {
+			continue
+		}
+		fields := response.ProtoReflect().Descriptor().Fields()
+		successField := fields.ByName("success")
+		messageField := fields.ByName("message")
+		if successField == nil || successField.Kind() != protoreflect.BoolKind || messageField == nil || messageField.Kind() != protoreflect.StringKind {
+			continue
+		}
+		response.ProtoReflect().Set(messageField, protoreflect.ValueOfString(message))
+		return response, responseType
+	}
+
+	return &cartaDefinitions.ErrorData{
+		Severity: cartaDefinitions.ErrorSeverity_ERROR,
+		Tags:     []string{"policy"},
+		Message:  message,
+	}, cartaDefinitions.EventType_ERROR_DATA
+}
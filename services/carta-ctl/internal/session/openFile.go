@@ -4,13 +4,11 @@ import (
 	"fmt"
 	"log/slog"
 
-	"github.com/gorilla/websocket"
-
 	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
 )
 
-// OpenFile needs to spin up a new worker and proxy the message to it
+// OpenFile is proxied to the worker chosen by the allocation strategy, which may need to be started first
 func (s *Session) handleOpenFile(_ cartaDefinitions.EventType, requestId uint32, msg []byte) error {
 	var payload cartaDefinitions.OpenFile
 	err := s.checkAndParse(&payload, requestId, msg)
@@ -18,33 +16,117 @@ func (s *Session) handleOpenFile(_ cartaDefinitions.EventType, requestId uint32,
 		return fmt.Errorf("error parsing message: %v", err)
 	}
 
+	fileWorker, recovering := s.allocateWorker(&payload)
+	if recovering != nil {
+		// The chosen worker crashed and is being replaced, so wait for the replacement
+		select {
+		case <-recovering:
+		case <-s.Context.Done():
+			return fmt.Errorf("session is closed")
+		}
+		fileWorker, _ = s.allocateWorker(&payload)
+	}
+	started := fileWorker == nil
+	if started {
+		fileWorker, err = s.startFileWorker(&payload, requestId)
+		if err != nil {
+			s.mu.Lock()
+			s.startingWorkers--
+			s.mu.Unlock()
+			return err
+		}
+	} else {
+		slog.Info("Opening file in existing worker", "workerName", fileWorker.name(), "fileId", payload.FileId)
+	}
+
+	s.mu.Lock()
+	if started {
+		s.startingWorkers--
+	}
+	// A worker started for a session that has since closed would never be shut down
+	if s.closed {
+		s.mu.Unlock()
+		if started {
+			s.discardWorker(fileWorker)
+		}
+		return fmt.Errorf("session is closed")
+	}
+	if s.fileMap == nil {
+		s.fileMap = make(map[int32]*SessionWorker)
+		s.fileRequests = make(map[int32]*cartaDefinitions.OpenFile)
+	}
+
+	s.fileMap[payload.FileId] = fileWorker
+	s.fileRequests[payload.FileId] = &payload
+	s.mu.Unlock()
+
+	if err := fileWorker.proxyMessageToWorker(cartaDefinitions.EventType_OPEN_FILE, requestId, msg); err != nil {
+		return err
+	}
+	s.recordState(fileWorker, cartaDefinitions.EventType_OPEN_FILE, requestId, msg)
+	return nil
+}
+
+// allocateWorker asks the allocation strategy for the worker to open a file in. A nil worker means that a new one
+// should be started, and is counted in startingWorkers until the caller has started it or failed to. If the chosen
+// worker is being replaced after a crash, its recovering channel is returned too.
+func (s *Session) allocateWorker(file *cartaDefinitions.OpenFile) (*SessionWorker, chan struct{}) {
+	size := int64(-1)
+	if _, ok := workerAllocator.(sizeAllocator); ok {
+		size = s.imageSize(file)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := workerAllocator.allocate(s, file, size)
+	if w == nil {
+		s.startingWorkers++
+		return nil, nil
+	}
+	return w, w.recovering
+}
+
+// startFileWorker starts a new worker for a file and registers it with the client's viewer session
+func (s *Session) startFileWorker(payload *cartaDefinitions.OpenFile, requestId uint32) (*SessionWorker, error) {
 	info, err := spawnerHelpers.RequestWorkerStartup(s.SpawnerAddress, s.BaseFolder)
 	if err != nil {
-		return fmt.Errorf("error starting worker: %v", err)
+		return nil, fmt.Errorf("error starting worker: %v", err)
 	}
 
 	slog.Info("Worker started", "workerId", info.WorkerId, "fileId", payload.FileId, "address", info.Address, "port", info.Port)
-	addr := fmt.Sprintf("ws://%s:%d", info.Address, info.Port)
-	workerConn, _, err := websocket.DefaultDialer.DialContext(s.Context, addr, nil)
+	workerConn, err := dialWorker(s.Context, info)
 	if err != nil {
-		return fmt.Errorf("could not connect to worker at %s: %w", addr, err)
+		if shutdownErr := spawnerHelpers.RequestWorkerShutdown(info.WorkerId, s.SpawnerAddress); shutdownErr != nil {
+			slog.Error("Error shutting down unreachable worker", "workerId", info.WorkerId, "error", shutdownErr)
+		}
+		return nil, err
 	}
 
+	s.mu.Lock()
+	registration := s.registration
+	clientIcdVersion := s.clientIcdVersion
+	s.mu.Unlock()
+
 	fileWorker := &SessionWorker{
-		requestId:      requestId,
-		fileRequest:    &payload,
-		conn:           workerConn,
-		clientSendChan: s.clientSendChan,
+		info:             info,
+		requestId:        requestId,
+		fileRequest:      payload,
+		conn:             workerConn,
+		clientQueue:      s.clientQueue,
+		recorder:         s.recorder,
+		tileCache:        s.tileCache,
+		clientIcdVersion: clientIcdVersion,
+		onDisconnect:     s.handleWorkerLost,
+		fanOut:           s.fanOut,
+		state:            newReplayState(),
 	}
-	fileWorker.handleInit()
-
-	if s.fileMap == nil {
-		s.fileMap = make(map[int32]*SessionWorker)
+	// The worker needs to be registered with the client's viewer session before it can open the file
+	if _, err := fileWorker.register(s.Context, registration, requestId); err != nil {
+		if shutdownErr := spawnerHelpers.RequestWorkerShutdown(info.WorkerId, s.SpawnerAddress); shutdownErr != nil {
+			slog.Error("Error shutting down unregistered worker", "workerId", info.WorkerId, "error", shutdownErr)
+		}
+		return nil, err
 	}
-
-	s.fileMap[payload.FileId] = fileWorker
-
-	// We  need to first pass through a register viewer message, and then wait for the ack before sending through the open file message
-	// File opening is handled by workerMessageHandler
-	return fileWorker.proxyMessageToWorker(&payload, cartaDefinitions.EventType_REGISTER_VIEWER, requestId)
+	fileWorker.handleInit()
+	return fileWorker, nil
 }
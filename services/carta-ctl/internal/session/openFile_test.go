@@ -0,0 +1,35 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/mockworker"
+)
+
+func TestUnreachableWorkersAreShutDown(t *testing.T) {
+	base := imageFolder(t)
+	spawner := newTestSpawner(t, mockworker.Options{BaseFolder: base})
+	spawner.makeUnreachable(1)
+	spawner.makeUnreachable(3)
+	server := newTestServer(t, spawner, base)
+	client := dialTestClient(t, server.url)
+
+	client.send(cartaDefinitions.EventType_REGISTER_VIEWER, 1, &cartaDefinitions.RegisterViewer{})
+	waitFor(t, "the unreachable shared worker to be shut down", func() bool { return spawner.stopped(1) })
+	s := server.session(t, 1)
+	s.mu.Lock()
+	info := s.Info
+	s.mu.Unlock()
+	if info.WorkerId != "" {
+		t.Errorf("session took on worker %s that it couldn't connect to", info.WorkerId)
+	}
+
+	// The second attempt succeeds, but the file's worker can't be reached either
+	client.register()
+	client.send(cartaDefinitions.EventType_OPEN_FILE, 2, &cartaDefinitions.OpenFile{Directory: basePlaceholder, File: "m51.fits", FileId: 0})
+	waitFor(t, "the unreachable file worker to be shut down", func() bool { return spawner.stopped(3) })
+	if spawner.stopped(2) {
+		t.Error("shared worker was shut down")
+	}
+}
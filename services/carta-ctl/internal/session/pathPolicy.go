@@ -0,0 +1,223 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+)
+
+// Workers are started without a top level folder, so they resolve relative paths in requests against the filesystem
+// root. The frontend also uses the $BASE placeholder to refer to the worker's base folder.
+const (
+	workerTopLevelFolder = "/"
+	basePlaceholder      = "$BASE"
+)
+
+// pathPolicy restricts the paths that a session may access to its allowed roots, and optionally restricts writes to
+// an output directory. Paths are checked after resolving symlinks, so links inside a root can't be used to escape it.
+type pathPolicy struct {
+	baseFolder string
+	roots      []string
+	outputDir  string
+}
+
+func (s *Session) pathPolicy() pathPolicy {
+	p := pathPolicy{baseFolder: s.BaseFolder}
+	if s.BaseFolder != "" {
+		p.roots = append(p.roots, s.BaseFolder)
+	}
+	p.roots = append(p.roots, settings.AllowedRoots...)
+	if settings.OutputDir != "" {
+		p.outputDir = settings.OutputDir
+		if !filepath.IsAbs(p.outputDir) {
+			p.outputDir = filepath.Join(s.BaseFolder, p.outputDir)
+		}
+	}
+	return p
+}
+
+// resolve converts a directory and file from a request to a clean absolute path, as the worker would see it
+func (p pathPolicy) resolve(directory, file string) string {
+	if rest, ok := strings.CutPrefix(directory, basePlaceholder); ok {
+		directory = filepath.Join(p.baseFolder, rest)
+	}
+	path := filepath.Join(directory, file)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workerTopLevelFolder, path)
+	}
+	return filepath.Clean(path)
+}
+
+// check returns an error if the path is outside the allowed roots or, for writes, outside the output directory. A
+// session without a base folder or allowed roots may access any path, which is warned about at startup.
+func (p pathPolicy) check(directory, file string, write bool) error {
+	if len(p.roots) == 0 && p.outputDir == "" {
+		return nil
+	}
+
+	requested := filepath.Join(directory, file)
+	path, err := evalSymlinks(p.resolve(directory, file))
+	if err != nil {
+		return fmt.Errorf("could not resolve %s: %w", requested, err)
+	}
+
+	if len(p.roots) > 0 && !withinAny(path, p.roots) {
+		return fmt.Errorf("access to %s is not permitted", requested)
+	}
+	if write && p.outputDir != "" && !withinAny(path, []string{p.outputDir}) {
+		return fmt.Errorf("writing to %s is not permitted, files can only be saved to %s", requested, p.outputDir)
+	}
+	return nil
+}
+
+// withinAny reports whether the path is one of the roots or inside one of them
+func withinAny(path string, roots []string) bool {
+	for _, root := range roots {
+		resolvedRoot, err := evalSymlinks(filepath.Clean(root))
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(resolvedRoot, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// evalSymlinks resolves symlinks in the longest existing prefix of an absolute path. Files that are about to be
+// created, or that only exist on a worker's host, can't be resolved themselves, but a symlinked parent directory
+// would still be followed by the worker.
+func evalSymlinks(path string) (string, error) {
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, missing[i])
+			}
+			return resolved, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		missing = append(missing, filepath.Base(path))
+		path = parent
+	}
+}
+
+// malformedPathRequest rejects messages that can't be checked, rather than letting the worker interpret them
+func malformedPathRequest(eventType cartaDefinitions.EventType, err error) (proto.Message, cartaDefinitions.EventType, error) {
+	err = fmt.Errorf("malformed %s message: %w", eventType, err)
+	return &cartaDefinitions.ErrorData{
+		Severity: cartaDefinitions.ErrorSeverity_ERROR,
+		Tags:     []string{"path"},
+		Message:  err.Error(),
+	}, cartaDefinitions.EventType_ERROR_DATA, err
+}
+
+// checkPathPolicy checks the paths in messages that list, read or write files against the session's path policy. If a
+// message violates the policy, the returned response should be sent to the client instead of handling the message.
+func (s *Session) checkPathPolicy(eventType cartaDefinitions.EventType, body []byte) (proto.Message, cartaDefinitions.EventType, error) {
+	policy := s.pathPolicy()
+
+	switch eventType {
+	case cartaDefinitions.EventType_OPEN_FILE:
+		var payload cartaDefinitions.OpenFile
+		if err := proto.Unmarshal(body, &payload); err != nil {
+			return malformedPathRequest(eventType, err)
+		}
+		if err := policy.check(payload.Directory, payload.File, false); err != nil {
+			return &cartaDefinitions.OpenFileAck{FileId: payload.FileId, Success: false, Message: err.Error()}, cartaDefinitions.EventType_OPEN_FILE_ACK, err
+		}
+	case cartaDefinitions.EventType_SAVE_FILE:
+		var payload cartaDefinitions.SaveFile
+		if err := proto.Unmarshal(body, &payload); err != nil {
+			return malformedPathRequest(eventType, err)
+		}
+		if err := policy.check(payload.OutputFileDirectory, payload.OutputFileName, true); err != nil {
+			return &cartaDefinitions.SaveFileAck{FileId: payload.FileId, Success: false, Message: err.Error()}, cartaDefinitions.EventType_SAVE_FILE_ACK, err
+		}
+	case cartaDefinitions.EventType_IMPORT_REGION:
+		var payload cartaDefinitions.ImportRegion
+		if err := proto.Unmarshal(body, &payload); err != nil {
+			return malformedPathRequest(eventType, err)
+		}
+		// Regions can also be imported from contents sent by the frontend, which don't touch the filesystem
+		if payload.File == "" {
+			return nil, 0, nil
+		}
+		if err := policy.check(payload.Directory, payload.File, false); err != nil {
+			return &cartaDefinitions.ImportRegionAck{Success: false, Message: err.Error()}, cartaDefinitions.EventType_IMPORT_REGION_ACK, err
+		}
+	case cartaDefinitions.EventType_EXPORT_REGION:
+		var payload cartaDefinitions.ExportRegion
+		if err := proto.Unmarshal(body, &payload); err != nil {
+			return malformedPathRequest(eventType, err)
+		}
+		// Without a file, the exported contents are returned to the frontend instead of being written
+		if payload.File == "" {
+			return nil, 0, nil
+		}
+		if err := policy.check(payload.Directory, payload.File, true); err != nil {
+			return &cartaDefinitions.ExportRegionAck{Success: false, Message: err.Error()}, cartaDefinitions.EventType_EXPORT_REGION_ACK, err
+		}
+	case cartaDefinitions.EventType_CONCAT_STOKES_FILES:
+		var payload cartaDefinitions.ConcatStokesFiles
+		if err := proto.Unmarshal(body, &payload); err != nil {
+			return malformedPathRequest(eventType, err)
+		}
+		for _, stokesFile := range payload.StokesFiles {
+			if err := policy.check(stokesFile.Directory, stokesFile.File, false); err != nil {
+				return &cartaDefinitions.ConcatStokesFilesAck{Success: false, Message: err.Error()}, cartaDefinitions.EventType_CONCAT_STOKES_FILES_ACK, err
+			}
+		}
+	case cartaDefinitions.EventType_FILE_LIST_REQUEST, cartaDefinitions.EventType_REGION_LIST_REQUEST, cartaDefinitions.EventType_CATALOG_LIST_REQUEST,
+		cartaDefinitions.EventType_FILE_INFO_REQUEST, cartaDefinitions.EventType_REGION_FILE_INFO_REQUEST, cartaDefinitions.EventType_CATALOG_FILE_INFO_REQUEST:
+		// Listings and file information reveal what is on the filesystem, so they are restricted like reads
+		payload, err := cartaHelpers.UnmarshalMessage(eventType, body)
+		if err != nil {
+			return malformedPathRequest(eventType, err)
+		}
+		directory, file := requestedPath(payload)
+		if err := policy.check(directory, file, false); err != nil {
+			response, responseType := failureResponse(eventType, err.Error())
+			return response, responseType, err
+		}
+	case cartaDefinitions.EventType_OPEN_CATALOG_FILE:
+		var payload cartaDefinitions.OpenCatalogFile
+		if err := proto.Unmarshal(body, &payload); err != nil {
+			return malformedPathRequest(eventType, err)
+		}
+		if err := policy.check(payload.Directory, payload.Name, false); err != nil {
+			return &cartaDefinitions.OpenCatalogFileAck{FileId: payload.FileId, Success: false, Message: err.Error()}, cartaDefinitions.EventType_OPEN_CATALOG_FILE_ACK, err
+		}
+	}
+	return nil, 0, nil
+}
+
+// requestedPath returns the directory and file of a listing or file information request. Listings have no file, and
+// catalog requests name the file as name.
+func requestedPath(msg proto.Message) (directory string, file string) {
+	if m, ok := msg.(interface{ GetDirectory() string }); ok {
+		directory = m.GetDirectory()
+	}
+	switch m := msg.(type) {
+	case interface{ GetFile() string }:
+		file = m.GetFile()
+	case interface{ GetName() string }:
+		file = m.GetName()
+	}
+	return directory, file
+}
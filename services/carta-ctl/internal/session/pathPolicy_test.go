@@ -0,0 +1,146 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+)
+
+// policyTree creates a base folder with an image, an output directory, and symlinks that lead out of the base folder
+// into a secret directory next to it
+func policyTree(t *testing.T) (base string, secret string) {
+	t.Helper()
+	dir := t.TempDir()
+	base = filepath.Join(dir, "base")
+	secret = filepath.Join(dir, "secret")
+	for _, d := range []string{filepath.Join(base, "images"), filepath.Join(base, "output"), secret} {
+		if err := os.MkdirAll(d, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(base, "images", "m51.fits"), filepath.Join(secret, "private.fits")} {
+		if err := os.WriteFile(f, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(base, "images", "escape"):      secret,
+		filepath.Join(base, "images", "leak.fits"):   filepath.Join(secret, "private.fits"),
+		filepath.Join(base, "images", "inside.fits"): filepath.Join(base, "images", "m51.fits"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return base, secret
+}
+
+func TestPathPolicyCheck(t *testing.T) {
+	base, secret := policyTree(t)
+	policy := pathPolicy{baseFolder: base, roots: []string{base}, outputDir: filepath.Join(base, "output")}
+
+	tests := []struct {
+		name      string
+		directory string
+		file      string
+		write     bool
+		allowed   bool
+	}{
+		{"File", "$BASE/images", "m51.fits", false, true},
+		{"AbsoluteFile", filepath.Join(base, "images"), "m51.fits", false, true},
+		{"BaseFolder", "$BASE", "", false, true},
+		{"SymlinkInsideRoot", "$BASE/images", "inside.fits", false, true},
+		{"NewFileInOutput", "$BASE/output", "new.fits", true, true},
+		{"Traversal", "$BASE/images/../..", "secret/private.fits", false, false},
+		{"TraversalInFile", "$BASE/images", "../../secret/private.fits", false, false},
+		{"ParentOfBase", "$BASE/..", "", false, false},
+		{"AbsoluteOutside", secret, "private.fits", false, false},
+		{"RelativeToWorkerRoot", filepath.Dir(base)[1:], "secret/private.fits", false, false},
+		{"SymlinkedFile", "$BASE/images", "leak.fits", false, false},
+		{"SymlinkedDirectory", "$BASE/images/escape", "private.fits", false, false},
+		{"NewFileInSymlinkedDirectory", "$BASE/images/escape", "new.fits", true, false},
+		{"WriteOutsideOutput", "$BASE/images", "new.fits", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.check(tt.directory, tt.file, tt.write)
+			if tt.allowed && err != nil {
+				t.Errorf("check(%q, %q) rejected an allowed path: %v", tt.directory, tt.file, err)
+			}
+			if !tt.allowed && err == nil {
+				t.Errorf("check(%q, %q) allowed a path outside the policy", tt.directory, tt.file)
+			}
+		})
+	}
+}
+
+func TestCheckPathPolicyMessages(t *testing.T) {
+	base, secret := policyTree(t)
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.AllowedRoots = nil
+	settings.OutputDir = ""
+	s := &Session{BaseFolder: base}
+
+	tests := []struct {
+		name         string
+		eventType    cartaDefinitions.EventType
+		msg          proto.Message
+		responseType cartaDefinitions.EventType
+	}{
+		{"OpenFile", cartaDefinitions.EventType_OPEN_FILE, &cartaDefinitions.OpenFile{Directory: secret, File: "private.fits"}, cartaDefinitions.EventType_OPEN_FILE_ACK},
+		{"ConcatStokesFiles", cartaDefinitions.EventType_CONCAT_STOKES_FILES, &cartaDefinitions.ConcatStokesFiles{StokesFiles: []*cartaDefinitions.StokesFile{
+			{Directory: "$BASE/images", File: "m51.fits"},
+			{Directory: "$BASE/images", File: "leak.fits"},
+		}}, cartaDefinitions.EventType_CONCAT_STOKES_FILES_ACK},
+		{"FileList", cartaDefinitions.EventType_FILE_LIST_REQUEST, &cartaDefinitions.FileListRequest{Directory: "$BASE/.."}, cartaDefinitions.EventType_FILE_LIST_RESPONSE},
+		{"FileInfo", cartaDefinitions.EventType_FILE_INFO_REQUEST, &cartaDefinitions.FileInfoRequest{Directory: "$BASE/images/escape", File: "private.fits"}, cartaDefinitions.EventType_FILE_INFO_RESPONSE},
+		{"RegionList", cartaDefinitions.EventType_REGION_LIST_REQUEST, &cartaDefinitions.RegionListRequest{Directory: secret}, cartaDefinitions.EventType_REGION_LIST_RESPONSE},
+		{"RegionFileInfo", cartaDefinitions.EventType_REGION_FILE_INFO_REQUEST, &cartaDefinitions.RegionFileInfoRequest{Directory: secret, File: "private.fits"}, cartaDefinitions.EventType_REGION_FILE_INFO_RESPONSE},
+		{"CatalogList", cartaDefinitions.EventType_CATALOG_LIST_REQUEST, &cartaDefinitions.CatalogListRequest{Directory: "$BASE/images/escape"}, cartaDefinitions.EventType_CATALOG_LIST_RESPONSE},
+		{"CatalogFileInfo", cartaDefinitions.EventType_CATALOG_FILE_INFO_REQUEST, &cartaDefinitions.CatalogFileInfoRequest{Directory: "$BASE/images", Name: "../../secret/private.fits"}, cartaDefinitions.EventType_CATALOG_FILE_INFO_RESPONSE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := proto.Marshal(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, responseType, err := s.checkPathPolicy(tt.eventType, body)
+			if err == nil {
+				t.Fatalf("%s outside the base folder was not rejected", tt.eventType)
+			}
+			if responseType != tt.responseType || response == nil {
+				t.Errorf("rejected %s with %s, want %s", tt.eventType, responseType, tt.responseType)
+			}
+		})
+	}
+
+	// The same requests within the base folder are let through
+	allowed := []struct {
+		eventType cartaDefinitions.EventType
+		msg       proto.Message
+	}{
+		{cartaDefinitions.EventType_FILE_LIST_REQUEST, &cartaDefinitions.FileListRequest{Directory: "$BASE"}},
+		{cartaDefinitions.EventType_FILE_INFO_REQUEST, &cartaDefinitions.FileInfoRequest{Directory: "$BASE/images", File: "m51.fits"}},
+		{cartaDefinitions.EventType_CATALOG_LIST_REQUEST, &cartaDefinitions.CatalogListRequest{Directory: base}},
+		{cartaDefinitions.EventType_CONCAT_STOKES_FILES, &cartaDefinitions.ConcatStokesFiles{StokesFiles: []*cartaDefinitions.StokesFile{
+			{Directory: "$BASE/images", File: "m51.fits"},
+			{Directory: "$BASE/images", File: "inside.fits"},
+		}}},
+	}
+	for _, a := range allowed {
+		body, err := proto.Marshal(a.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.checkPathPolicy(a.eventType, body); err != nil {
+			t.Errorf("%s within the base folder was rejected: %v", a.eventType, err)
+		}
+	}
+}
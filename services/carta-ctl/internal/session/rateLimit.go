@@ -0,0 +1,224 @@
+package session
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/pkg/config"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
+)
+
+var (
+	throttledMessages = metrics.NewCounterVec("carta_messages_throttled_total", "Number of client messages held back to stay within rate limits", "event_type")
+	rejectedMessages  = metrics.NewCounterVec("carta_messages_rejected_total", "Number of client messages rejected for exceeding rate or size limits", "event_type", "reason")
+	abusiveSessions   = metrics.NewCounterVec("carta_sessions_rate_limited_total", "Number of sessions closed for repeatedly exceeding rate or size limits")
+)
+
+// Reasons for rejecting a message, used in logs and metrics
+const (
+	reasonSessionRate = "session_rate"
+	reasonEventRate   = "event_rate"
+	reasonFrameSize   = "frame_size"
+)
+
+// eventRateLimits holds the limits for individual event types. It is set once at startup by Configure
+var eventRateLimits map[cartaDefinitions.EventType]config.EventRateLimit
+
+func compileEventRateLimits(cfg []config.EventRateLimit) (map[cartaDefinitions.EventType]config.EventRateLimit, error) {
+	limits := make(map[cartaDefinitions.EventType]config.EventRateLimit, len(cfg))
+	for i, c := range cfg {
+		eventTypes, err := parseEventTypes([]string{c.EventType})
+		if err != nil {
+			return nil, fmt.Errorf("rate limit %d: %w", i, err)
+		}
+		if c.Rate <= 0 {
+			return nil, fmt.Errorf("rate limit %d: rate must be positive, got %v", i, c.Rate)
+		}
+		limits[eventTypes[0]] = c
+	}
+	return limits, nil
+}
+
+// tokenBucket allows rate events per second on average, and up to burst at once
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// wait returns how long until a token is available
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take uses a token. The bucket goes into debt if the token is taken before it is available, which the caller pays
+// off by waiting
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// rateLimiter enforces the configured limits on the messages from one client connection
+type rateLimiter struct {
+	mu      sync.Mutex
+	session *tokenBucket
+	events  map[cartaDefinitions.EventType]*tokenBucket
+	// violations counts the messages rejected since windowStart
+	violations  int
+	windowStart time.Time
+	// releasedUntil is when the latest admitted message is released. Later messages are never released before it, so
+	// that holding back one message doesn't let the ones after it overtake it
+	releasedUntil time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{events: make(map[cartaDefinitions.EventType]*tokenBucket)}
+	if settings.RateLimit.Rate > 0 {
+		l.session = newTokenBucket(settings.RateLimit.Rate, settings.RateLimit.Burst)
+	}
+	return l
+}
+
+// reserve takes a token from each bucket that applies to the message, and returns how long to hold the message back
+// for. If that would take longer than the allowed delay, no tokens are taken and the reason for rejecting the message
+// is returned instead. Messages are held back at least as long as the one before them, so that they keep their order,
+// for example a SET_REGION that follows a throttled SET_SPECTRAL_REQUIREMENTS.
+func (l *rateLimiter) reserve(eventType cartaDefinitions.EventType, now time.Time) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	eventBucket, ok := l.events[eventType]
+	if !ok {
+		if limit, ok := eventRateLimits[eventType]; ok {
+			eventBucket = newTokenBucket(limit.Rate, limit.Burst)
+			l.events[eventType] = eventBucket
+		}
+	}
+
+	var delay time.Duration
+	if l.session != nil {
+		delay = l.session.wait(now)
+		if delay > settings.RateLimit.MaxDelay {
+			return 0, reasonSessionRate
+		}
+	}
+	if eventBucket != nil {
+		eventDelay := eventBucket.wait(now)
+		if eventDelay > settings.RateLimit.MaxDelay {
+			return 0, reasonEventRate
+		}
+		delay = max(delay, eventDelay)
+		eventBucket.take()
+	}
+	if l.session != nil {
+		l.session.take()
+	}
+
+	release := now.Add(delay)
+	if release.Before(l.releasedUntil) {
+		release = l.releasedUntil
+	}
+	l.releasedUntil = release
+	return release.Sub(now), ""
+}
+
+// violation records a rejected message, and reports whether the session has now exceeded its limits often enough to
+// be closed, and whether this is the first violation in the current window
+func (l *rateLimiter) violation() (abusive bool, first bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.windowStart) > settings.RateLimit.ViolationWindow {
+		l.windowStart = now
+		l.violations = 0
+	}
+	l.violations++
+	abusive = settings.RateLimit.MaxViolations > 0 && l.violations == settings.RateLimit.MaxViolations
+	return abusive, l.violations == 1
+}
+
+// admitMessage applies the rate and size limits to a message from the client. Messages over a rate limit are held
+// back for up to the configured delay. If that is not enough, or the message is too large, it is rejected: requests
+// are answered with a failure response and other messages are dropped. It reports whether the message should be
+// handled.
+func (s *Session) admitMessage(prefix cartaHelpers.MessagePrefix, size int) bool {
+	if s.limiter == nil {
+		return true
+	}
+	if settings.RateLimit.MaxFrameSize > 0 && size > settings.RateLimit.MaxFrameSize {
+		s.rejectMessage(prefix, size, reasonFrameSize)
+		return false
+	}
+
+	delay, reason := s.limiter.reserve(prefix.EventType, time.Now())
+	if reason != "" {
+		s.rejectMessage(prefix, size, reason)
+		return false
+	}
+	if delay > 0 {
+		// Each message is handled in its own goroutine, so waiting here doesn't hold up reading from the client.
+		// The bucket's debt is what limits how far ahead of the rate the client can get, and reserve holds back the
+		// messages behind this one at least as long, so that they don't overtake it
+		throttledMessages.WithLabelValues(prefix.EventType.String()).Inc()
+		select {
+		case <-time.After(delay):
+		case <-s.Context.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Session) rejectMessage(prefix cartaHelpers.MessagePrefix, size int, reason string) {
+	rejectedMessages.WithLabelValues(prefix.EventType.String(), reason).Inc()
+	abusive, first := s.limiter.violation()
+	// Only the first rejection in each window is logged as a warning, so that a flood doesn't flood the logs too
+	logLevel := slog.LevelDebug
+	if first {
+		logLevel = slog.LevelWarn
+	}
+	slog.Log(s.Context, logLevel, "Rejected message over limit", "sessionId", s.ID, "user", s.User, "eventType", prefix.EventType, "size", size, "reason", reason)
+
+	// Streamed messages such as cursor updates have no response, and a notice for each of them would only add to the
+	// flood
+	if len(responseEventTypes(prefix.EventType)) > 0 {
+		response, responseType := failureResponse(prefix.EventType, fmt.Sprintf("%s rejected: message limit exceeded", prefix.EventType))
+		if reply, err := s.prepareClientMessage(response, responseType, prefix.RequestId); err == nil {
+			if err := s.sendToClient(reply); err != nil {
+				slog.Debug("Failed to send rejection", "sessionId", s.ID, "error", err)
+			}
+		}
+	}
+
+	if !abusive {
+		return
+	}
+	abusiveSessions.WithLabelValues().Inc()
+	slog.Warn("Closing session that keeps exceeding message limits", "sessionId", s.ID, "user", s.User, "violations", settings.RateLimit.MaxViolations, "window", settings.RateLimit.ViolationWindow)
+	err := s.SendNotice(cartaDefinitions.ErrorSeverity_CRITICAL, []string{"rate_limit"}, "The session was closed because the frontend sent too many messages")
+	if err != nil {
+		slog.Warn("Failed to notify client of rate limiting", "sessionId", s.ID, "error", err)
+	}
+	if err := s.Terminate("message limits exceeded"); err != nil {
+		slog.Error("Failed to terminate rate limited session", "sessionId", s.ID, "error", err)
+	}
+}
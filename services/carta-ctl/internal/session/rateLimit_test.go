@@ -0,0 +1,142 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/config"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(10, 5)
+	for i := 0; i < 5; i++ {
+		if delay := b.wait(start); delay != 0 {
+			t.Fatalf("message %d of the burst delayed by %v", i+1, delay)
+		}
+		b.take()
+	}
+	if delay := b.wait(start); delay != 100*time.Millisecond {
+		t.Errorf("delay after the burst = %v, want 100ms", delay)
+	}
+	if delay := b.wait(start.Add(50 * time.Millisecond)); delay != 50*time.Millisecond {
+		t.Errorf("delay after half a token has been refilled = %v, want 50ms", delay)
+	}
+
+	// An idle bucket refills up to its burst, and no further
+	later := start.Add(time.Minute)
+	for i := 0; i < 5; i++ {
+		if delay := b.wait(later); delay != 0 {
+			t.Fatalf("message %d of the refilled burst delayed by %v", i+1, delay)
+		}
+		b.take()
+	}
+	if delay := b.wait(later); delay == 0 {
+		t.Error("bucket refilled beyond its burst")
+	}
+}
+
+func TestTokenBucketDefaultBurst(t *testing.T) {
+	if b := newTokenBucket(2.5, 0); b.burst != 3 {
+		t.Errorf("burst = %v, want the rate rounded up to 3", b.burst)
+	}
+}
+
+func TestTokenBucketDebt(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(10, 1)
+	b.wait(start)
+	b.take()
+	// Taking a token that isn't available yet puts the bucket into debt, which later messages wait for too
+	b.take()
+	if delay := b.wait(start); delay != 200*time.Millisecond {
+		t.Errorf("delay with one token owed = %v, want 200ms", delay)
+	}
+	if delay := b.wait(start.Add(200 * time.Millisecond)); delay != 0 {
+		t.Errorf("delay once the debt is paid off = %v, want 0", delay)
+	}
+}
+
+// withRateLimits replaces the rate limit settings for the duration of a test
+func withRateLimits(t *testing.T, cfg config.RateLimitConfig, events map[cartaDefinitions.EventType]config.EventRateLimit) {
+	t.Helper()
+	savedSettings, savedEvents := settings, eventRateLimits
+	t.Cleanup(func() { settings, eventRateLimits = savedSettings, savedEvents })
+	settings.RateLimit = cfg
+	eventRateLimits = events
+}
+
+func TestReserveMaxDelay(t *testing.T) {
+	withRateLimits(t, config.RateLimitConfig{Rate: 10, Burst: 1, MaxDelay: 250 * time.Millisecond}, nil)
+	l := newRateLimiter()
+	start := time.Now()
+
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		delay, reason := l.reserve(cartaDefinitions.EventType_SET_CURSOR, start)
+		if reason != "" || delay != want {
+			t.Fatalf("message %d: delay %v, reason %q, want %v", i+1, delay, reason, want)
+		}
+	}
+	if _, reason := l.reserve(cartaDefinitions.EventType_SET_CURSOR, start); reason != reasonSessionRate {
+		t.Fatalf("message needing a 300ms delay: reason %q, want %q", reason, reasonSessionRate)
+	}
+
+	// A rejected message doesn't use up a token
+	delay, reason := l.reserve(cartaDefinitions.EventType_SET_CURSOR, start.Add(100*time.Millisecond))
+	if reason != "" || delay != 200*time.Millisecond {
+		t.Errorf("message after a rejection: delay %v, reason %q, want 200ms", delay, reason)
+	}
+}
+
+func TestReserveEventRate(t *testing.T) {
+	withRateLimits(t, config.RateLimitConfig{MaxDelay: 250 * time.Millisecond}, map[cartaDefinitions.EventType]config.EventRateLimit{
+		cartaDefinitions.EventType_SET_SPECTRAL_REQUIREMENTS: {EventType: "SET_SPECTRAL_REQUIREMENTS", Rate: 1, Burst: 1},
+	})
+	l := newRateLimiter()
+	start := time.Now()
+
+	if _, reason := l.reserve(cartaDefinitions.EventType_SET_SPECTRAL_REQUIREMENTS, start); reason != "" {
+		t.Fatalf("first message rejected: %q", reason)
+	}
+	if _, reason := l.reserve(cartaDefinitions.EventType_SET_SPECTRAL_REQUIREMENTS, start); reason != reasonEventRate {
+		t.Errorf("second message within a second: reason %q, want %q", reason, reasonEventRate)
+	}
+	if delay, reason := l.reserve(cartaDefinitions.EventType_SET_CURSOR, start); reason != "" || delay != 0 {
+		t.Errorf("message of another type: delay %v, reason %q, want neither", delay, reason)
+	}
+}
+
+func TestReserveKeepsOrder(t *testing.T) {
+	withRateLimits(t, config.RateLimitConfig{MaxDelay: time.Second}, map[cartaDefinitions.EventType]config.EventRateLimit{
+		cartaDefinitions.EventType_SET_SPECTRAL_REQUIREMENTS: {EventType: "SET_SPECTRAL_REQUIREMENTS", Rate: 10, Burst: 1},
+	})
+	l := newRateLimiter()
+	start := time.Now()
+
+	l.reserve(cartaDefinitions.EventType_SET_SPECTRAL_REQUIREMENTS, start)
+	throttled, _ := l.reserve(cartaDefinitions.EventType_SET_SPECTRAL_REQUIREMENTS, start)
+	if throttled != 100*time.Millisecond {
+		t.Fatalf("throttled message delayed by %v, want 100ms", throttled)
+	}
+	// A SET_REGION sent after the throttled message isn't limited itself, but must not overtake it
+	delay, _ := l.reserve(cartaDefinitions.EventType_SET_REGION, start.Add(10*time.Millisecond))
+	if delay != 90*time.Millisecond {
+		t.Errorf("following message delayed by %v, want 90ms", delay)
+	}
+	if delay, _ := l.reserve(cartaDefinitions.EventType_SET_REGION, start.Add(time.Second)); delay != 0 {
+		t.Errorf("message after the throttled one was released delayed by %v, want 0", delay)
+	}
+}
+
+func TestViolations(t *testing.T) {
+	withRateLimits(t, config.RateLimitConfig{MaxViolations: 3, ViolationWindow: time.Minute}, nil)
+	l := newRateLimiter()
+
+	for i, want := range []struct{ abusive, first bool }{{false, true}, {false, false}, {true, false}, {false, false}} {
+		abusive, first := l.violation()
+		if abusive != want.abusive || first != want.first {
+			t.Errorf("violation %d: abusive %v, first %v, want %v, %v", i+1, abusive, first, want.abusive, want.first)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/CARTAvis/go-carta/pkg/capture"
+	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+)
+
+// recorder writes all traffic of a session to a capture file, for debugging protocol problems. A nil recorder is
+// valid and records nothing, so call sites don't need to check whether recording is enabled.
+type recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *capture.Writer
+}
+
+// newRecorder creates a capture file for the session in the configured capture directory, or returns nil if
+// recording is disabled
+func newRecorder(sessionId string) *recorder {
+	if settings.CaptureDir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(settings.CaptureDir, 0o750); err != nil {
+		slog.Error("Failed to create capture directory", "dir", settings.CaptureDir, "error", err)
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%s.cartacap", time.Now().UTC().Format("20060102T150405Z"), sessionId)
+	path := filepath.Join(settings.CaptureDir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o640)
+	if err != nil {
+		slog.Error("Failed to create capture file", "path", path, "error", err)
+		return nil
+	}
+
+	w, err := capture.NewWriter(f)
+	if err != nil {
+		slog.Error("Failed to write capture header", "path", path, "error", err)
+		helpers.CloseOrLog(f)
+		return nil
+	}
+
+	slog.Info("Recording session traffic", "sessionId", sessionId, "path", path)
+	return &recorder{file: f, w: w}
+}
+
+func (r *recorder) record(direction capture.Direction, workerName string, msg []byte) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	err := r.w.Write(capture.Record{
+		Time:       time.Now(),
+		Direction:  direction,
+		WorkerName: workerName,
+		Message:    msg,
+	})
+	// Flush every record, so that the capture is complete up to the last message if the controller crashes or is
+	// killed, which is when it is most needed
+	if err == nil {
+		err = r.w.Flush()
+	}
+	if err != nil {
+		slog.Error("Failed to record message, stopping recording", "path", r.file.Name(), "error", err)
+		r.w = nil
+	}
+}
+
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w != nil {
+		if err := r.w.Flush(); err != nil {
+			slog.Error("Failed to flush capture file", "path", r.file.Name(), "error", err)
+		}
+		r.w = nil
+	}
+	helpers.CloseOrLog(r.file)
+}
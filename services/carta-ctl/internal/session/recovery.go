@@ -0,0 +1,414 @@
+package session
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
+)
+
+// replayedEvents lists the messages that establish state in a worker, and are replayed into a replacement worker
+// after a crash. Only the latest message for each file and region is kept, so that the replacement renders the tiles
+// currently in view. The viewer registration is replayed separately, as every worker is registered before it receives
+// any other message.
+var replayedEvents = map[cartaDefinitions.EventType]bool{
+	cartaDefinitions.EventType_OPEN_FILE:                     true,
+	cartaDefinitions.EventType_SET_IMAGE_CHANNELS:            true,
+	cartaDefinitions.EventType_ADD_REQUIRED_TILES:            true,
+	cartaDefinitions.EventType_SET_CURSOR:                    true,
+	cartaDefinitions.EventType_SET_REGION:                    true,
+	cartaDefinitions.EventType_SET_SPATIAL_REQUIREMENTS:      true,
+	cartaDefinitions.EventType_SET_SPECTRAL_REQUIREMENTS:     true,
+	cartaDefinitions.EventType_SET_STATS_REQUIREMENTS:        true,
+	cartaDefinitions.EventType_SET_HISTOGRAM_REQUIREMENTS:    true,
+	cartaDefinitions.EventType_SET_CONTOUR_PARAMETERS:        true,
+	cartaDefinitions.EventType_SET_VECTOR_OVERLAY_PARAMETERS: true,
+}
+
+// replayEntry is a state-establishing message body, in the client's ICD version
+type replayEntry struct {
+	eventType cartaDefinitions.EventType
+	fileId    int32
+	regionId  int32
+	hasRegion bool
+	body      []byte
+}
+
+func (e *replayEntry) sameTarget(other *replayEntry) bool {
+	return e.eventType == other.eventType && e.fileId == other.fileId && e.hasRegion == other.hasRegion && e.regionId == other.regionId
+}
+
+// replayState records the state-establishing messages proxied to a worker, in the order they were first sent
+type replayState struct {
+	mu      sync.Mutex
+	entries []*replayEntry
+	// pendingRegions holds new regions by request ID until the worker acknowledges them with the region's ID
+	pendingRegions map[uint32]*replayEntry
+}
+
+func newReplayState() *replayState {
+	return &replayState{pendingRegions: make(map[uint32]*replayEntry)}
+}
+
+func decodeEntry(eventType cartaDefinitions.EventType, body []byte) (*replayEntry, error) {
+	// State messages are keyed by the file and region they apply to, which are read without un-marshalling them, as
+	// some are sent at a high rate
+	e := &replayEntry{eventType: eventType, body: body}
+	fileId, hasFile := cartaHelpers.PeekFileId(eventType, body)
+	e.regionId, e.hasRegion = cartaHelpers.PeekRegionId(eventType, body)
+	if !hasFile && !e.hasRegion {
+		return nil, fmt.Errorf("could not read the file or region ID of %s", eventType)
+	}
+	if hasFile {
+		e.fileId = fileId
+	}
+	return e, nil
+}
+
+// record adds a message to the state, replacing the previous message of the same type for the same file and region.
+// Replaced messages keep their position, so that regions are always replayed before their requirements.
+func (r *replayState) record(e *replayEntry, requestId uint32) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// New regions are numbered by the worker, so they can only be recorded once the worker has acknowledged them
+	if e.eventType == cartaDefinitions.EventType_SET_REGION && e.regionId <= 0 {
+		r.pendingRegions[requestId] = e
+		return
+	}
+	for i, existing := range r.entries {
+		if existing.sameTarget(e) {
+			r.entries[i] = e
+			return
+		}
+	}
+	r.entries = append(r.entries, e)
+}
+
+// forget removes the messages that match, once the file or region they apply to has been closed
+func (r *replayState) forget(match func(*replayEntry) bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = slices.DeleteFunc(r.entries, match)
+}
+
+// observe watches the messages from the worker for acknowledgements of new regions, which carry the region's ID
+func (r *replayState) observe(eventType cartaDefinitions.EventType, requestId uint32, body []byte) {
+	if r == nil || eventType != cartaDefinitions.EventType_SET_REGION_ACK {
+		return
+	}
+	r.mu.Lock()
+	e, ok := r.pendingRegions[requestId]
+	delete(r.pendingRegions, requestId)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	var ack cartaDefinitions.SetRegionAck
+	if err := proto.Unmarshal(body, &ack); err != nil || !ack.Success {
+		return
+	}
+	var region cartaDefinitions.SetRegion
+	if err := proto.Unmarshal(e.body, &region); err != nil {
+		return
+	}
+	region.RegionId = ack.RegionId
+	body, err := proto.Marshal(&region)
+	if err != nil {
+		return
+	}
+	r.record(&replayEntry{eventType: e.eventType, fileId: e.fileId, regionId: ack.RegionId, hasRegion: true, body: body}, requestId)
+}
+
+func (r *replayState) snapshot() []*replayEntry {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.entries)
+}
+
+// workers returns all of the session's workers
+func (s *Session) workers() []*SessionWorker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	workers := make([]*SessionWorker, 0, len(s.fileMap)+1)
+	if s.sharedWorker != nil {
+		workers = append(workers, s.sharedWorker)
+	}
+	for _, w := range s.fileMap {
+		if !slices.Contains(workers, w) {
+			workers = append(workers, w)
+		}
+	}
+	return workers
+}
+
+// recordState keeps track of the state-establishing messages proxied to a worker, so that they can be replayed if
+// the worker crashes
+func (s *Session) recordState(sw *SessionWorker, eventType cartaDefinitions.EventType, requestId uint32, body []byte) {
+	if !replayedEvents[eventType] && eventType != cartaDefinitions.EventType_CLOSE_FILE && eventType != cartaDefinitions.EventType_REMOVE_REGION {
+		return
+	}
+	e, err := decodeEntry(eventType, body)
+	if err != nil {
+		slog.Debug("Not recording unparseable state message", "sessionId", s.ID, "eventType", eventType, "error", err)
+		return
+	}
+
+	// Files and regions may be closed through a different worker from the one that holds their state
+	switch eventType {
+	case cartaDefinitions.EventType_CLOSE_FILE:
+		for _, w := range s.workers() {
+			w.state.forget(func(other *replayEntry) bool {
+				return e.fileId == allFiles || other.fileId == e.fileId
+			})
+		}
+	case cartaDefinitions.EventType_REMOVE_REGION:
+		for _, w := range s.workers() {
+			w.state.forget(func(other *replayEntry) bool {
+				return other.hasRegion && other.regionId == e.regionId
+			})
+		}
+	default:
+		sw.state.record(e, requestId)
+	}
+}
+
+// failInFlightRequests answers the requests that a lost worker never answered, so that the client doesn't wait for
+// them. Files that were being opened are forgotten rather than replayed, as the client is told that they failed to
+// open, and the file may well be what crashed the worker.
+func (s *Session) failInFlightRequests(sw *SessionWorker) {
+	requests := sw.takeInFlight()
+	for _, requestId := range slices.Sorted(maps.Keys(requests)) {
+		r := requests[requestId]
+		if r.eventType == cartaDefinitions.EventType_OPEN_FILE {
+			sw.state.forget(func(e *replayEntry) bool {
+				return e.fileId == r.fileId
+			})
+			s.mu.Lock()
+			delete(s.fileMap, r.fileId)
+			delete(s.fileRequests, r.fileId)
+			delete(s.openImages, r.fileId)
+			s.mu.Unlock()
+		}
+
+		response, responseType := failureResponse(r.eventType, "The CARTA backend stopped before answering this request")
+		reply, err := s.prepareClientMessage(response, responseType, requestId)
+		if err == nil {
+			err = s.sendToClient(reply)
+		}
+		if err != nil {
+			slog.Warn("Failed to answer request to lost worker", "sessionId", s.ID, "eventType", r.eventType, "requestId", requestId, "error", err)
+		}
+	}
+}
+
+// holdsFiles reports whether any of the session's open files are in the worker
+func (s *Session) holdsFiles(sw *SessionWorker) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(slices.Collect(maps.Values(s.fileMap)), sw)
+}
+
+// recoverWorker replaces a crashed or restarted worker. It returns false if the worker couldn't be replaced, in which
+// case the caller handles the loss as if recovery was disabled.
+func (s *Session) recoverWorker(sw *SessionWorker, isShared bool, restart bool) bool {
+	sw.disconnect()
+	if sw.info.WorkerId != "" {
+		if err := spawnerHelpers.RequestWorkerShutdown(sw.info.WorkerId, s.SpawnerAddress); err != nil {
+			slog.Debug("Error shutting down crashed worker", "workerId", sw.info.WorkerId, "error", err)
+		}
+	}
+
+	what := s.describeWorker(sw)
+	notice := fmt.Sprintf("Connection to %s was lost, restarting it", what)
+	// Restarts asked for by the user don't count towards the replacements allowed for crashes
+	recoveries := sw.recoveries + 1
+	if restart {
+		notice = fmt.Sprintf("Restarting %s", what)
+		recoveries = sw.recoveries
+	}
+	if err := s.SendNotice(cartaDefinitions.ErrorSeverity_WARNING, []string{"worker"}, notice); err != nil {
+		slog.Warn("Failed to notify client of lost worker", "sessionId", s.ID, "error", err)
+	}
+
+	start := time.Now()
+	replacement, err := s.replaceWorker(sw, recoveries)
+
+	s.mu.Lock()
+	closed := s.closed
+	if err == nil && !closed {
+		if isShared {
+			s.sharedWorker = replacement
+			s.Info = replacement.info
+		}
+		for fileId, w := range s.fileMap {
+			if w == sw {
+				s.fileMap[fileId] = replacement
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		slog.Error("Failed to replace worker", "sessionId", s.ID, "workerName", sw.name(), "error", err)
+		return false
+	}
+	if closed {
+		s.discardWorker(replacement)
+		return true
+	}
+
+	slog.Info("Replaced worker", "sessionId", s.ID, "workerName", sw.name(), "workerId", replacement.info.WorkerId, "duration", time.Since(start))
+	if err := s.SendNotice(cartaDefinitions.ErrorSeverity_INFO, []string{"worker"}, fmt.Sprintf("Restarted %s and restored the session", what)); err != nil {
+		slog.Warn("Failed to notify client of replaced worker", "sessionId", s.ID, "error", err)
+	}
+	return true
+}
+
+// describeWorker names a worker by the files open in it, for messages to the client
+func (s *Session) describeWorker(sw *SessionWorker) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []string
+	for _, fileId := range slices.Sorted(maps.Keys(s.fileMap)) {
+		if s.fileMap[fileId] == sw {
+			files = append(files, s.fileRequests[fileId].File)
+		}
+	}
+	switch len(files) {
+	case 0:
+		return "the CARTA backend"
+	case 1:
+		return "the CARTA backend for file " + files[0]
+	default:
+		return "the CARTA backend for files " + strings.Join(files, ", ")
+	}
+}
+
+// replaceWorker starts a new worker for the same role as a crashed one, registers it and replays the crashed worker's
+// state into it. recoveries is the number of crashed workers that the replacement will have replaced.
+func (s *Session) replaceWorker(sw *SessionWorker, recoveries int) (*SessionWorker, error) {
+	info, err := spawnerHelpers.RequestWorkerStartup(s.SpawnerAddress, s.BaseFolder)
+	if err != nil {
+		return nil, fmt.Errorf("error starting worker: %w", err)
+	}
+	slog.Info("Replacement worker started", "sessionId", s.ID, "workerName", sw.name(), "workerId", info.WorkerId)
+	workerConn, err := dialWorker(s.Context, info)
+	if err != nil {
+		if shutdownErr := spawnerHelpers.RequestWorkerShutdown(info.WorkerId, s.SpawnerAddress); shutdownErr != nil {
+			slog.Error("Error shutting down unreachable worker", "workerId", info.WorkerId, "error", shutdownErr)
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	registration := s.registration
+	clientIcdVersion := s.clientIcdVersion
+	s.mu.Unlock()
+
+	replacement := &SessionWorker{
+		info:             info,
+		requestId:        sw.requestId,
+		fileRequest:      sw.fileRequest,
+		conn:             workerConn,
+		clientQueue:      s.clientQueue,
+		recorder:         s.recorder,
+		tileCache:        s.tileCache,
+		clientIcdVersion: clientIcdVersion,
+		onDisconnect:     s.handleWorkerLost,
+		fanOut:           s.fanOut,
+		state:            sw.state,
+		recoveries:       recoveries,
+	}
+	if _, err := replacement.register(s.Context, registration, s.internalRequestId()); err != nil {
+		if shutdownErr := spawnerHelpers.RequestWorkerShutdown(info.WorkerId, s.SpawnerAddress); shutdownErr != nil {
+			slog.Error("Error shutting down unregistered worker", "workerId", info.WorkerId, "error", shutdownErr)
+		}
+		return nil, err
+	}
+	replacement.handleInit()
+
+	for _, e := range sw.state.snapshot() {
+		if err := s.replayMessage(replacement, e); err != nil {
+			s.discardWorker(replacement)
+			return nil, err
+		}
+	}
+	return replacement, nil
+}
+
+// replayMessage sends a recorded message to a replacement worker, and waits for the response if it has one, so that
+// each message is applied before the ones that depend on it. The responses are not passed on to the client.
+func (s *Session) replayMessage(sw *SessionWorker, e *replayEntry) error {
+	requestId := s.internalRequestId()
+	awaitResponse := len(responseEventTypes(e.eventType)) > 0
+	responses := make(chan []byte, 1)
+	if awaitResponse {
+		s.scriptResponses.Store(requestId, responses)
+		defer s.scriptResponses.Delete(requestId)
+	}
+
+	slog.Debug("Replaying message into replacement worker", "sessionId", s.ID, "workerName", sw.name(), "eventType", e.eventType)
+	if err := sw.proxyMessageToWorker(e.eventType, requestId, e.body); err != nil {
+		return err
+	}
+	if !awaitResponse {
+		return nil
+	}
+
+	var timeout <-chan time.Time
+	if settings.ReplayTimeout > 0 {
+		timeout = time.After(settings.ReplayTimeout)
+	}
+	var response []byte
+	select {
+	case response = <-responses:
+	case <-timeout:
+		return fmt.Errorf("no response to replayed %s", e.eventType)
+	case <-sw.done:
+		return fmt.Errorf("worker connection lost while replaying %s", e.eventType)
+	case <-s.Context.Done():
+		return fmt.Errorf("session closed while replaying %s", e.eventType)
+	}
+
+	responseType, msg, err := s.decodeClientResponse(response)
+	if err != nil {
+		return err
+	}
+	if fd := msg.ProtoReflect().Descriptor().Fields().ByName("success"); fd != nil && !msg.ProtoReflect().Get(fd).Bool() {
+		// Without the file there is nothing to restore the rest of the state into
+		if e.eventType == cartaDefinitions.EventType_OPEN_FILE {
+			return fmt.Errorf("replayed %s failed", e.eventType)
+		}
+		slog.Warn("Replayed message failed", "sessionId", s.ID, "workerName", sw.name(), "eventType", e.eventType, "responseType", responseType)
+	}
+	return nil
+}
+
+// discardWorker closes the connection to a worker that the session never started using, such as a replacement that
+// failed to take over from a crashed worker, and shuts it down
+func (s *Session) discardWorker(sw *SessionWorker) {
+	sw.disconnect()
+	if err := spawnerHelpers.RequestWorkerShutdown(sw.info.WorkerId, s.SpawnerAddress); err != nil {
+		slog.Error("Error shutting down unused worker", "workerId", sw.info.WorkerId, "error", err)
+	}
+}
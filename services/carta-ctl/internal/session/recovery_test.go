@@ -0,0 +1,117 @@
+package session
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/mockworker"
+)
+
+// withRecovery enables worker recovery, and returns a base folder with an image in it
+func withRecovery(t *testing.T) string {
+	t.Helper()
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.WorkerRecoveries = 1
+	settings.ReplayTimeout = 5 * time.Second
+	return imageFolder(t)
+}
+
+func TestWorkerCrashReplaysState(t *testing.T) {
+	base := withRecovery(t)
+	// The shared worker and the replacement behave, and the file's own worker crashes when a region is set
+	spawner := newTestSpawner(t,
+		mockworker.Options{BaseFolder: base},
+		mockworker.Options{BaseFolder: base, Faults: mockworker.Faults{CrashOn: []cartaDefinitions.EventType{cartaDefinitions.EventType_SET_REGION}}},
+		mockworker.Options{BaseFolder: base},
+	)
+	server := newTestServer(t, spawner, base)
+	client := dialTestClient(t, server.url)
+	client.register()
+
+	client.send(cartaDefinitions.EventType_OPEN_FILE, 2, &cartaDefinitions.OpenFile{Directory: basePlaceholder, File: "m51.fits", FileId: 0})
+	client.expect(cartaDefinitions.EventType_OPEN_FILE_ACK, nil)
+	client.send(cartaDefinitions.EventType_SET_IMAGE_CHANNELS, 0, &cartaDefinitions.SetImageChannels{
+		FileId:        0,
+		Channel:       2,
+		RequiredTiles: &cartaDefinitions.AddRequiredTiles{FileId: 0, Tiles: []int32{1}},
+	})
+	client.expect(cartaDefinitions.EventType_RASTER_TILE_DATA, nil)
+	client.send(cartaDefinitions.EventType_ADD_REQUIRED_TILES, 0, &cartaDefinitions.AddRequiredTiles{FileId: 0, Tiles: []int32{5, 6}})
+	for range 2 {
+		client.expect(cartaDefinitions.EventType_RASTER_TILE_DATA, nil)
+	}
+
+	// The request that crashes the worker is answered with a failure
+	client.send(cartaDefinitions.EventType_SET_REGION, 3, &cartaDefinitions.SetRegion{FileId: 0, RegionId: -1})
+	var regionAck cartaDefinitions.SetRegionAck
+	prefix := client.expect(cartaDefinitions.EventType_SET_REGION_ACK, &regionAck)
+	if prefix.RequestId != 3 || regionAck.Success {
+		t.Errorf("got SET_REGION_ACK for request %d with success %v, want a failure for request 3", prefix.RequestId, regionAck.Success)
+	}
+
+	// The replacement is sent the file and the tiles in view, and renders them in the channel that was in view
+	var tiles []int32
+	for len(tiles) < 3 {
+		var data cartaDefinitions.RasterTileData
+		client.expect(cartaDefinitions.EventType_RASTER_TILE_DATA, &data)
+		if data.FileId != 0 || data.Channel != 2 {
+			t.Errorf("replacement sent a tile for file %d channel %d, want file 0 channel 2", data.FileId, data.Channel)
+		}
+		for _, tile := range data.Tiles {
+			tiles = append(tiles, tile.X)
+		}
+	}
+	if slices.Sort(tiles); !slices.Equal(tiles, []int32{1, 5, 6}) {
+		t.Errorf("replacement rendered tiles %v, want [1 5 6]", tiles)
+	}
+	if n := spawner.started(); n != 3 {
+		t.Errorf("started %d workers, want the shared worker, the file's worker and its replacement", n)
+	}
+	if !spawner.stopped(2) {
+		t.Error("crashed worker was not shut down")
+	}
+}
+
+func TestOpenFileThatCrashesWorkerIsNotReplayed(t *testing.T) {
+	base := withRecovery(t)
+	spawner := newTestSpawner(t,
+		mockworker.Options{BaseFolder: base},
+		mockworker.Options{BaseFolder: base, Faults: mockworker.Faults{CrashOn: []cartaDefinitions.EventType{cartaDefinitions.EventType_OPEN_FILE}}},
+	)
+	server := newTestServer(t, spawner, base)
+	client := dialTestClient(t, server.url)
+	client.register()
+
+	client.send(cartaDefinitions.EventType_OPEN_FILE, 2, &cartaDefinitions.OpenFile{Directory: basePlaceholder, File: "m51.fits", FileId: 0})
+	var ack cartaDefinitions.OpenFileAck
+	if prefix := client.expect(cartaDefinitions.EventType_OPEN_FILE_ACK, &ack); prefix.RequestId != 2 || ack.Success {
+		t.Fatalf("got OPEN_FILE_ACK for request %d with success %v, want a failure for request 2", prefix.RequestId, ack.Success)
+	}
+	waitFor(t, "the crashed worker to be shut down", func() bool { return spawner.stopped(2) })
+
+	// The file would crash a replacement too, so the worker is not replaced, and the client is not told to reopen
+	// files it never had
+	client.send(cartaDefinitions.EventType_FILE_LIST_REQUEST, 3, &cartaDefinitions.FileListRequest{Directory: basePlaceholder})
+	for {
+		prefix, _ := client.next()
+		if prefix.EventType == cartaDefinitions.EventType_ERROR_DATA {
+			t.Error("client was sent a notice about a worker that only held the failed file")
+		}
+		if prefix.EventType == cartaDefinitions.EventType_FILE_LIST_RESPONSE {
+			break
+		}
+	}
+	if n := spawner.started(); n != 2 {
+		t.Errorf("started %d workers, want no replacement for the crashed worker", n)
+	}
+	s := server.session(t, 1)
+	s.mu.Lock()
+	_, open := s.fileMap[0]
+	s.mu.Unlock()
+	if open {
+		t.Error("file that failed to open is still mapped to a worker")
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"log/slog"
 
-	"github.com/gorilla/websocket"
-
 	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
 )
@@ -23,25 +21,58 @@ func (s *Session) handleRegisterViewerMessage(_ cartaDefinitions.EventType, requ
 	if err != nil {
 		return fmt.Errorf("error starting worker: %v", err)
 	}
-	s.Info = info
 
 	slog.Info("Worker started for session", "workerId", info.WorkerId, "sessionId", payload.SessionId, "address", info.Address, "port", info.Port)
-	addr := fmt.Sprintf("ws://%s:%d", info.Address, info.Port)
 	wctx := s.Context
 	if wctx == nil {
 		wctx = context.Background()
 	}
-	workerConn, _, err := websocket.DefaultDialer.DialContext(wctx, addr, nil)
+	workerConn, err := dialWorker(wctx, info)
+	if err != nil {
+		if shutdownErr := spawnerHelpers.RequestWorkerShutdown(info.WorkerId, s.SpawnerAddress); shutdownErr != nil {
+			slog.Error("Error shutting down unreachable worker", "workerId", info.WorkerId, "error", shutdownErr)
+		}
+		return err
+	}
 
+	s.mu.Lock()
+	s.registration = msg
+	clientIcdVersion := s.clientIcdVersion
+	s.mu.Unlock()
+
+	sharedWorker := &SessionWorker{
+		info:             info,
+		conn:             workerConn,
+		clientQueue:      s.clientQueue,
+		recorder:         s.recorder,
+		tileCache:        s.tileCache,
+		fileRequest:      nil,
+		clientIcdVersion: clientIcdVersion,
+		onDisconnect:     s.handleWorkerLost,
+		fanOut:           s.fanOut,
+		state:            newReplayState(),
+	}
+	ack, err := sharedWorker.register(wctx, msg, requestId)
 	if err != nil {
-		return fmt.Errorf("could not connect to worker at %s: %w", addr, err)
+		if shutdownErr := spawnerHelpers.RequestWorkerShutdown(info.WorkerId, s.SpawnerAddress); shutdownErr != nil {
+			slog.Error("Error shutting down unregistered worker", "workerId", info.WorkerId, "error", shutdownErr)
+		}
+		return err
 	}
+	sharedWorker.handleInit()
 
-	s.sharedWorker = &SessionWorker{
-		conn:           workerConn,
-		clientSendChan: s.clientSendChan,
-		fileRequest:    nil,
+	// The worker only becomes the session's once it is usable, and a session that has closed meanwhile can't shut it
+	// down any more
+	s.mu.Lock()
+	closed := s.closed
+	if !closed {
+		s.sharedWorker = sharedWorker
+		s.Info = info
+	}
+	s.mu.Unlock()
+	if closed {
+		s.discardWorker(sharedWorker)
+		return fmt.Errorf("session is closed")
 	}
-	s.sharedWorker.handleInit()
-	return s.sharedWorker.proxyMessageToWorker(&payload, cartaDefinitions.EventType_REGISTER_VIEWER, requestId)
+	return s.sendToClient(ack)
 }
@@ -0,0 +1,253 @@
+package session
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
+)
+
+// registry keeps track of all live sessions, so that they can be inspected and managed outside the WebSocket handler
+var registry = struct {
+	sync.RWMutex
+	sessions map[string]*Session
+}{sessions: make(map[string]*Session)}
+
+func register(s *Session) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.sessions[s.ID] = s
+	liveSessions.Add(1)
+	s.countUserSession(1)
+}
+
+func unregister(s *Session) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.sessions, s.ID)
+	s.countUserSession(-1)
+}
+
+// List returns all live sessions, ordered by connection time
+func List() []*Session {
+	registry.RLock()
+	sessions := make([]*Session, 0, len(registry.sessions))
+	for _, s := range registry.sessions {
+		sessions = append(sessions, s)
+	}
+	registry.RUnlock()
+
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	return sessions
+}
+
+// Get looks up a live session by its ID
+func Get(id string) (*Session, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	s, ok := registry.sessions[id]
+	return s, ok
+}
+
+type FileSummary struct {
+	FileId    int32  `json:"fileId"`
+	Directory string `json:"directory"`
+	File      string `json:"file"`
+	WorkerId  string `json:"workerId"`
+}
+
+type Summary struct {
+	ID          string        `json:"id"`
+	Username    string        `json:"username"`
+	RemoteAddr  string        `json:"remoteAddr"`
+	ConnectedAt time.Time     `json:"connectedAt"`
+	Files       []FileSummary `json:"files"`
+	WorkerIds   []string      `json:"workerIds"`
+	// Following is the ID of the session that a read-only follower session watches
+	Following string `json:"following,omitempty"`
+	Followers int    `json:"followers"`
+}
+
+type Details struct {
+	Summary
+	Workers     []spawnerHelpers.WorkerInfo `json:"workers"`
+	ClientQueue QueueStats                  `json:"clientQueue"`
+}
+
+// Summary returns a snapshot of the session's user, connection and open files
+func (s *Session) Summary() Summary {
+	return s.Details().Summary
+}
+
+// Details returns a snapshot of the session, including the connection details of each of its workers
+func (s *Session) Details() Details {
+	d := Details{
+		Summary: Summary{
+			ID:          s.ID,
+			RemoteAddr:  s.RemoteAddr,
+			ConnectedAt: s.ConnectedAt,
+			Files:       []FileSummary{},
+			WorkerIds:   []string{},
+		},
+		Workers: []spawnerHelpers.WorkerInfo{},
+	}
+	if s.User != nil {
+		d.Username = s.User.Username
+	}
+	if s.clientQueue != nil {
+		d.ClientQueue = s.clientQueue.stats()
+	}
+
+	d.Following = s.Following()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d.Followers = len(s.followers)
+	if s.sharedWorker != nil && s.sharedWorker.info.WorkerId != "" {
+		d.WorkerIds = append(d.WorkerIds, s.sharedWorker.info.WorkerId)
+		d.Workers = append(d.Workers, s.sharedWorker.info)
+	}
+	for fileId, fileWorker := range s.fileMap {
+		file := FileSummary{
+			FileId:   fileId,
+			WorkerId: fileWorker.info.WorkerId,
+		}
+		if request := s.fileRequests[fileId]; request != nil {
+			file.Directory = request.Directory
+			file.File = request.File
+		}
+		d.Files = append(d.Files, file)
+		// Files may share a worker, which is only listed once
+		if fileWorker.info.WorkerId != "" && !slices.Contains(d.WorkerIds, fileWorker.info.WorkerId) {
+			d.WorkerIds = append(d.WorkerIds, fileWorker.info.WorkerId)
+			d.Workers = append(d.Workers, fileWorker.info)
+		}
+	}
+	slices.SortFunc(d.Files, func(a, b FileSummary) int {
+		return cmp.Compare(a.FileId, b.FileId)
+	})
+	return d
+}
+
+// terminateFlushTimeout is how long Terminate waits for queued messages to reach the client before closing
+const terminateFlushTimeout = 2 * time.Second
+
+// Terminate closes the client WebSocket. The connection handler then exits and shuts down the session's workers.
+// Messages already queued for the client, such as a notice explaining why the session is closing, are delivered
+// first, unless the client is too slow to take them.
+func (s *Session) Terminate(reason string) error {
+	slog.Info("Terminating session", "sessionId", s.ID, "reason", reason)
+	if s.clientQueue != nil && !s.clientQueue.flush(time.Now().Add(terminateFlushTimeout)) {
+		slog.Warn("Closing session before its queued messages were delivered", "sessionId", s.ID)
+	}
+	deadline := time.Now().Add(time.Second)
+	err := s.WebSocket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, reason), deadline)
+	if err != nil {
+		slog.Warn("Failed to send close message", "sessionId", s.ID, "error", err)
+	}
+	// Unblock the read loop immediately rather than waiting for the client to acknowledge the close
+	return s.WebSocket.SetReadDeadline(time.Now())
+}
+
+// RestartBackend replaces each of the session's workers with a new one, for users whose backend has stopped
+// responding. The workers are shut down through the spawner and replaced in the same way as crashed workers, with the
+// session's state replayed into the replacements, so the client stays connected and keeps its open images.
+func (s *Session) RestartBackend(reason string) error {
+	workers := s.workers()
+	if len(workers) == 0 {
+		return fmt.Errorf("session has no backend to restart")
+	}
+	slog.Info("Restarting session backend", "sessionId", s.ID, "reason", reason, "workers", len(workers))
+
+	s.mu.Lock()
+	sharedWorker := s.sharedWorker
+	openFiles := len(s.fileMap)
+	for _, sw := range workers {
+		sw.restarting = true
+	}
+	s.mu.Unlock()
+	for _, sw := range workers {
+		// The connection is closed first, so that the worker's read loop doesn't also report it lost
+		sw.disconnect()
+		s.handleWorkerLost(sw, errors.New(reason))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A session that can't replace its shared worker is closed
+	if s.closed || s.sharedWorker == sharedWorker {
+		return fmt.Errorf("backend could not be restarted, and the session was closed")
+	}
+	if lost := openFiles - len(s.fileMap); lost > 0 {
+		return fmt.Errorf("backend was restarted, but %d open files could not be restored", lost)
+	}
+	return nil
+}
+
+// SendNotice sends an ERROR_DATA message to the client, which the frontend displays in its log and alert UI
+func (s *Session) SendNotice(severity cartaDefinitions.ErrorSeverity, tags []string, message string) error {
+	msg, err := s.prepareClientMessage(&cartaDefinitions.ErrorData{
+		Severity: severity,
+		Tags:     tags,
+		Message:  message,
+	}, cartaDefinitions.EventType_ERROR_DATA, 0)
+	if err != nil {
+		return err
+	}
+	return s.sendToClient(msg)
+}
+
+// Broadcast sends a notice to every live session and returns the number of sessions that it was delivered to
+func Broadcast(severity cartaDefinitions.ErrorSeverity, tags []string, message string) int {
+	delivered := 0
+	for _, s := range List() {
+		err := s.SendNotice(severity, tags, message)
+		if err != nil {
+			slog.Warn("Failed to send notice to session", "sessionId", s.ID, "error", err)
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// ForUser returns the live sessions opened by a user, ordered by connection time
+func ForUser(u *auth.User) []*Session {
+	var sessions []*Session
+	for _, s := range List() {
+		if s.User != nil && u != nil && s.User.Username == u.Username && s.User.Source == u.Source {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// TerminateLogin terminates every live session that was opened with a login, and returns the number of sessions
+func TerminateLogin(loginID, reason string) int {
+	if loginID == "" {
+		return 0
+	}
+	terminated := 0
+	for _, s := range List() {
+		if s.User == nil || s.User.LoginID != loginID {
+			continue
+		}
+		if err := s.Terminate(reason); err != nil {
+			slog.Warn("Failed to terminate session", "sessionId", s.ID, "error", err)
+		}
+		terminated++
+	}
+	return terminated
+}
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/mockworker"
+)
+
+func TestTerminateDeliversQueuedNotice(t *testing.T) {
+	spawner := newTestSpawner(t)
+	server := newTestServer(t, spawner, "")
+	client := dialTestClient(t, server.url)
+	client.register()
+
+	s := server.session(t, 1)
+	if err := s.SendNotice(cartaDefinitions.ErrorSeverity_WARNING, []string{"test"}, "Closing for a test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Terminate("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	var notice cartaDefinitions.ErrorData
+	client.expect(cartaDefinitions.EventType_ERROR_DATA, &notice)
+	if notice.Message != "Closing for a test" {
+		t.Errorf("got notice %q before the close", notice.Message)
+	}
+	if _, _, err := client.conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("got %v after the notice, want the close frame", err)
+	}
+}
+
+func TestRestartBackendKeepsClientConnected(t *testing.T) {
+	// Restarts are asked for by the user, so they don't depend on crash recovery being enabled
+	base := withRecovery(t)
+	settings.WorkerRecoveries = 0
+	spawner := newTestSpawner(t, mockworker.Options{BaseFolder: base})
+	server := newTestServer(t, spawner, base)
+	client := dialTestClient(t, server.url)
+	client.register()
+	client.send(cartaDefinitions.EventType_OPEN_FILE, 2, &cartaDefinitions.OpenFile{Directory: basePlaceholder, File: "m51.fits", FileId: 0})
+	client.expect(cartaDefinitions.EventType_OPEN_FILE_ACK, nil)
+
+	s := server.session(t, 1)
+	if err := s.RestartBackend("test"); err != nil {
+		t.Fatal(err)
+	}
+	if !spawner.stopped(1) || !spawner.stopped(2) {
+		t.Error("old workers were not shut down")
+	}
+	if n := spawner.started(); n != 4 {
+		t.Errorf("started %d workers, want the shared and file workers and a replacement for each", n)
+	}
+
+	// The client is told, and keeps using the session with the file still open
+	var notice cartaDefinitions.ErrorData
+	for !strings.HasPrefix(notice.Message, "Restarted") {
+		client.expect(cartaDefinitions.EventType_ERROR_DATA, &notice)
+	}
+	client.send(cartaDefinitions.EventType_SET_IMAGE_CHANNELS, 0, &cartaDefinitions.SetImageChannels{
+		FileId:        0,
+		Channel:       1,
+		RequiredTiles: &cartaDefinitions.AddRequiredTiles{FileId: 0, Tiles: []int32{1}},
+	})
+	var data cartaDefinitions.RasterTileData
+	client.expect(cartaDefinitions.EventType_RASTER_TILE_DATA, &data)
+	if data.FileId != 0 || data.Channel != 1 {
+		t.Errorf("got a tile for file %d channel %d from the new worker, want file 0 channel 1", data.FileId, data.Channel)
+	}
+	if n := spawner.started(); n != 4 {
+		t.Errorf("started %d workers after the restart, want no more", n)
+	}
+}
@@ -0,0 +1,129 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+)
+
+// scriptRequestIdBase is the first request ID used for scripted messages. Clients number their requests upwards from
+// 1, so scripted requests use the upper half of the range to avoid clashing with them.
+const scriptRequestIdBase = 1 << 31
+
+var (
+	ErrNotRegistered    = errors.New("session has not registered a viewer yet")
+	ErrNotScriptable    = errors.New("message type cannot be scripted")
+	ErrScriptNoResponse = errors.New("no response to scripted message")
+)
+
+// ScriptResponse is the reply to a scripted message
+type ScriptResponse struct {
+	EventType cartaDefinitions.EventType
+	RequestId uint32
+	// Message is nil for messages that aren't answered with an X_ACK or X_RESPONSE message
+	Message proto.Message
+}
+
+// Script handles a message on behalf of the client, with a fresh request ID, and waits for the response to it. The
+// message is checked against the session's policies and routed exactly as if the client had sent it, but the response
+// is returned to the caller instead of being sent to the client.
+func (s *Session) Script(ctx context.Context, eventType cartaDefinitions.EventType, msg proto.Message) (ScriptResponse, error) {
+	// A second viewer registration would replace the session's shared worker
+	if eventType == cartaDefinitions.EventType_REGISTER_VIEWER {
+		return ScriptResponse{}, fmt.Errorf("%w: %s", ErrNotScriptable, eventType)
+	}
+	s.mu.Lock()
+	registered := s.sharedWorker != nil
+	s.mu.Unlock()
+	if !registered {
+		return ScriptResponse{}, ErrNotRegistered
+	}
+
+	requestId := s.internalRequestId()
+	result := ScriptResponse{RequestId: requestId}
+
+	responseTypes := responseEventTypes(eventType)
+	responses := make(chan []byte, 1)
+	if len(responseTypes) > 0 {
+		s.scriptResponses.Store(requestId, responses)
+		defer s.scriptResponses.Delete(requestId)
+	}
+
+	message, err := s.prepareClientMessage(msg, eventType, requestId)
+	if err != nil {
+		return result, err
+	}
+	slog.Info("Handling scripted message", "sessionId", s.ID, "eventType", eventType, "requestId", requestId)
+	err = s.HandleMessage(message)
+	if len(responseTypes) == 0 {
+		return result, err
+	}
+
+	var response []byte
+	if err != nil {
+		// Rejected messages are usually answered with a failed response, which is more useful to return
+		select {
+		case response = <-responses:
+		default:
+			return result, err
+		}
+	} else {
+		select {
+		case response = <-responses:
+		case <-ctx.Done():
+			return result, fmt.Errorf("%w: %w", ErrScriptNoResponse, ctx.Err())
+		case <-s.Context.Done():
+			return result, fmt.Errorf("%w: session closed", ErrScriptNoResponse)
+		}
+	}
+
+	result.EventType, result.Message, err = s.decodeClientResponse(response)
+	return result, err
+}
+
+// internalRequestId returns a fresh request ID for a message that the controller sends on the client's behalf
+func (s *Session) internalRequestId() uint32 {
+	return scriptRequestIdBase + s.nextScriptRequestId.Add(1)
+}
+
+// decodeClientResponse decodes a message that was addressed to the client, translating it from the client's ICD
+// version first
+func (s *Session) decodeClientResponse(response []byte) (cartaDefinitions.EventType, proto.Message, error) {
+	s.mu.Lock()
+	clientIcdVersion := s.clientIcdVersion
+	s.mu.Unlock()
+	if translated, err := translateMessage(response, clientIcdVersion, cartaHelpers.IcdVersion); err == nil {
+		response = translated
+	}
+	prefix, err := cartaHelpers.DecodeMessagePrefix(response)
+	if err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+		return 0, nil, err
+	}
+	msg, err := cartaHelpers.NewMessage(prefix.EventType)
+	if err != nil {
+		return prefix.EventType, nil, err
+	}
+	if err := proto.Unmarshal(response[8:], msg); err != nil {
+		return prefix.EventType, nil, fmt.Errorf("error decoding %s: %w", prefix.EventType, err)
+	}
+	return prefix.EventType, msg, nil
+}
+
+// interceptScriptResponse takes messages in reply to scripted and replayed requests out of the client's queue. The
+// first one for each request is handed to the waiting caller, and the rest are dropped, as the client never asked for
+// them.
+func (s *Session) interceptScriptResponse(requestId uint32, data []byte) bool {
+	if requestId < scriptRequestIdBase {
+		return false
+	}
+	if responses, ok := s.scriptResponses.LoadAndDelete(requestId); ok {
+		responses.(chan []byte) <- data
+	}
+	return true
+}
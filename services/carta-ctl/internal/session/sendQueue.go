@@ -0,0 +1,321 @@
+package session
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
+)
+
+var (
+	queueDepth = metrics.NewGaugeVec("carta_send_queue_messages", "Number of messages waiting to be written to a peer", "queue")
+	queueBytes = metrics.NewGaugeVec("carta_send_queue_bytes", "Number of bytes waiting to be written to a peer", "queue")
+	queueDrops = metrics.NewCounterVec("carta_send_queue_dropped_total", "Number of messages dropped from send queues", "queue", "event_type", "reason")
+)
+
+// flushPollInterval is how often flush checks whether the queue has been written out
+const flushPollInterval = 10 * time.Millisecond
+
+// dropPolicy determines what a send queue may do with a message when the peer falls behind
+type dropPolicy int
+
+const (
+	// neverDrop messages are always delivered, even if the queue is over its limits. ACKs and errors fall into this category.
+	neverDrop dropPolicy = iota
+	// dropWhenFull messages are streamed data that the client can do without, and are dropped first when the queue is full
+	dropWhenFull
+)
+
+// droppableEvents lists the streamed data messages that may be dropped under backpressure. Everything else is
+// treated as neverDrop. Raster tiles are not listed: each set of tiles ends with a RASTER_TILE_SYNC, and the frontend
+// would treat a set with missing tiles as complete and leave holes in the image. Tiles are only dropped by
+// dropSupersededTiles, once the client has moved on to another plane.
+var droppableEvents = map[cartaDefinitions.EventType]bool{
+	cartaDefinitions.EventType_SPATIAL_PROFILE_DATA:     true,
+	cartaDefinitions.EventType_REGION_HISTOGRAM_DATA:    true,
+	cartaDefinitions.EventType_VECTOR_OVERLAY_TILE_DATA: true,
+}
+
+func policyFor(eventType cartaDefinitions.EventType) dropPolicy {
+	if droppableEvents[eventType] {
+		return dropWhenFull
+	}
+	return neverDrop
+}
+
+// tileChannel identifies the image plane that a raster tile belongs to
+type tileChannel struct {
+	fileId  int32
+	channel int32
+	stokes  int32
+}
+
+type queuedMessage struct {
+	data      []byte
+	eventType cartaDefinitions.EventType
+	policy    dropPolicy
+	// only set for RASTER_TILE_DATA messages
+	tile *tileChannel
+}
+
+// sendQueue is a bounded, byte-aware queue of messages waiting to be written to a WebSocket peer. Unlike a plain
+// channel, pushing never blocks: when the peer falls behind, droppable messages are discarded according to their
+// policy, and if the queue still overflows the peer is considered stuck and onStuck is called.
+type sendQueue struct {
+	name        string
+	metricLabel string
+	maxMessages int
+	maxBytes    int
+	// hard limit beyond which even neverDrop messages cannot be queued
+	overflowFactor int
+
+	mu     sync.Mutex
+	items  []queuedMessage
+	bytes  int
+	closed bool
+	// writing is set while the sender is writing the message it last popped
+	writing bool
+	// signalled whenever items are added or the queue is closed
+	ready chan struct{}
+
+	onStuck   func(reason string)
+	stuckOnce sync.Once
+	// onSent is called with each message after it has been written to the peer
+	onSent func(data []byte)
+	// intercept is called with each message before it is queued. Messages that it returns true for are consumed
+	// by it, and not sent to the peer.
+	intercept func(requestId uint32, data []byte) bool
+	// onPush is called with the event type and request ID of each message as it is queued
+	onPush func(eventType cartaDefinitions.EventType, requestId uint32)
+}
+
+func newSendQueue(name string, metricLabel string) *sendQueue {
+	q := &sendQueue{
+		name:           name,
+		metricLabel:    metricLabel,
+		maxMessages:    settings.SendQueueMessages,
+		maxBytes:       settings.SendQueueBytes,
+		overflowFactor: 2,
+		ready:          make(chan struct{}, 1),
+	}
+	if q.maxMessages <= 0 {
+		q.maxMessages = 1000
+	}
+	if q.maxBytes <= 0 {
+		q.maxBytes = 64 * 1024 * 1024
+	}
+	return q
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *sendQueue) full(extraBytes int) bool {
+	return len(q.items)+1 > q.maxMessages || q.bytes+extraBytes > q.maxBytes
+}
+
+// removeAt deletes an item from the queue and updates the size accounting. The caller must hold q.mu.
+func (q *sendQueue) removeAt(i int, reason string) {
+	item := q.items[i]
+	q.items = append(q.items[:i], q.items[i+1:]...)
+	q.bytes -= len(item.data)
+	queueDepth.WithLabelValues(q.metricLabel).Dec()
+	queueBytes.WithLabelValues(q.metricLabel).Add(-float64(len(item.data)))
+	if reason != "" {
+		queueDrops.WithLabelValues(q.metricLabel, item.eventType.String(), reason).Inc()
+	}
+}
+
+// push queues a framed message for the peer. It returns false if the message was dropped.
+func (q *sendQueue) push(data []byte) bool {
+	item := queuedMessage{data: data}
+	if prefix, err := cartaHelpers.DecodeMessagePrefix(data); err == nil || errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+		item.eventType = prefix.EventType
+		if q.onPush != nil {
+			q.onPush(prefix.EventType, prefix.RequestId)
+		}
+		if q.intercept != nil && q.intercept(prefix.RequestId, data) {
+			return true
+		}
+	}
+	item.policy = policyFor(item.eventType)
+	if item.eventType == cartaDefinitions.EventType_RASTER_TILE_DATA && len(data) > 8 {
+		if fileId, channel, stokes, ok := cartaHelpers.PeekRasterTileChannel(data[8:]); ok {
+			item.tile = &tileChannel{fileId: fileId, channel: channel, stokes: stokes}
+		}
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+
+	// Make room by discarding the oldest droppable messages
+	for i := 0; q.full(len(data)) && i < len(q.items); {
+		if q.items[i].policy == dropWhenFull {
+			q.removeAt(i, "queue_full")
+			continue
+		}
+		i++
+	}
+
+	if q.full(len(data)) {
+		if item.policy == dropWhenFull {
+			q.mu.Unlock()
+			queueDrops.WithLabelValues(q.metricLabel, item.eventType.String(), "queue_full").Inc()
+			return false
+		}
+		if len(q.items)+1 > q.overflowFactor*q.maxMessages || q.bytes+len(data) > q.overflowFactor*q.maxBytes {
+			q.mu.Unlock()
+			queueDrops.WithLabelValues(q.metricLabel, item.eventType.String(), "overflow").Inc()
+			q.stuck("send queue overflowed")
+			return false
+		}
+	}
+
+	q.items = append(q.items, item)
+	q.bytes += len(data)
+	queueDepth.WithLabelValues(q.metricLabel).Inc()
+	queueBytes.WithLabelValues(q.metricLabel).Add(float64(len(data)))
+	q.mu.Unlock()
+
+	q.signal()
+	return true
+}
+
+// dropSupersededTiles discards queued raster tiles for a file that belong to a different channel or Stokes parameter
+// than the one the client has just switched to. The client would discard them on arrival anyway.
+func (q *sendQueue) dropSupersededTiles(current tileChannel) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := 0; i < len(q.items); {
+		tile := q.items[i].tile
+		if tile != nil && tile.fileId == current.fileId && (tile.channel != current.channel || tile.stokes != current.stokes) {
+			q.removeAt(i, "superseded")
+			continue
+		}
+		i++
+	}
+}
+
+// pop blocks until a message is available, returning false once the queue has been closed and drained
+func (q *sendQueue) pop() (queuedMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.removeAt(0, "")
+			q.writing = true
+			q.mu.Unlock()
+			return item, true
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return queuedMessage{}, false
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// written marks the message last popped as written to the peer, or as failed to write
+func (q *sendQueue) written() {
+	q.mu.Lock()
+	q.writing = false
+	q.mu.Unlock()
+}
+
+// flush waits until every queued message has been written to the peer, returning false if the deadline passes first
+func (q *sendQueue) flush(deadline time.Time) bool {
+	for {
+		q.mu.Lock()
+		idle := len(q.items) == 0 && !q.writing
+		q.mu.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(flushPollInterval)
+	}
+}
+
+// close stops the queue from accepting messages. Messages that are already queued are still delivered.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// discard empties the queue without delivering the remaining messages
+func (q *sendQueue) discard() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) > 0 {
+		q.removeAt(len(q.items)-1, "")
+	}
+}
+
+func (q *sendQueue) stuck(reason string) {
+	q.stuckOnce.Do(func() {
+		slog.Error("Peer is not keeping up, giving up on connection", "name", q.name, "reason", reason)
+		if q.onStuck != nil {
+			go q.onStuck(reason)
+		}
+	})
+}
+
+// QueueStats describes the current state of a send queue
+type QueueStats struct {
+	Messages int `json:"messages"`
+	Bytes    int `json:"bytes"`
+}
+
+func (q *sendQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{Messages: len(q.items), Bytes: q.bytes}
+}
+
+// sendHandler writes queued messages to the connection until the queue is closed. A peer that cannot accept a
+// message within the configured write timeout is treated as stuck, and no further messages are written.
+func sendHandler(q *sendQueue, conn *websocket.Conn) {
+	slog.Debug("Starting send handler", "name", q.name)
+	for {
+		item, ok := q.pop()
+		if !ok {
+			break
+		}
+
+		if settings.WriteTimeout > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(settings.WriteTimeout))
+		}
+		err := conn.WriteMessage(websocket.BinaryMessage, item.data)
+		q.written()
+		if err != nil {
+			slog.Error("Error sending message", "name", q.name, "eventType", item.eventType, "error", err)
+			// Nothing more can be written to this connection, so stop accepting messages for it
+			q.close()
+			q.discard()
+			q.stuck(err.Error())
+			break
+		}
+		if q.onSent != nil {
+			q.onSent(item.data)
+		}
+	}
+	slog.Debug("Send handler exiting", "name", q.name)
+}
@@ -0,0 +1,81 @@
+package session
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+)
+
+func framed(t *testing.T, msg proto.Message, eventType cartaDefinitions.EventType) []byte {
+	t.Helper()
+	data, err := cartaHelpers.PrepareMessagePayload(msg, eventType, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func queuedTypes(q *sendQueue) []cartaDefinitions.EventType {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var types []cartaDefinitions.EventType
+	for _, item := range q.items {
+		types = append(types, item.eventType)
+	}
+	return types
+}
+
+func TestSendQueueKeepsTileSetsWhenFull(t *testing.T) {
+	q := newSendQueue("test", "test")
+	q.maxMessages = 3
+	q.onStuck = func(string) {}
+
+	tile := framed(t, &cartaDefinitions.RasterTileData{FileId: 0, Channel: 5}, cartaDefinitions.EventType_RASTER_TILE_DATA)
+	sync := framed(t, &cartaDefinitions.RasterTileSync{FileId: 0, Channel: 5, EndSync: true}, cartaDefinitions.EventType_RASTER_TILE_SYNC)
+	profile := framed(t, &cartaDefinitions.SpatialProfileData{}, cartaDefinitions.EventType_SPATIAL_PROFILE_DATA)
+
+	q.push(profile)
+	q.push(tile)
+	q.push(tile)
+	// The queue is full, so the profile makes way, but the tiles of the current plane must stay with their sync
+	if !q.push(tile) || !q.push(sync) {
+		t.Fatal("tile set message was dropped")
+	}
+	want := []cartaDefinitions.EventType{
+		cartaDefinitions.EventType_RASTER_TILE_DATA, cartaDefinitions.EventType_RASTER_TILE_DATA,
+		cartaDefinitions.EventType_RASTER_TILE_DATA, cartaDefinitions.EventType_RASTER_TILE_SYNC,
+	}
+	if got := queuedTypes(q); !slices.Equal(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
+
+func TestSendQueueDropsSupersededTiles(t *testing.T) {
+	q := newSendQueue("test", "test")
+	q.push(framed(t, &cartaDefinitions.RasterTileData{FileId: 0, Channel: 5}, cartaDefinitions.EventType_RASTER_TILE_DATA))
+	q.push(framed(t, &cartaDefinitions.RasterTileData{FileId: 1, Channel: 5}, cartaDefinitions.EventType_RASTER_TILE_DATA))
+	q.push(framed(t, &cartaDefinitions.RasterTileData{FileId: 0, Channel: 6}, cartaDefinitions.EventType_RASTER_TILE_DATA))
+
+	q.dropSupersededTiles(tileChannel{fileId: 0, channel: 6})
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) != 2 || q.items[0].tile.fileId != 1 || q.items[1].tile.channel != 6 {
+		t.Errorf("expected only the tiles of the other file and the new channel to remain, got %d items", len(q.items))
+	}
+}
+
+func TestSendQueueFlushTimesOutWithoutSender(t *testing.T) {
+	q := newSendQueue("test", "test")
+	if !q.flush(time.Now()) {
+		t.Error("flush of an empty queue failed")
+	}
+	q.push(framed(t, &cartaDefinitions.ErrorData{}, cartaDefinitions.EventType_ERROR_DATA))
+	if q.flush(time.Now().Add(50 * time.Millisecond)) {
+		t.Error("flush succeeded with a message that was never written")
+	}
+}
@@ -2,15 +2,23 @@ package session
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"google.golang.org/protobuf/proto"
 
+	"github.com/CARTAvis/go-carta/pkg/capture"
 	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
-	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/cartaHelpers"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
 )
 
@@ -19,6 +27,9 @@ type contextKey string
 const UserContextKey contextKey = "sessionUser"
 
 type Session struct {
+	ID             string
+	RemoteAddr     string
+	ConnectedAt    time.Time
 	Info           spawnerHelpers.WorkerInfo
 	SpawnerAddress string
 	BaseFolder     string
@@ -27,22 +38,59 @@ type Session struct {
 	Context        context.Context
 	Cancel         context.CancelFunc
 
-	clientSendChan chan []byte
-	// maps incoming file IDs to the internal IDs of the workers
+	clientQueue *sendQueue
+	recorder    *recorder
+	// tileCache is nil if tile caching is disabled
+	tileCache *tileCache
+	limiter   *rateLimiter
+	tracer    *requestTracer
+	// maps incoming file IDs to the workers that opened them, and to the requests that opened them. Several files may
+	// share a worker, depending on the allocation strategy
 	fileMap      map[int32]*SessionWorker
+	fileRequests map[int32]*cartaDefinitions.OpenFile
 	sharedWorker *SessionWorker
+	// ICD version used by the client, set by its first message, and the body of its REGISTER_VIEWER message, which is
+	// reused to register additional workers
+	clientIcdVersion uint16
+	registration     []byte
+
+	// mu guards fileMap, fileRequests, sharedWorker, clientIcdVersion, registration and closed against concurrent access from message
+	// handlers and the admin API
+	mu     sync.Mutex
+	closed bool
+
+	// scriptResponses holds a channel for each scripted or replayed request that is waiting for its response
+	nextScriptRequestId atomic.Uint32
+	scriptResponses     sync.Map
+
+	// invites and followers are the invite tokens for following this session, and the sessions following it. Both
+	// are guarded by mu
+	invites   map[string]Invite
+	followers map[string]*Session
+	// leader and invite are set for follower sessions, to the session being followed and the invite used to join it
+	leader *Session
+	invite string
+	// startingWorkers counts the workers being started for files, which allocation counts as part of the session's
+	// workers so that concurrent requests don't start more than it allows. It is guarded by mu
+	startingWorkers int
+	// openImages holds the acknowledgement of each image open in the session, whether opened by the client or
+	// generated by a worker, to tell followers who join later about them. It is guarded by mu
+	openImages map[int32]*cartaDefinitions.OpenFileAck
 }
 
 var handlerMap = map[cartaDefinitions.EventType]func(*Session, cartaDefinitions.EventType, uint32, []byte) error{
 	cartaDefinitions.EventType_REGISTER_VIEWER: (*Session).handleRegisterViewerMessage,
 	cartaDefinitions.EventType_OPEN_FILE:       (*Session).handleOpenFile,
-	// TODO: We need to handle CLOSE_FILE separately as well, because it will require shutting down a worker
-	cartaDefinitions.EventType_EMPTY_EVENT: (*Session).handleStatusMessage,
+	cartaDefinitions.EventType_CLOSE_FILE:      (*Session).handleCloseFile,
+	cartaDefinitions.EventType_EMPTY_EVENT:     (*Session).handleStatusMessage,
 }
 
-func NewSession(conn *websocket.Conn, workerAddr string, folder string, user *auth.User) *Session {
+func NewSession(conn *websocket.Conn, remoteAddr string, workerAddr string, folder string, user *auth.User) *Session {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Session{
+	s := &Session{
+		ID:             uuid.New().String(),
+		RemoteAddr:     remoteAddr,
+		ConnectedAt:    time.Now(),
 		WebSocket:      conn,
 		SpawnerAddress: workerAddr,
 		BaseFolder:     folder,
@@ -50,6 +98,8 @@ func NewSession(conn *websocket.Conn, workerAddr string, folder string, user *au
 		Context:        ctx,
 		Cancel:         cancel,
 	}
+	register(s)
+	return s
 }
 
 func (s *Session) checkAndParse(msg proto.Message, requestId uint32, rawMsg []byte) error {
@@ -77,16 +127,171 @@ func (s *Session) checkAndParse(msg proto.Message, requestId uint32, rawMsg []by
 }
 
 func (s *Session) HandleConnection() {
-	s.clientSendChan = make(chan []byte, 100)
-	go sendHandler(s.clientSendChan, s.WebSocket, "client")
+	s.clientQueue = newSendQueue("client", "client")
+	s.clientQueue.onStuck = func(reason string) {
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+		if err := s.Terminate("client is not keeping up"); err != nil {
+			slog.Error("Failed to terminate stuck session", "sessionId", s.ID, "reason", reason, "error", err)
+		}
+	}
+	s.clientQueue.intercept = s.interceptScriptResponse
+	s.tracer = newRequestTracer()
+	s.clientQueue.onPush = s.finishTrace
+	s.tileCache = newTileCache()
+	s.limiter = newRateLimiter()
+	s.recorder = newRecorder(s.ID)
+	s.clientQueue.onSent = func(data []byte) {
+		countMessage(capture.ControllerToClient, data)
+		s.recorder.record(capture.ControllerToClient, "", data)
+	}
+	if settings.ClientWebSocket.MaxMessageSize > 0 {
+		s.WebSocket.SetReadLimit(settings.ClientWebSocket.MaxMessageSize)
+	}
+	go sendHandler(s.clientQueue, s.WebSocket)
+	startHeartbeat(s.WebSocket, "client", s.Context.Done())
+}
+
+// handleWorkerLost is called when a worker connection drops unexpectedly, or when the user restarts the worker.
+// Requests that the worker didn't answer are failed, and the worker is replaced and the session's state replayed into
+// the replacement, up to the configured number of times per worker for crashes, and always for restarts. Beyond that,
+// losing the shared worker leaves the session unusable, so the client is told and disconnected. Losing another worker
+// only affects the files open in it, so the worker is cleaned up and the client is told that the files need to be
+// reopened.
+func (s *Session) handleWorkerLost(sw *SessionWorker, err error) {
+	s.mu.Lock()
+	isShared := sw == s.sharedWorker
+	isCurrent := isShared || slices.Contains(slices.Collect(maps.Values(s.fileMap)), sw)
+	closed := s.closed
+	restart := sw.restarting
+	// A worker can be reported lost more than once, for example when writes get stuck before the connection drops
+	alreadyLost := sw.recovering != nil
+	if isCurrent && !closed && !alreadyLost {
+		sw.recovering = make(chan struct{})
+	}
+	s.mu.Unlock()
+
+	if closed || alreadyLost {
+		return
+	}
+	if !isCurrent {
+		// Replacement workers that crash during recovery are cleaned up by the recovery itself
+		slog.Warn("Lost connection to replacement worker", "sessionId", s.ID, "workerName", sw.name(), "workerId", sw.info.WorkerId, "error", err)
+		sw.disconnect()
+		return
+	}
+
+	if restart {
+		slog.Info("Restarting worker", "sessionId", s.ID, "workerName", sw.name(), "workerId", sw.info.WorkerId, "reason", err)
+	} else {
+		slog.Warn("Lost connection to worker", "sessionId", s.ID, "workerName", sw.name(), "workerId", sw.info.WorkerId, "error", err)
+	}
+	s.failInFlightRequests(sw)
+
+	// A worker that crashed while opening its only file has nothing left to restore
+	idle := !isShared && !s.holdsFiles(sw)
+	attempted := !idle && (restart || sw.recoveries < settings.WorkerRecoveries)
+	recovered := attempted && s.recoverWorker(sw, isShared, restart)
+	var what string
+	if !recovered && !isShared {
+		what = s.describeWorker(sw)
+		s.mu.Lock()
+		for fileId, w := range s.fileMap {
+			if w == sw {
+				delete(s.fileMap, fileId)
+				delete(s.fileRequests, fileId)
+				delete(s.openImages, fileId)
+			}
+		}
+		s.mu.Unlock()
+	}
+	// Messages held back while the worker was being replaced can now go to the replacement, or the shared worker
+	close(sw.recovering)
+	if recovered {
+		return
+	}
+
+	if isShared {
+		notice := "Connection to the CARTA backend was lost"
+		if restart {
+			notice = "The CARTA backend could not be restarted"
+		}
+		noticeErr := s.SendNotice(cartaDefinitions.ErrorSeverity_CRITICAL, []string{"worker"}, notice)
+		if noticeErr != nil {
+			slog.Warn("Failed to notify client of lost worker", "sessionId", s.ID, "error", noticeErr)
+		}
+		if err := s.Terminate("backend connection lost"); err != nil {
+			slog.Error("Failed to terminate session after losing worker", "sessionId", s.ID, "error", err)
+		}
+		return
+	}
+
+	// A failed recovery has already shut the worker down
+	if !attempted {
+		sw.disconnect()
+		if sw.info.WorkerId != "" {
+			if err := spawnerHelpers.RequestWorkerShutdown(sw.info.WorkerId, s.SpawnerAddress); err != nil {
+				slog.Error("Error shutting down file worker", "workerId", sw.info.WorkerId, "error", err)
+			}
+		}
+	}
+	if idle {
+		return
+	}
+
+	message := fmt.Sprintf("Connection to %s was lost, please reopen its files", what)
+	if restart {
+		message = fmt.Sprintf("Could not restart %s, please reopen its files", what)
+	}
+	if err := s.SendNotice(cartaDefinitions.ErrorSeverity_ERROR, []string{"worker"}, message); err != nil {
+		slog.Warn("Failed to notify client of lost worker", "sessionId", s.ID, "error", err)
+	}
 }
 
 func (s *Session) HandleMessage(msg []byte) error {
+	received := time.Now()
+	s.recorder.record(capture.ClientToController, "", msg)
+	countMessage(capture.ClientToController, msg)
+	s.countUserMessage()
+
 	// Message prefix is used for determining message type and matching requests to responses
 	prefix, err := cartaHelpers.DecodeMessagePrefix(msg)
-	if err != nil {
+	if err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
 		return fmt.Errorf("failed to unmarshal message: %v", err)
 	}
+	if err := s.checkIcdVersion(prefix); err != nil {
+		return err
+	}
+	if !s.admitMessage(prefix, len(msg)) {
+		// Rejections are logged and counted by the limiter, so they aren't reported again as errors
+		return nil
+	}
+	if s.leader != nil {
+		return s.handleFollowerMessage(prefix.EventType, prefix.RequestId, msg[8:])
+	}
+	if !messageAllowed(s.User, prefix.EventType) {
+		err := fmt.Errorf("%s is not permitted for this user", prefix.EventType)
+		slog.Warn("Rejected message by message policy", "sessionId", s.ID, "user", s.User, "eventType", prefix.EventType)
+		response, responseType := failureResponse(prefix.EventType, err.Error())
+		if reply, replyErr := s.prepareClientMessage(response, responseType, prefix.RequestId); replyErr == nil {
+			return errors.Join(err, s.sendToClient(reply))
+		}
+		return err
+	}
+	if response, responseType, err := s.checkPathPolicy(prefix.EventType, msg[8:]); err != nil {
+		slog.Warn("Rejected message by path policy", "sessionId", s.ID, "eventType", prefix.EventType, "error", err)
+		if reply, replyErr := s.prepareClientMessage(response, responseType, prefix.RequestId); replyErr == nil {
+			return errors.Join(err, s.sendToClient(reply))
+		}
+		return err
+	}
+
+	s.invalidateTiles(prefix.EventType, msg[8:])
+	s.startTrace(prefix.EventType, prefix.RequestId, received)
 
 	handler, ok := handlerMap[prefix.EventType]
 	if !ok {
@@ -103,24 +308,138 @@ func (s *Session) HandleMessage(msg []byte) error {
 }
 
 func (s *Session) HandleDisconnect() {
-	// Close the client channel to signal the sender goroutine to stop
-	if s.clientSendChan != nil {
-		close(s.clientSendChan)
+	defer liveSessions.Add(-1)
+	unregister(s)
+	if s.Cancel != nil {
+		s.Cancel()
 	}
+	if s.leader != nil {
+		s.leader.removeFollower(s)
+	}
+	s.endFollowers()
+
+	// The workers are collected under the lock, but shut down without it, as the spawner may be slow to answer
+	s.mu.Lock()
+	s.closed = true
+	sharedWorker := s.sharedWorker
+	sharedInfo := s.Info
+	fileWorkers := maps.Clone(s.fileMap)
+	s.mu.Unlock()
 
-	if s.Info.WorkerId == "" {
+	// Close the client queue to signal the sender goroutine to stop
+	if s.clientQueue != nil {
+		s.clientQueue.close()
+	}
+
+	// File workers are owned by this session as well, so they need to be shut down alongside the shared worker. Files
+	// may share a worker, and may be open in the shared worker itself
+	shutDown := map[*SessionWorker]bool{sharedWorker: true}
+	for fileId, fileWorker := range fileWorkers {
+		if shutDown[fileWorker] {
+			continue
+		}
+		shutDown[fileWorker] = true
+		fileWorker.disconnect()
+		if fileWorker.info.WorkerId == "" {
+			continue
+		}
+		err := spawnerHelpers.RequestWorkerShutdown(fileWorker.info.WorkerId, s.SpawnerAddress)
+		if err != nil {
+			slog.Error("Error shutting down file worker", "fileId", fileId, "error", err)
+		}
+		slog.Info("Shut down file worker", "fileId", fileId, "workerId", fileWorker.info.WorkerId)
+	}
+
+	defer s.recorder.close()
+	s.tileCache.clear()
+
+	if sharedInfo.WorkerId == "" {
 		return
 	}
 
 	// Close the worker channel to signal the sender goroutine to stop
-	if s.sharedWorker != nil {
-		s.sharedWorker.disconnect()
+	if sharedWorker != nil {
+		sharedWorker.disconnect()
 	}
 
-	err := spawnerHelpers.RequestWorkerShutdown(s.Info.WorkerId, s.SpawnerAddress)
+	err := spawnerHelpers.RequestWorkerShutdown(sharedInfo.WorkerId, s.SpawnerAddress)
 	if err != nil {
 		slog.Error("Error shutting down worker", "error", err)
 	}
-	slog.Info("Shut down worker", "workerId", s.Info.WorkerId)
+	slog.Info("Shut down worker", "workerId", sharedInfo.WorkerId)
+
+}
 
+// checkIcdVersion ensures that the client uses an accepted ICD version, and the same version for every message.
+// Clients using any other version are sent an explicit error in the version they used.
+func (s *Session) checkIcdVersion(prefix cartaHelpers.MessagePrefix) error {
+	var message string
+	s.mu.Lock()
+	switch {
+	case !slices.Contains(acceptedClientIcdVersions(), prefix.IcdVersion):
+		message = fmt.Sprintf("ICD version %d is not supported by this server, supported versions are %v", prefix.IcdVersion, acceptedClientIcdVersions())
+	case s.clientIcdVersion == 0:
+		s.clientIcdVersion = prefix.IcdVersion
+	case s.clientIcdVersion != prefix.IcdVersion:
+		message = fmt.Sprintf("ICD version %d does not match the version %d used to register", prefix.IcdVersion, s.clientIcdVersion)
+	}
+	s.mu.Unlock()
+	if message == "" {
+		return nil
+	}
+
+	var response []byte
+	var err error
+	if prefix.EventType == cartaDefinitions.EventType_REGISTER_VIEWER {
+		response, err = prepareVersionedMessage(&cartaDefinitions.RegisterViewerAck{
+			Success: false,
+			Message: message,
+		}, cartaDefinitions.EventType_REGISTER_VIEWER_ACK, prefix.IcdVersion, prefix.RequestId)
+	} else {
+		response, err = prepareVersionedMessage(&cartaDefinitions.ErrorData{
+			Severity: cartaDefinitions.ErrorSeverity_ERROR,
+			Tags:     []string{"icd"},
+			Message:  message,
+		}, cartaDefinitions.EventType_ERROR_DATA, prefix.IcdVersion, prefix.RequestId)
+	}
+	if err == nil {
+		err = s.sendToClient(response)
+	}
+	if err != nil {
+		slog.Warn("Failed to notify client of ICD version mismatch", "sessionId", s.ID, "error", err)
+	}
+	return fmt.Errorf("rejected message with ICD version %d: %s", prefix.IcdVersion, message)
+}
+
+// prepareClientMessage frames a message generated by the controller in the client's ICD version
+func (s *Session) prepareClientMessage(msg proto.Message, eventType cartaDefinitions.EventType, requestId uint32) ([]byte, error) {
+	s.mu.Lock()
+	version := s.clientIcdVersion
+	s.mu.Unlock()
+	if version == 0 {
+		version = cartaHelpers.IcdVersion
+	}
+	return prepareVersionedMessage(msg, eventType, version, requestId)
+}
+
+// prepareVersionedMessage frames a message generated by the controller in the given ICD version. Messages are
+// translated where a shim exists, and otherwise sent as-is, as the messages the controller generates (ACKs and
+// ERROR_DATA) are expected to be stable across versions.
+func prepareVersionedMessage(msg proto.Message, eventType cartaDefinitions.EventType, version uint16, requestId uint32) ([]byte, error) {
+	message, err := cartaHelpers.PrepareMessagePayload(msg, eventType, requestId)
+	if err != nil {
+		return nil, err
+	}
+	if translated, err := translateMessage(message, cartaHelpers.IcdVersion, version); err == nil {
+		return translated, nil
+	}
+	return cartaHelpers.PrepareVersionedBinaryMessage(message[8:], eventType, version, requestId), nil
+}
+
+// sendToClient queues a message for the client, failing if the session has closed or the message was dropped
+func (s *Session) sendToClient(msg []byte) error {
+	if s.clientQueue == nil || !s.clientQueue.push(msg) {
+		return fmt.Errorf("session is closed")
+	}
+	return nil
 }
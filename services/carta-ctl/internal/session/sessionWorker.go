@@ -1,41 +1,222 @@
 package session
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
-	"google.golang.org/protobuf/proto"
 
+	"github.com/CARTAvis/go-carta/pkg/capture"
 	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
 	helpers "github.com/CARTAvis/go-carta/pkg/shared"
-	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/cartaHelpers"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
 )
 
 type SessionWorker struct {
-	fileRequest    *cartaDefinitions.OpenFile
-	requestId      uint32
-	conn           *websocket.Conn
-	sendChan       chan []byte
-	clientSendChan chan []byte
+	info        spawnerHelpers.WorkerInfo
+	fileRequest *cartaDefinitions.OpenFile
+	requestId   uint32
+	conn        *websocket.Conn
+	sendQueue   *sendQueue
+	clientQueue *sendQueue
+	recorder    *recorder
+	tileCache   *tileCache
+	// ICD versions used by the worker and by the client it serves. Messages are translated between them if they differ
+	icdVersion       uint16
+	clientIcdVersion uint16
+
+	// onDisconnect is called when the worker connection drops without the session having closed it
+	onDisconnect func(*SessionWorker, error)
+	// fanOut is called with each message from the worker after it has been queued for the client
+	fanOut func(message []byte)
+	// state holds the messages to replay into a replacement if the worker crashes, and recoveries counts how many
+	// crashed workers this one has replaced so far. recovering is closed once a crashed worker has been replaced, and
+	// restarting is set when the user asked for the worker to be replaced. Both are guarded by the session's mu
+	state      *replayState
+	recoveries int
+	recovering chan struct{}
+	restarting bool
+	// inFlight holds the requests sent to the worker that it hasn't answered yet, by request ID, so that they can be
+	// failed if the worker is lost
+	inFlightMu sync.Mutex
+	inFlight   map[uint32]inFlightRequest
+
+	done           chan struct{}
+	disconnectOnce sync.Once
+}
+
+type inFlightRequest struct {
+	eventType cartaDefinitions.EventType
+	fileId    int32
+}
+
+func (sw *SessionWorker) name() string {
+	if sw.fileRequest != nil {
+		return fmt.Sprintf("worker:%d", sw.fileRequest.FileId)
+	}
+	return "shared-worker"
 }
 
-func (sw *SessionWorker) proxyMessageToWorker(msg proto.Message, eventType cartaDefinitions.EventType, requestId uint32) error {
-	byteData, err := cartaHelpers.PrepareMessagePayload(msg, eventType, requestId)
+// proxyMessageToWorker queues a message body received from the client for the worker, translating it to the worker's
+// ICD version if necessary
+func (sw *SessionWorker) proxyMessageToWorker(eventType cartaDefinitions.EventType, requestId uint32, body []byte) error {
+	message := cartaHelpers.PrepareVersionedBinaryMessage(body, eventType, sw.clientIcdVersion, requestId)
+	message, err := translateMessage(message, sw.clientIcdVersion, sw.icdVersion)
 	if err != nil {
 		return err
 	}
 
 	slog.Debug("Proxying message from session to worker", "eventType", eventType)
-	sw.sendChan <- byteData
+	// Requests are in flight as soon as they are queued, as the worker may crash before the push returns
+	tracked := requestId != 0 && len(responseEventTypes(eventType)) > 0
+	if tracked {
+		fileId, _ := cartaHelpers.PeekFileId(eventType, body)
+		sw.inFlightMu.Lock()
+		if sw.inFlight == nil {
+			sw.inFlight = make(map[uint32]inFlightRequest)
+		}
+		sw.inFlight[requestId] = inFlightRequest{eventType: eventType, fileId: fileId}
+		sw.inFlightMu.Unlock()
+	}
+	if !sw.sendQueue.push(message) {
+		if tracked {
+			sw.inFlightMu.Lock()
+			delete(sw.inFlight, requestId)
+			sw.inFlightMu.Unlock()
+		}
+		return fmt.Errorf("worker connection is closed")
+	}
 	return nil
 }
 
+// answered removes the request that a message from the worker responds to from the requests in flight
+func (sw *SessionWorker) answered(prefix cartaHelpers.MessagePrefix) {
+	if prefix.RequestId == 0 {
+		return
+	}
+	sw.inFlightMu.Lock()
+	defer sw.inFlightMu.Unlock()
+	if r, ok := sw.inFlight[prefix.RequestId]; ok && slices.Contains(responseEventTypes(r.eventType), prefix.EventType) {
+		delete(sw.inFlight, prefix.RequestId)
+	}
+}
+
+// takeInFlight returns the requests that the worker hasn't answered, and stops tracking them
+func (sw *SessionWorker) takeInFlight() map[uint32]inFlightRequest {
+	sw.inFlightMu.Lock()
+	defer sw.inFlightMu.Unlock()
+	requests := sw.inFlight
+	sw.inFlight = nil
+	return requests
+}
+
+// register sends the client's REGISTER_VIEWER message to a newly connected worker and waits for the acknowledgement,
+// trying each candidate ICD version in turn. The version that the worker answers with is used for all further
+// messages to and from it. The acknowledgement is returned translated to the client's version. register must be
+// called before handleInit starts the worker's read loop. If registration fails, the connection is closed.
+func (sw *SessionWorker) register(ctx context.Context, body []byte, requestId uint32) (_ []byte, err error) {
+	// probing is the version of the latest registration sent, as a worker may still answer an earlier one late
+	var probing atomic.Uint32
+	acks := make(chan []byte, 1)
+	readErr := make(chan error, 1)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			messageType, message, err := sw.conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			prefix, err := cartaHelpers.DecodeMessagePrefix(message)
+			if err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+				slog.Warn("Ignoring malformed message from worker during registration", "workerName", sw.name(), "error", err)
+				continue
+			}
+			if prefix.EventType != cartaDefinitions.EventType_REGISTER_VIEWER_ACK {
+				slog.Warn("Ignoring message from worker during registration", "workerName", sw.name(), "eventType", prefix.EventType)
+				continue
+			}
+			sw.recorder.record(capture.WorkerToController, sw.name(), message)
+			countMessage(capture.WorkerToController, message)
+			if uint32(prefix.IcdVersion) != probing.Load() {
+				slog.Warn("Ignoring late registration acknowledgement from worker", "workerName", sw.name(), "icdVersion", prefix.IcdVersion)
+				continue
+			}
+			acks <- message
+			return
+		}
+	}()
+	// Only one goroutine may read from the connection, so the reader is stopped before the worker's read loop could
+	// be started. It only stops by itself once it has read the acknowledgement.
+	defer func() {
+		if err != nil {
+			helpers.CloseOrLog(sw.conn)
+			<-readerDone
+		}
+	}()
+
+	candidates := workerIcdCandidates(sw.clientIcdVersion)
+	for _, version := range candidates {
+		message := cartaHelpers.PrepareVersionedBinaryMessage(body, cartaDefinitions.EventType_REGISTER_VIEWER, sw.clientIcdVersion, requestId)
+		message, err := translateMessage(message, sw.clientIcdVersion, version)
+		if err != nil {
+			return nil, err
+		}
+		probing.Store(uint32(version))
+		if err := sw.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+			return nil, fmt.Errorf("error registering with worker: %w", err)
+		}
+		sw.recorder.record(capture.ControllerToWorker, sw.name(), message)
+		countMessage(capture.ControllerToWorker, message)
+
+		var timeout <-chan time.Time
+		if settings.WorkerRegisterTimeout > 0 {
+			timeout = time.After(settings.WorkerRegisterTimeout)
+		}
+		select {
+		case ack := <-acks:
+			prefix, _ := cartaHelpers.DecodeMessagePrefix(ack)
+			sw.icdVersion = prefix.IcdVersion
+			if sw.icdVersion != sw.clientIcdVersion {
+				slog.Info("Translating between client and worker ICD versions", "workerName", sw.name(), "clientVersion", sw.clientIcdVersion, "workerVersion", sw.icdVersion)
+			}
+			return translateMessage(ack, sw.icdVersion, sw.clientIcdVersion)
+		case err := <-readErr:
+			return nil, fmt.Errorf("error registering with worker: %w", err)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			slog.Debug("Worker did not acknowledge registration", "workerName", sw.name(), "icdVersion", version)
+		}
+	}
+	return nil, fmt.Errorf("worker did not acknowledge registration with ICD versions %v", candidates)
+}
+
 func (sw *SessionWorker) workerMessageHandler() {
 	for {
 		messageType, message, err := sw.conn.ReadMessage()
 		if err != nil {
-			slog.Error("Error reading message from worker", "error", err)
+			select {
+			case <-sw.done:
+				// The session closed the connection itself, so this is expected
+				slog.Debug("Worker connection closed", "workerName", sw.name())
+			default:
+				slog.Error("Error reading message from worker", "workerName", sw.name(), "error", err)
+				if sw.onDisconnect != nil {
+					sw.onDisconnect(sw, err)
+				}
+			}
 			break
 		}
 
@@ -54,64 +235,81 @@ func (sw *SessionWorker) workerMessageHandler() {
 			slog.Warn("Ignoring non-binary message", "messageType", messageType, "message", string(message))
 			continue
 		}
+		sw.recorder.record(capture.WorkerToController, sw.name(), message)
+		countMessage(capture.WorkerToController, message)
+		// Tiles are stamped in the order that the worker sent them, as they are handled concurrently from here on.
+		// Answered requests are removed here too, so that none are still in flight once the connection drops.
+		generation := sw.tileCache.stamp(message)
+		if prefix, err := cartaHelpers.DecodeMessagePrefix(message); err == nil || errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+			sw.answered(prefix)
+		}
 
 		go func() {
 			prefix, err := cartaHelpers.DecodeMessagePrefix(message)
-			if err != nil {
+			if err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
 				slog.Error("failed to unmarshal message", "error", err)
 				return
 			}
-			if prefix.IcdVersion != cartaHelpers.IcdVersion {
-				slog.Error("invalid ICD version", "version", prefix.IcdVersion)
+			if prefix.IcdVersion != sw.icdVersion {
+				slog.Error("invalid ICD version", "version", prefix.IcdVersion, "expected", sw.icdVersion)
 				return
 			}
-			slog.Debug("Received message from worker", "eventType", prefix.EventType)
-
-			var workerName string
-			if sw.fileRequest != nil {
-				workerName = fmt.Sprintf("worker:%d", sw.fileRequest.FileId)
-			} else {
-				workerName = "shared-worker"
-			}
 
-			// Special case for register viewer: send the open file payload once the worker is ready
+			slog.Debug("Received message from worker", "eventType", prefix.EventType, "workerName", sw.name())
 
-			slog.Debug("Received message from worker", "eventType", prefix.EventType, "workerName", workerName, "hasFileRequest", sw.fileRequest != nil)
-
-			if sw.fileRequest != nil && prefix.EventType == cartaDefinitions.EventType_REGISTER_VIEWER_ACK {
-				slog.Debug("Proxying OPEN_FILE message to worker after REGISTER_VIEWER_ACK", "workerName", workerName)
-				err = sw.proxyMessageToWorker(sw.fileRequest, cartaDefinitions.EventType_OPEN_FILE, sw.requestId)
-				if err != nil {
-					slog.Error("Error proxying open file message to worker", "error", err)
-				}
-			} else {
-				// TODO: We will often need to adjust responses here
-				// Pass the incoming message along to the client
-				sw.clientSendChan <- message
+			// TODO: We will often need to adjust responses here
+			// Pass the incoming message along to the client
+			message, err := translateMessage(message, sw.icdVersion, sw.clientIcdVersion)
+			if err != nil {
+				slog.Error("Error translating message from worker", "workerName", sw.name(), "error", err)
+				return
+			}
+			sw.state.observe(prefix.EventType, prefix.RequestId, message[8:])
+			sw.tileCache.observe(prefix.EventType, message[8:], generation)
+			sw.clientQueue.push(message)
+			// Responses to requests the controller made itself are only for the controller
+			if sw.fanOut != nil && prefix.RequestId < scriptRequestIdBase {
+				sw.fanOut(message)
 			}
 		}()
 	}
 }
 
 func (sw *SessionWorker) handleInit() {
-	sw.sendChan = make(chan []byte, 100)
-	// Start up the message sender and proxy handler
-	var workerName string
-	if sw.fileRequest != nil {
-		workerName = fmt.Sprintf("worker:%d", sw.fileRequest.FileId)
-	} else {
-		workerName = "shared-worker"
+	workerName := sw.name()
+	sw.sendQueue = newSendQueue(workerName, "worker")
+	sw.sendQueue.onStuck = func(reason string) {
+		select {
+		case <-sw.done:
+			// Writes fail as expected once the session has closed the connection itself
+			return
+		default:
+		}
+		if sw.onDisconnect != nil {
+			sw.onDisconnect(sw, fmt.Errorf("worker is not keeping up: %s", reason))
+		}
 	}
-
-	go sendHandler(sw.sendChan, sw.conn, workerName)
+	sw.sendQueue.onSent = func(data []byte) {
+		countMessage(capture.ControllerToWorker, data)
+		sw.recorder.record(capture.ControllerToWorker, workerName, data)
+	}
+	sw.done = make(chan struct{})
+	// Start up the message sender, heartbeat and proxy handler
+	go sendHandler(sw.sendQueue, sw.conn)
+	startHeartbeat(sw.conn, workerName, sw.done)
 	go sw.workerMessageHandler()
 }
 
 func (sw *SessionWorker) disconnect() {
-	if sw.conn != nil {
-		helpers.CloseOrLog(sw.conn)
-	}
-	if sw.sendChan != nil {
-		close(sw.sendChan)
-	}
+	sw.disconnectOnce.Do(func() {
+		if sw.done != nil {
+			close(sw.done)
+		}
+		if sw.conn != nil {
+			helpers.CloseOrLog(sw.conn)
+		}
+		if sw.sendQueue != nil {
+			sw.sendQueue.close()
+		}
+	})
 }
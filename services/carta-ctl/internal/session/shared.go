@@ -4,37 +4,64 @@ import (
 	"fmt"
 	"log/slog"
 
-	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
-	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/cartaHelpers"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
 )
 
-func sendHandler(channel <-chan []byte, conn *websocket.Conn, name string) {
-	slog.Debug("Starting send handler", "name", name, "channel", fmt.Sprintf("%p", channel))
-	for byteData := range channel {
-		err := conn.WriteMessage(websocket.BinaryMessage, byteData)
-		if err != nil {
-			slog.Error("Error sending message", "name", name, "channel", fmt.Sprintf("%p", channel), "error", err)
-			// Continue processing other messages even if one fails
+// handleProxiedMessage proxies unhandled messages to the appropriate worker.
+// It reads the fileId from the message (if present) and routes to the corresponding worker.
+func (s *Session) handleProxiedMessage(eventType cartaDefinitions.EventType, requestId uint32, bytes []byte) error {
+	// Read the fileId straight from the wire format, as this runs for every message, including high-rate cursor and
+	// tile requests. Handlers that need the rest of the message un-marshal it themselves
+	fileId, hasFileId := cartaHelpers.PeekFileId(eventType, bytes)
+
+	targetWorker, workerName, recovering := s.routeMessage(fileId, hasFileId)
+	if recovering != nil {
+		// Messages for a worker that is being replaced wait for the replacement, so that they apply on top of the
+		// replayed state
+		select {
+		case <-recovering:
+		case <-s.Context.Done():
+			return fmt.Errorf("session is closed")
 		}
+		targetWorker, workerName, _ = s.routeMessage(fileId, hasFileId)
 	}
-	slog.Debug("Send handler exiting", "name", name)
-}
 
-// handleProxiedMessage proxies unhandled messages to the appropriate worker.
-// It extracts the fileId from the message (if present) and routes to the corresponding worker.
-func (s *Session) handleProxiedMessage(eventType cartaDefinitions.EventType, requestId uint32, bytes []byte) error {
-	messageBytes := cartaHelpers.PrepareBinaryMessage(bytes, eventType, requestId)
+	slog.Debug("Proxying message from client to worker", "eventType", eventType, "workerName", workerName)
 
-	// Try to extract fileId from the message
-	fileId, hasFileId := cartaHelpers.ExtractFileIdFromBytes(eventType, bytes)
+	if targetWorker == nil {
+		return fmt.Errorf("no worker available to handle message")
+	}
 
-	// Determine which worker to send the message to
+	if eventType == cartaDefinitions.EventType_SET_IMAGE_CHANNELS {
+		s.dropSupersededTiles(bytes)
+	}
+
+	forward, cached := s.checkTileCache(eventType, bytes)
+	if forward != nil {
+		if err := targetWorker.proxyMessageToWorker(eventType, requestId, forward); err != nil {
+			return err
+		}
+	}
+	// The original message is recorded, so that a replacement worker renders the tiles that the cache answered for
+	s.recordState(targetWorker, eventType, requestId, bytes)
+	if cached != nil {
+		return s.sendCachedTiles(cached)
+	}
+	return nil
+}
+
+// routeMessage determines which worker to send a message to, and returns the worker's recovering channel if it
+// crashed and is being replaced
+func (s *Session) routeMessage(fileId int32, hasFileId bool) (*SessionWorker, string, chan struct{}) {
 	var targetWorker *SessionWorker
 	var workerName string
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if hasFileId && s.fileMap != nil {
 		// Check if we have a worker for this fileId
 		if worker, exists := s.fileMap[fileId]; exists {
@@ -50,15 +77,23 @@ func (s *Session) handleProxiedMessage(eventType cartaDefinitions.EventType, req
 		targetWorker = s.sharedWorker
 		workerName = "shared-worker"
 	}
-
-	slog.Debug("Proxying message from client to worker", "eventType", eventType, "workerName", workerName)
-
 	if targetWorker == nil {
-		return fmt.Errorf("no worker available to handle message")
+		return nil, workerName, nil
 	}
+	return targetWorker, workerName, targetWorker.recovering
+}
 
-	targetWorker.sendChan <- messageBytes
-	return nil
+// dropSupersededTiles discards queued raster tiles that the client no longer needs after switching channels
+func (s *Session) dropSupersededTiles(rawMsg []byte) {
+	var payload cartaDefinitions.SetImageChannels
+	if err := proto.Unmarshal(rawMsg, &payload); err != nil {
+		return
+	}
+	s.clientQueue.dropSupersededTiles(tileChannel{
+		fileId:  payload.FileId,
+		channel: payload.Channel,
+		stokes:  payload.Stokes,
+	})
 }
 
 func (s *Session) handleStatusMessage(_ cartaDefinitions.EventType, _ uint32, _ []byte) error {
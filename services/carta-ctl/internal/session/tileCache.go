@@ -0,0 +1,422 @@
+package session
+
+import (
+	"container/list"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
+)
+
+var (
+	tileCacheRequests = metrics.NewCounterVec("carta_tile_cache_requests_total", "Number of tile requests checked against the tile cache", "result")
+	tileCacheBytes    = metrics.NewGaugeVec("carta_tile_cache_bytes", "Number of bytes of tile data held by the tile caches of all sessions")
+)
+
+// tileCacheTotal is the number of bytes held by the tile caches of all sessions, for enforcing the overall limit
+var tileCacheTotal atomic.Int64
+
+// tileInvalidatingEvents lists the client messages that change what a file ID's tiles look like. Channel, Stokes and
+// compression settings are part of the cache key, so only replacing or closing the file invalidates its tiles.
+var tileInvalidatingEvents = map[cartaDefinitions.EventType]bool{
+	cartaDefinitions.EventType_OPEN_FILE:  true,
+	cartaDefinitions.EventType_CLOSE_FILE: true,
+}
+
+// imageOpeningEvents lists the worker messages that open images, whether the client asked for them with OPEN_FILE or
+// the worker generated them, as for moment and PV images. Each image they open starts a new generation of tiles for
+// its file ID.
+var imageOpeningEvents = map[cartaDefinitions.EventType]bool{
+	cartaDefinitions.EventType_OPEN_FILE_ACK:           true,
+	cartaDefinitions.EventType_CONCAT_STOKES_FILES_ACK: true,
+	cartaDefinitions.EventType_MOMENT_RESPONSE:         true,
+	cartaDefinitions.EventType_PV_RESPONSE:             true,
+	cartaDefinitions.EventType_FITTING_RESPONSE:        true,
+}
+
+// tilePlane is the image plane that the client currently views for a file
+type tilePlane struct {
+	channel int32
+	stokes  int32
+}
+
+type tileKey struct {
+	fileId int32
+	// generation counts the images that have been opened with the file ID, so that tiles of an earlier image are
+	// never served for a later one
+	generation  uint64
+	plane       tilePlane
+	compression cartaDefinitions.CompressionType
+	quality     float32
+	// encoded is the tile's coordinates, encoded as in tile requests
+	encoded int32
+}
+
+type tileEntry struct {
+	key  tileKey
+	tile *cartaDefinitions.TileData
+	size int
+}
+
+// tileCache is a least-recently-used cache of the raster tiles that a session's workers have sent. Tile requests
+// that it holds every tile for are answered without the worker.
+type tileCache struct {
+	maxBytes int
+
+	mu      sync.Mutex
+	bytes   int
+	order   *list.List
+	entries map[tileKey]*list.Element
+	// planes and syncIds track, per file, the plane that the client last selected and the last sync ID that the
+	// worker used, for answering tile requests
+	planes      map[int32]tilePlane
+	syncIds     map[int32]uint32
+	generations map[int32]uint64
+}
+
+// newTileCache returns nil if tile caching is disabled
+func newTileCache() *tileCache {
+	if settings.TileCache.SessionBytes <= 0 {
+		return nil
+	}
+	return &tileCache{
+		maxBytes:    settings.TileCache.SessionBytes,
+		order:       list.New(),
+		entries:     make(map[tileKey]*list.Element),
+		planes:      make(map[int32]tilePlane),
+		syncIds:     make(map[int32]uint32),
+		generations: make(map[int32]uint64),
+	}
+}
+
+// encodeTile packs tile coordinates the same way as tile requests do: (layer << 24) | (y << 12) | x
+func encodeTile(tile *cartaDefinitions.TileData) int32 {
+	return tile.Layer<<24 | tile.Y<<12 | tile.X
+}
+
+// stamp is called with each message from a worker in the order that the worker sent them, before the messages are
+// handled concurrently. Messages that open images start a new generation of tiles for their file IDs, and tile data
+// is stamped with the current generation of its file. Tiles of a replaced image that are still being handled when
+// the new image is opened are then not cached for it.
+func (c *tileCache) stamp(message []byte) uint64 {
+	if c == nil {
+		return 0
+	}
+	prefix, err := cartaHelpers.DecodeMessagePrefix(message)
+	if err != nil && !errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+		return 0
+	}
+	body := message[8:]
+
+	switch {
+	case prefix.EventType == cartaDefinitions.EventType_RASTER_TILE_DATA:
+		fileId, _, _, ok := cartaHelpers.PeekRasterTileChannel(body)
+		if !ok {
+			return 0
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.generations[fileId]
+	case imageOpeningEvents[prefix.EventType]:
+		msg, err := cartaHelpers.UnmarshalMessage(prefix.EventType, body)
+		if err != nil {
+			return 0
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, ack := range openFileAcks(msg) {
+			c.generations[ack.FileId]++
+			c.dropFile(ack.FileId)
+		}
+	}
+	return 0
+}
+
+// openFileAcks returns the acknowledgements of the images that a message opens, which may be the message itself or
+// nested in it
+func openFileAcks(msg proto.Message) []*cartaDefinitions.OpenFileAck {
+	if ack, ok := msg.(*cartaDefinitions.OpenFileAck); ok {
+		return []*cartaDefinitions.OpenFileAck{ack}
+	}
+	ackName := (*cartaDefinitions.OpenFileAck)(nil).ProtoReflect().Descriptor().FullName()
+	var acks []*cartaDefinitions.OpenFileAck
+	msg.ProtoReflect().Range(func(field protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if field.IsMap() || field.Message() == nil || field.Message().FullName() != ackName {
+			return true
+		}
+		if field.IsList() {
+			for i := 0; i < v.List().Len(); i++ {
+				acks = append(acks, v.List().Get(i).Message().Interface().(*cartaDefinitions.OpenFileAck))
+			}
+		} else {
+			acks = append(acks, v.Message().Interface().(*cartaDefinitions.OpenFileAck))
+		}
+		return true
+	})
+	return acks
+}
+
+// observe adds the tiles in messages from the worker to the cache, if they belong to the generation that they were
+// stamped with. Messages are in the client's ICD version.
+func (c *tileCache) observe(eventType cartaDefinitions.EventType, body []byte, generation uint64) {
+	if c == nil {
+		return
+	}
+	switch eventType {
+	case cartaDefinitions.EventType_RASTER_TILE_SYNC:
+		var sync cartaDefinitions.RasterTileSync
+		if err := proto.Unmarshal(body, &sync); err != nil {
+			return
+		}
+		c.mu.Lock()
+		c.syncIds[sync.FileId] = sync.SyncId
+		c.mu.Unlock()
+	case cartaDefinitions.EventType_RASTER_TILE_DATA:
+		var data cartaDefinitions.RasterTileData
+		if err := proto.Unmarshal(body, &data); err != nil {
+			slog.Debug("Not caching malformed raster tile data", "error", err)
+			return
+		}
+		for _, tile := range data.Tiles {
+			c.put(tileKey{
+				fileId:      data.FileId,
+				generation:  generation,
+				plane:       tilePlane{channel: data.Channel, stokes: data.Stokes},
+				compression: data.CompressionType,
+				quality:     data.CompressionQuality,
+				encoded:     encodeTile(tile),
+			}, tile)
+		}
+	}
+}
+
+func (c *tileCache) put(key tileKey, tile *cartaDefinitions.TileData) {
+	size := len(tile.ImageData) + len(tile.NanEncodings)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key.generation != c.generations[key.fileId] {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+	c.entries[key] = c.order.PushFront(&tileEntry{key: key, tile: tile, size: size})
+	c.add(size)
+
+	// Only the session's own tiles are evicted to stay under the overall limit, so sessions never affect each
+	// other's caches directly
+	for c.order.Len() > 0 && (c.bytes > c.maxBytes || (settings.TileCache.TotalBytes > 0 && tileCacheTotal.Load() > int64(settings.TileCache.TotalBytes))) {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// removeElement drops an entry from the cache. The caller must hold c.mu.
+func (c *tileCache) removeElement(element *list.Element) {
+	entry := c.order.Remove(element).(*tileEntry)
+	delete(c.entries, entry.key)
+	c.add(-entry.size)
+}
+
+// add updates the size accounting. The caller must hold c.mu.
+func (c *tileCache) add(size int) {
+	c.bytes += size
+	tileCacheTotal.Add(int64(size))
+	tileCacheBytes.WithLabelValues().Add(float64(size))
+}
+
+// setPlane records the plane that the client selected for a file
+func (c *tileCache) setPlane(fileId int32, plane tilePlane) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.planes[fileId] = plane
+}
+
+// cachedTiles is the answer to a tile request from the cache
+type cachedTiles struct {
+	fileId      int32
+	plane       tilePlane
+	compression cartaDefinitions.CompressionType
+	quality     float32
+	syncId      uint32
+	tiles       []*cartaDefinitions.TileData
+}
+
+// lookup returns the tiles for a request in the file's current plane. It only succeeds if every requested tile is
+// cached, as the client expects all of the tiles that it asked for to arrive between one pair of sync messages.
+func (c *tileCache) lookup(req *cartaDefinitions.AddRequiredTiles) (cachedTiles, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	plane, ok := c.planes[req.FileId]
+	if !ok || len(req.Tiles) == 0 {
+		return cachedTiles{}, false
+	}
+
+	result := cachedTiles{
+		fileId:      req.FileId,
+		plane:       plane,
+		compression: req.CompressionType,
+		quality:     req.CompressionQuality,
+		syncId:      c.syncIds[req.FileId],
+		tiles:       make([]*cartaDefinitions.TileData, 0, len(req.Tiles)),
+	}
+	elements := make([]*list.Element, 0, len(req.Tiles))
+	for _, encoded := range req.Tiles {
+		key := tileKey{
+			fileId:      req.FileId,
+			generation:  c.generations[req.FileId],
+			plane:       plane,
+			compression: req.CompressionType,
+			quality:     req.CompressionQuality,
+			encoded:     encoded,
+		}
+		element, ok := c.entries[key]
+		if !ok {
+			tileCacheRequests.WithLabelValues("miss").Inc()
+			return cachedTiles{}, false
+		}
+		elements = append(elements, element)
+	}
+	for _, element := range elements {
+		c.order.MoveToFront(element)
+		result.tiles = append(result.tiles, element.Value.(*tileEntry).tile)
+	}
+	tileCacheRequests.WithLabelValues("hit").Inc()
+	return result, true
+}
+
+// invalidateFile drops the cached tiles of a file, or of every file for allFiles
+func (c *tileCache) invalidateFile(fileId int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropFile(fileId)
+}
+
+// dropFile drops the cached tiles of a file, or of every file for allFiles. Generations are kept, as tiles of the
+// file's current generation may still arrive. The caller must hold c.mu.
+func (c *tileCache) dropFile(fileId int32) {
+	for key, element := range c.entries {
+		if fileId == allFiles || key.fileId == fileId {
+			c.removeElement(element)
+		}
+	}
+	if fileId == allFiles {
+		clear(c.planes)
+		clear(c.syncIds)
+	} else {
+		delete(c.planes, fileId)
+		delete(c.syncIds, fileId)
+	}
+}
+
+// clear empties the cache when the session ends
+func (c *tileCache) clear() {
+	if c == nil {
+		return
+	}
+	c.invalidateFile(allFiles)
+}
+
+// invalidateTiles drops the cached tiles of files that a message from the client replaces or closes
+func (s *Session) invalidateTiles(eventType cartaDefinitions.EventType, body []byte) {
+	if s.tileCache == nil || !tileInvalidatingEvents[eventType] {
+		return
+	}
+	if fileId, ok := cartaHelpers.PeekFileId(eventType, body); ok {
+		s.tileCache.invalidateFile(fileId)
+	}
+}
+
+// checkTileCache keeps track of the plane the client views, and answers tile requests from the cache where possible.
+// It returns the message body to forward to the worker, which is nil if the cache answered the message completely,
+// along with the tiles to send to the client once the message has been forwarded.
+func (s *Session) checkTileCache(eventType cartaDefinitions.EventType, body []byte) ([]byte, *cachedTiles) {
+	c := s.tileCache
+	if c == nil {
+		return body, nil
+	}
+
+	switch eventType {
+	case cartaDefinitions.EventType_ADD_REQUIRED_TILES:
+		var req cartaDefinitions.AddRequiredTiles
+		if err := proto.Unmarshal(body, &req); err != nil {
+			return body, nil
+		}
+		if tiles, ok := c.lookup(&req); ok {
+			return nil, &tiles
+		}
+	case cartaDefinitions.EventType_SET_IMAGE_CHANNELS:
+		var req cartaDefinitions.SetImageChannels
+		if err := proto.Unmarshal(body, &req); err != nil {
+			return body, nil
+		}
+		c.setPlane(req.FileId, tilePlane{channel: req.Channel, stokes: req.Stokes})
+		if req.RequiredTiles == nil {
+			return body, nil
+		}
+		tiles, ok := c.lookup(req.RequiredTiles)
+		if !ok {
+			return body, nil
+		}
+		// The worker still needs to switch channels, but not to render the tiles
+		req.RequiredTiles = nil
+		rewritten, err := proto.Marshal(&req)
+		if err != nil {
+			return body, nil
+		}
+		return rewritten, &tiles
+	}
+	return body, nil
+}
+
+// sendCachedTiles sends tiles from the cache to the client and its followers, framed by sync messages like the
+// worker's own responses
+func (s *Session) sendCachedTiles(tiles *cachedTiles) error {
+	sync := &cartaDefinitions.RasterTileSync{
+		FileId:    tiles.fileId,
+		Channel:   tiles.plane.channel,
+		Stokes:    tiles.plane.stokes,
+		SyncId:    tiles.syncId,
+		TileCount: int32(len(tiles.tiles)),
+	}
+	if err := s.sendToClientAndFollowers(sync, cartaDefinitions.EventType_RASTER_TILE_SYNC); err != nil {
+		return err
+	}
+	for _, tile := range tiles.tiles {
+		err := s.sendToClientAndFollowers(&cartaDefinitions.RasterTileData{
+			FileId:             tiles.fileId,
+			Channel:            tiles.plane.channel,
+			Stokes:             tiles.plane.stokes,
+			CompressionType:    tiles.compression,
+			CompressionQuality: tiles.quality,
+			SyncId:             tiles.syncId,
+			Tiles:              []*cartaDefinitions.TileData{tile},
+		}, cartaDefinitions.EventType_RASTER_TILE_DATA)
+		if err != nil {
+			return err
+		}
+	}
+	sync.EndSync = true
+	return s.sendToClientAndFollowers(sync, cartaDefinitions.EventType_RASTER_TILE_SYNC)
+}
+
+func (s *Session) sendToClientAndFollowers(msg proto.Message, eventType cartaDefinitions.EventType) error {
+	message, err := s.prepareClientMessage(msg, eventType, 0)
+	if err != nil {
+		return err
+	}
+	// Like tiles from the workers, cached tiles may be dropped if the client falls behind
+	s.clientQueue.push(message)
+	s.fanOut(message)
+	return nil
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/pkg/config"
+)
+
+// withTileCache enables tile caching with the given limits for the duration of a test, and returns a session's cache
+func withTileCache(t *testing.T, sessionBytes, totalBytes int) *tileCache {
+	t.Helper()
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+	settings.TileCache = config.TileCacheConfig{SessionBytes: sessionBytes, TotalBytes: totalBytes}
+	c := newTileCache()
+	t.Cleanup(c.clear)
+	return c
+}
+
+// tileMessage returns a framed RASTER_TILE_DATA message with one tile of the given size in channel 0
+func tileMessage(t *testing.T, fileId int32, x int32, size int) []byte {
+	t.Helper()
+	return framed(t, &cartaDefinitions.RasterTileData{
+		FileId: fileId,
+		Tiles:  []*cartaDefinitions.TileData{{X: x, ImageData: make([]byte, size)}},
+	}, cartaDefinitions.EventType_RASTER_TILE_DATA)
+}
+
+// receive passes a message from a worker through the cache as workerMessageHandler does
+func (c *tileCache) receive(message []byte) {
+	generation := c.stamp(message)
+	prefix, _ := cartaHelpers.DecodeMessagePrefix(message)
+	c.observe(prefix.EventType, message[8:], generation)
+}
+
+func cached(c *tileCache, fileId int32, xs ...int32) bool {
+	c.setPlane(fileId, tilePlane{})
+	_, ok := c.lookup(&cartaDefinitions.AddRequiredTiles{FileId: fileId, Tiles: xs})
+	return ok
+}
+
+func TestTileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := withTileCache(t, 300, 0)
+	for x := int32(1); x <= 3; x++ {
+		c.receive(tileMessage(t, 0, x, 100))
+	}
+	if !cached(c, 0, 1, 2, 3) {
+		t.Fatal("tiles within the limit are not all cached")
+	}
+
+	// Using tile 1 makes tile 2 the least recently used, so it is the one evicted for tile 4
+	cached(c, 0, 1)
+	c.receive(tileMessage(t, 0, 4, 100))
+	if cached(c, 0, 2) {
+		t.Error("least recently used tile was not evicted")
+	}
+	if !cached(c, 0, 1, 3, 4) {
+		t.Error("recently used tiles were evicted")
+	}
+	if c.bytes != 300 {
+		t.Errorf("cache holds %d bytes, want 300", c.bytes)
+	}
+}
+
+func TestTileCacheByteLimits(t *testing.T) {
+	c := withTileCache(t, 300, 0)
+	c.receive(tileMessage(t, 0, 1, 301))
+	if cached(c, 0, 1) || c.bytes != 0 {
+		t.Error("tile larger than the cache was cached")
+	}
+
+	// The overall limit applies to the caches of all sessions together, and each session only evicts its own tiles
+	other := newTileCache()
+	t.Cleanup(other.clear)
+	other.receive(tileMessage(t, 0, 1, 200))
+	settings.TileCache.TotalBytes = int(tileCacheTotal.Load()) + 150
+	c.receive(tileMessage(t, 0, 1, 100))
+	c.receive(tileMessage(t, 0, 2, 100))
+	if cached(c, 0, 1) || !cached(c, 0, 2) {
+		t.Error("session did not evict its own tiles to stay under the overall limit")
+	}
+	if !cached(other, 0, 1) {
+		t.Error("another session's tiles were evicted")
+	}
+}
+
+func TestTileCacheInvalidation(t *testing.T) {
+	c := withTileCache(t, 1000, 0)
+	c.receive(tileMessage(t, 0, 1, 10))
+	c.invalidateFile(0)
+	if cached(c, 0, 1) {
+		t.Error("tiles of a closed file are still cached")
+	}
+
+	// A tile of the old image that the worker sent before acknowledging the new one is still being handled
+	// when the acknowledgement arrives
+	stale := tileMessage(t, 0, 1, 10)
+	staleGeneration := c.stamp(stale)
+	c.stamp(framed(t, &cartaDefinitions.OpenFileAck{FileId: 0, Success: true}, cartaDefinitions.EventType_OPEN_FILE_ACK))
+	c.observe(cartaDefinitions.EventType_RASTER_TILE_DATA, stale[8:], staleGeneration)
+	if cached(c, 0, 1) {
+		t.Error("tile of the replaced image was cached for the new one")
+	}
+	c.receive(tileMessage(t, 0, 1, 10))
+	if !cached(c, 0, 1) {
+		t.Error("tile of the new image was not cached")
+	}
+}
+
+func TestTileCacheGeneratedImages(t *testing.T) {
+	c := withTileCache(t, 1000, 0)
+	for _, fileId := range []int32{1, 2, 3} {
+		c.receive(tileMessage(t, fileId, 1, 10))
+	}
+
+	// Moment and PV images are opened by the worker without an OPEN_FILE from the client, reusing file IDs
+	c.receive(framed(t, &cartaDefinitions.MomentResponse{Success: true, OpenFileAcks: []*cartaDefinitions.OpenFileAck{
+		{FileId: 1, Success: true}, {FileId: 2, Success: true},
+	}}, cartaDefinitions.EventType_MOMENT_RESPONSE))
+	if cached(c, 1, 1) || cached(c, 2, 1) {
+		t.Error("tiles of images replaced by moment images are still cached")
+	}
+	c.receive(framed(t, &cartaDefinitions.PvResponse{Success: true, OpenFileAck: &cartaDefinitions.OpenFileAck{FileId: 3, Success: true}}, cartaDefinitions.EventType_PV_RESPONSE))
+	if cached(c, 3, 1) {
+		t.Error("tiles of the image replaced by a PV image are still cached")
+	}
+
+	fitting := &cartaDefinitions.FittingResponse{
+		ModelImage:    &cartaDefinitions.OpenFileAck{FileId: 4},
+		ResidualImage: &cartaDefinitions.OpenFileAck{FileId: 5},
+	}
+	var fileIds []int32
+	for _, ack := range openFileAcks(fitting) {
+		fileIds = append(fileIds, ack.FileId)
+	}
+	if got := slices.Sorted(slices.Values(fileIds)); !slices.Equal(got, []int32{4, 5}) {
+		t.Errorf("file IDs opened by a fitting response = %v, want [4 5]", got)
+	}
+}
@@ -0,0 +1,91 @@
+package session
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
+)
+
+var requestDuration = metrics.NewHistogramVec("carta_request_duration_seconds", "Time from receiving a client request to queueing its response for the client", metrics.DefaultBuckets, "event_type")
+
+const (
+	// maxPendingRequests bounds the number of requests traced per session, as requests that are never answered
+	// would otherwise accumulate
+	maxPendingRequests = 1000
+	// Requests still unanswered after pendingRequestExpiry are no longer traced
+	pendingRequestExpiry = 10 * time.Minute
+)
+
+type pendingRequest struct {
+	eventType     cartaDefinitions.EventType
+	responseTypes []cartaDefinitions.EventType
+	start         time.Time
+}
+
+// requestTracer matches the requests that a session's client sends with their responses by request ID and event type,
+// such as OPEN_FILE with OPEN_FILE_ACK, to measure how long each request takes end to end
+type requestTracer struct {
+	mu      sync.Mutex
+	pending map[uint32]pendingRequest
+}
+
+func newRequestTracer() *requestTracer {
+	return &requestTracer{pending: make(map[uint32]pendingRequest)}
+}
+
+// startTrace starts timing a client request, if it is one that expects a response
+func (s *Session) startTrace(eventType cartaDefinitions.EventType, requestId uint32, received time.Time) {
+	t := s.tracer
+	if t == nil || requestId == 0 {
+		return
+	}
+	responseTypes := responseEventTypes(eventType)
+	if len(responseTypes) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPendingRequests {
+		for id, p := range t.pending {
+			if received.Sub(p.start) > pendingRequestExpiry {
+				delete(t.pending, id)
+			}
+		}
+		if len(t.pending) >= maxPendingRequests {
+			slog.Debug("Not tracing request, too many are pending", "sessionId", s.ID, "eventType", eventType, "requestId", requestId)
+			return
+		}
+	}
+	t.pending[requestId] = pendingRequest{eventType: eventType, responseTypes: responseTypes, start: received}
+}
+
+// finishTrace is called for each message queued for the client, and records the latency of the request that it
+// answers, if any
+func (s *Session) finishTrace(eventType cartaDefinitions.EventType, requestId uint32) {
+	t := s.tracer
+	if t == nil || requestId == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	p, ok := t.pending[requestId]
+	if !ok || !slices.Contains(p.responseTypes, eventType) {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.pending, requestId)
+	t.mu.Unlock()
+
+	elapsed := time.Since(p.start)
+	requestDuration.WithLabelValues(p.eventType.String()).Observe(elapsed.Seconds())
+	if settings.SlowRequestThreshold > 0 && elapsed > settings.SlowRequestThreshold {
+		slog.Warn("Slow request", "sessionId", s.ID, "user", s.User, "eventType", p.eventType, "responseType", eventType, "requestId", requestId, "duration", elapsed)
+	} else {
+		slog.Debug("Request completed", "sessionId", s.ID, "eventType", p.eventType, "responseType", eventType, "requestId", requestId, "duration", elapsed)
+	}
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+)
+
+func TestTracePairsRequestWithResponse(t *testing.T) {
+	s := &Session{tracer: newRequestTracer()}
+	now := time.Now()
+	s.startTrace(cartaDefinitions.EventType_OPEN_FILE, 7, now)
+	// Messages without a response and unsolicited messages aren't traced
+	s.startTrace(cartaDefinitions.EventType_SET_CURSOR, 8, now)
+	s.startTrace(cartaDefinitions.EventType_OPEN_FILE, 0, now)
+	if n := len(s.tracer.pending); n != 1 {
+		t.Fatalf("%d requests pending, want 1", n)
+	}
+
+	// A response of the wrong type for the same request ID, or the right type for another one, doesn't finish it
+	s.finishTrace(cartaDefinitions.EventType_REGION_HISTOGRAM_DATA, 7)
+	s.finishTrace(cartaDefinitions.EventType_OPEN_FILE_ACK, 9)
+	if _, ok := s.tracer.pending[7]; !ok {
+		t.Fatal("request finished by a message that doesn't answer it")
+	}
+
+	s.finishTrace(cartaDefinitions.EventType_OPEN_FILE_ACK, 7)
+	if _, ok := s.tracer.pending[7]; ok {
+		t.Fatal("request still pending after its response")
+	}
+}
+
+func TestTraceLimitsPendingRequests(t *testing.T) {
+	s := &Session{tracer: newRequestTracer()}
+	start := time.Now()
+	for id := uint32(1); id <= maxPendingRequests; id++ {
+		s.startTrace(cartaDefinitions.EventType_OPEN_FILE, id, start)
+	}
+
+	s.startTrace(cartaDefinitions.EventType_OPEN_FILE, maxPendingRequests+1, start.Add(time.Second))
+	if _, ok := s.tracer.pending[maxPendingRequests+1]; ok {
+		t.Fatal("traced a request beyond the limit")
+	}
+	if n := len(s.tracer.pending); n != maxPendingRequests {
+		t.Fatalf("%d requests pending, want %d", n, maxPendingRequests)
+	}
+
+	// Once the unanswered requests have expired, they make room for new ones
+	s.startTrace(cartaDefinitions.EventType_OPEN_FILE, maxPendingRequests+2, start.Add(pendingRequestExpiry+time.Second))
+	if _, ok := s.tracer.pending[maxPendingRequests+2]; !ok {
+		t.Fatal("request not traced after the pending requests expired")
+	}
+	if n := len(s.tracer.pending); n != 1 {
+		t.Errorf("%d requests pending, want only the new one", n)
+	}
+}
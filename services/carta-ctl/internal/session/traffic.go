@@ -0,0 +1,89 @@
+package session
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/CARTAvis/go-carta/pkg/capture"
+	"github.com/CARTAvis/go-carta/pkg/cartaHelpers"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
+)
+
+var (
+	messageCount = metrics.NewCounterVec("carta_messages_total", "Number of messages proxied between clients and workers", "direction", "event_type")
+	messageBytes = metrics.NewCounterVec("carta_message_bytes_total", "Number of bytes of messages proxied between clients and workers", "direction", "event_type")
+
+	_ = metrics.NewGaugeFunc("carta_sessions", "Number of live client sessions, including followers", func() float64 {
+		registry.RLock()
+		defer registry.RUnlock()
+		return float64(len(registry.sessions))
+	})
+	_ = metrics.NewGaugeFunc("carta_workers", "Number of workers connected to live sessions", func() float64 {
+		var n int
+		for _, s := range List() {
+			n += len(s.workers())
+		}
+		return float64(n)
+	})
+)
+
+// Metrics labelled by user name are only created if they are enabled, as every user adds its own series
+var (
+	userSessions *metrics.GaugeVec
+	userMessages *metrics.CounterVec
+)
+
+// userSessionCounts holds the number of sessions of each user, so that a user's series can be removed once they
+// have no sessions left
+var userSessionCounts = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// EnableUserMetrics starts recording metrics labelled by user name. It must be called before any sessions are created
+func EnableUserMetrics() {
+	userSessions = metrics.NewGaugeVec("carta_user_sessions", "Number of live client sessions by user", "user")
+	userMessages = metrics.NewCounterVec("carta_user_messages_total", "Number of messages received from clients by user", "user")
+}
+
+// countMessage records a framed message passing through the controller
+func countMessage(direction capture.Direction, msg []byte) {
+	eventType := "invalid"
+	if prefix, err := cartaHelpers.DecodeMessagePrefix(msg); err == nil || errors.Is(err, cartaHelpers.ErrUnsupportedIcdVersion) {
+		eventType = prefix.EventType.String()
+	}
+	messageCount.WithLabelValues(direction.String(), eventType).Inc()
+	messageBytes.WithLabelValues(direction.String(), eventType).Add(float64(len(msg)))
+}
+
+func (s *Session) username() string {
+	if s.User == nil {
+		return ""
+	}
+	return s.User.Username
+}
+
+// countUserSession adjusts the number of sessions of the session's user, if per-user metrics are enabled
+func (s *Session) countUserSession(delta int) {
+	if userSessions == nil {
+		return
+	}
+	name := s.username()
+
+	userSessionCounts.Lock()
+	defer userSessionCounts.Unlock()
+	n := userSessionCounts.counts[name] + delta
+	if n > 0 {
+		userSessionCounts.counts[name] = n
+		userSessions.WithLabelValues(name).Set(float64(n))
+		return
+	}
+	delete(userSessionCounts.counts, name)
+	userSessions.DeleteLabelValues(name)
+}
+
+func (s *Session) countUserMessage() {
+	if userMessages != nil {
+		userMessages.WithLabelValues(s.username()).Inc()
+	}
+}
@@ -0,0 +1,41 @@
+package session
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
+)
+
+// enableUserMetrics registers the per-user metrics the first time it is called, as metrics can only be registered
+// once per process, and enables them for the duration of a test
+var enableUserMetrics = sync.OnceValues(func() (*metrics.GaugeVec, *metrics.CounterVec) {
+	EnableUserMetrics()
+	return userSessions, userMessages
+})
+
+func TestUserSessionSeriesRemoved(t *testing.T) {
+	userSessions, userMessages = enableUserMetrics()
+	t.Cleanup(func() { userSessions, userMessages = nil, nil })
+
+	first := &Session{User: &auth.User{Username: "alice", Source: auth.SourcePAM}}
+	second := &Session{User: &auth.User{Username: "alice", Source: auth.SourcePAM}}
+
+	first.countUserSession(1)
+	second.countUserSession(1)
+	if got := userSessions.WithLabelValues("alice").Value(); got != 2 {
+		t.Errorf("carta_user_sessions{user=alice} = %v, want 2", got)
+	}
+
+	first.countUserSession(-1)
+	second.countUserSession(-1)
+	var out strings.Builder
+	if err := metrics.WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), `carta_user_sessions{user="alice"}`) {
+		t.Errorf("series for a user without sessions is still written:\n%s", out.String())
+	}
+}
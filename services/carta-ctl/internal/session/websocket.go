@@ -0,0 +1,74 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
+)
+
+// anyOrigin in the allowed origins list accepts WebSocket connections from every origin
+const anyOrigin = "*"
+
+// NewUpgrader creates the upgrader for client WebSocket connections, using the configured client WebSocket settings.
+// Browsers send an Origin header with every WebSocket handshake, which is checked against the allowed origins so that
+// other sites can't open sessions using the user's cookies. If no origins are allowed explicitly, only connections
+// from the same origin as the controller are accepted.
+func NewUpgrader(allowedOrigins []string) *websocket.Upgrader {
+	normalized := make([]string, 0, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		normalized = append(normalized, strings.ToLower(strings.TrimSuffix(origin, "/")))
+	}
+
+	return &websocket.Upgrader{
+		ReadBufferSize:    settings.ClientWebSocket.ReadBufferSize,
+		WriteBufferSize:   settings.ClientWebSocket.WriteBufferSize,
+		EnableCompression: settings.ClientWebSocket.Compression,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			allowed := originAllowed(origin, r.Host, normalized)
+			if !allowed {
+				slog.Warn("Rejected WebSocket connection from disallowed origin", "origin", origin, "remoteAddr", r.RemoteAddr)
+			}
+			return allowed
+		},
+	}
+}
+
+func originAllowed(origin string, host string, allowedOrigins []string) bool {
+	// Non-browser clients don't send an Origin header, and aren't at risk of cross-site requests
+	if origin == "" {
+		return true
+	}
+	if len(allowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, host)
+	}
+	// Allowed origins are normalised in the same way by NewUpgrader
+	return slices.Contains(allowedOrigins, anyOrigin) || slices.Contains(allowedOrigins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+}
+
+// dialWorker opens a WebSocket connection to a worker, using the configured worker WebSocket settings
+func dialWorker(ctx context.Context, info spawnerHelpers.WorkerInfo) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.ReadBufferSize = settings.WorkerWebSocket.ReadBufferSize
+	dialer.WriteBufferSize = settings.WorkerWebSocket.WriteBufferSize
+	dialer.EnableCompression = settings.WorkerWebSocket.Compression
+
+	addr := fmt.Sprintf("ws://%s:%d", info.Address, info.Port)
+	conn, _, err := dialer.DialContext(ctx, addr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to worker at %s: %w", addr, err)
+	}
+	if settings.WorkerWebSocket.MaxMessageSize > 0 {
+		conn.SetReadLimit(settings.WorkerWebSocket.MaxMessageSize)
+	}
+	return conn, nil
+}
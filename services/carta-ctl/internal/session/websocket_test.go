@@ -0,0 +1,87 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/proxy"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		host    string
+		allowed []string
+		want    bool
+	}{
+		{"NoOrigin", "", "carta.example", nil, true},
+		{"NoOriginWithAllowList", "", "carta.example", []string{"https://carta.example"}, true},
+		{"SameHost", "https://carta.example", "carta.example", nil, true},
+		{"SameHostAndPort", "http://carta.example:3002", "carta.example:3002", nil, true},
+		{"SameHostDifferentPort", "http://carta.example:8080", "carta.example:3002", nil, false},
+		{"PortOnlyInOrigin", "http://carta.example:8080", "carta.example", nil, false},
+		{"HostCase", "https://CARTA.Example", "carta.example", nil, true},
+		{"OtherHost", "https://evil.example", "carta.example", nil, false},
+		{"HostAsSuffix", "https://carta.example.evil.example", "carta.example", nil, false},
+		{"MalformedOrigin", "https://carta.example:port", "carta.example", nil, false},
+		{"Listed", "https://carta.example", "internal", []string{"https://carta.example"}, true},
+		{"ListedCase", "HTTPS://Carta.Example", "internal", []string{"https://carta.example"}, true},
+		{"TrailingSlash", "https://carta.example/", "internal", []string{"https://carta.example"}, true},
+		{"ListedWithDifferentScheme", "http://carta.example", "internal", []string{"https://carta.example"}, false},
+		{"ListedWithDifferentPort", "https://carta.example:8443", "internal", []string{"https://carta.example"}, false},
+		{"NotListedSameHost", "https://carta.example", "carta.example", []string{"https://other.example"}, false},
+		{"Wildcard", "https://evil.example", "carta.example", []string{anyOrigin}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The upgrader normalises the allowed origins before checking them
+			upgrader := NewUpgrader(tt.allowed)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = tt.host
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := upgrader.CheckOrigin(r); got != tt.want {
+				t.Errorf("origin %q for host %q with allowed origins %q: got %v, want %v", tt.origin, tt.host, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+// The origin is compared with the host that the client connected to, which reverse proxies pass on in
+// X-Forwarded-Host, but only if the proxy is trusted
+func TestOriginAllowedBehindProxy(t *testing.T) {
+	proxies, err := proxy.ParseTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrader := NewUpgrader(nil)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       bool
+	}{
+		{"TrustedProxy", "10.0.0.1:4000", true},
+		{"UntrustedPeer", "203.0.113.9:4000", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bool
+			handler := proxies.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = upgrader.CheckOrigin(r)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Host = "carta-ctl:3002"
+			r.Header.Set("X-Forwarded-Host", "carta.example")
+			r.Header.Set("Origin", "https://carta.example")
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package sharing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/proxy"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/session"
+)
+
+// FollowParam is the query parameter that followers pass the invite token in when opening a WebSocket connection
+const FollowParam = "follow"
+
+// SharingConfig holds the settings for the sharing API, which users call to invite others to follow their sessions
+type SharingConfig struct{}
+
+type inviteResponse struct {
+	session.Invite
+	// URL opens the frontend as a follower of the session
+	URL string `json:"url"`
+	// SocketURL is the WebSocket address that the frontend connects to as a follower
+	SocketURL string `json:"socketUrl"`
+}
+
+// inviteLinks builds the links for an invite, pointing the frontend at the controller that the request came through
+func inviteLinks(r *http.Request, invite session.Invite) inviteResponse {
+	scheme, socketScheme := "http", "ws"
+	if proxy.Scheme(r) == "https" {
+		scheme, socketScheme = "https", "wss"
+	}
+	socketURL := fmt.Sprintf("%s://%s%s?%s=%s", socketScheme, r.Host, auth.Path("/"), FollowParam, url.QueryEscape(invite.Token))
+	return inviteResponse{
+		Invite:    invite,
+		URL:       fmt.Sprintf("%s://%s%s?socketUrl=%s", scheme, r.Host, auth.Path("/"), url.QueryEscape(socketURL)),
+		SocketURL: socketURL,
+	}
+}
+
+// ownSession looks up a session of the requesting user, as users may only share their own sessions
+func ownSession(r *http.Request) (*session.Session, bool) {
+	user, _ := r.Context().Value(session.UserContextKey).(*auth.User)
+	for _, s := range session.ForUser(user) {
+		if s.ID == r.PathValue("id") {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func (h *SharingConfig) handleListInvites(w http.ResponseWriter, r *http.Request) {
+	s, ok := ownSession(r)
+	if !ok {
+		helpers.WriteError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	invites := s.Invites()
+	responses := make([]inviteResponse, 0, len(invites))
+	for _, invite := range invites {
+		responses = append(responses, inviteLinks(r, invite))
+	}
+	helpers.WriteJSON(w, http.StatusOK, responses)
+}
+
+func (h *SharingConfig) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	s, ok := ownSession(r)
+	if !ok {
+		helpers.WriteError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	invite, err := s.CreateInvite()
+	if err != nil {
+		helpers.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	helpers.WriteJSON(w, http.StatusCreated, inviteLinks(r, invite))
+}
+
+func (h *SharingConfig) handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	s, ok := ownSession(r)
+	if !ok {
+		helpers.WriteError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	err := s.RevokeInvite(r.PathValue("token"))
+	if errors.Is(err, session.ErrInviteNotFound) {
+		helpers.WriteError(w, http.StatusNotFound, "Invite not found")
+		return
+	}
+	if err != nil {
+		helpers.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	helpers.WriteJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
+
+func (h *SharingConfig) Router() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /session/{id}/invites", http.HandlerFunc(h.handleListInvites))
+	mux.Handle("POST /session/{id}/invites", http.HandlerFunc(h.handleCreateInvite))
+	mux.Handle("DELETE /session/{id}/invites/{token}", http.HandlerFunc(h.handleRevokeInvite))
+
+	return mux
+}
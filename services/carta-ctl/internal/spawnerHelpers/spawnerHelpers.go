@@ -2,15 +2,31 @@ package spawnerHelpers
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/CARTAvis/go-carta/pkg/shared"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
 )
 
+var spawnDuration = metrics.NewHistogramVec("carta_spawn_duration_seconds", "Time taken by the spawner to start a worker", metrics.DefaultBuckets, "result")
+
+// httpClient is used for all requests to the spawner
+var httpClient = http.DefaultClient
+
+// SetTLSConfig sets the TLS configuration used to connect to a spawner that serves HTTPS
+func SetTLSConfig(cfg *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	httpClient = &http.Client{Transport: transport}
+}
+
 type ErrorResponse struct {
 	ErrorMessage string `json:"msg"`
 }
@@ -37,7 +53,7 @@ func CountWorkers(spawnerAddress string) (int, error) {
 	}
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return -1, err
 	}
@@ -69,6 +85,27 @@ func CountWorkers(spawnerAddress string) (int, error) {
 	return -1, errors.New("failed to get workers")
 }
 
+// CheckSpawner checks that the spawner is reachable and running
+func CheckSpawner(ctx context.Context, spawnerAddress string) error {
+	url := fmt.Sprintf("%s/healthz", spawnerAddress)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer helpers.CloseOrLog(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("spawner responded with %s", resp.Status)
+	}
+	return nil
+}
+
 func GetWorkerStatus(workerId string, spawnerAddress string) (WorkerStatus, error) {
 	url := fmt.Sprintf("%s/worker/%s", spawnerAddress, workerId)
 	req, err := http.NewRequest(http.MethodGet, url, nil)
@@ -77,7 +114,7 @@ func GetWorkerStatus(workerId string, spawnerAddress string) (WorkerStatus, erro
 	}
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return WorkerStatus{}, err
 	}
@@ -100,7 +137,19 @@ func GetWorkerStatus(workerId string, spawnerAddress string) (WorkerStatus, erro
 	return WorkerStatus{}, errors.New("failed to get worker status")
 }
 
+// RequestWorkerStartup asks the spawner to start a worker, and records how long that took
 func RequestWorkerStartup(spawnerAddress string, baseFolder string) (WorkerInfo, error) {
+	start := time.Now()
+	info, err := requestWorkerStartup(spawnerAddress, baseFolder)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	spawnDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return info, err
+}
+
+func requestWorkerStartup(spawnerAddress string, baseFolder string) (WorkerInfo, error) {
 	// create a request body with the base folder
 	requestBody, err := json.Marshal(map[string]string{"baseFolder": baseFolder})
 	if err != nil {
@@ -114,7 +163,7 @@ func RequestWorkerStartup(spawnerAddress string, baseFolder string) (WorkerInfo,
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return WorkerInfo{}, err
 	}
@@ -151,7 +200,7 @@ func RequestWorkerShutdown(workerId string, spawnerAddress string) error {
 	}
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,33 @@
+package spawnerHelpers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckSpawner(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+	stopped := httptest.NewServer(http.NotFoundHandler())
+	stopped.Close()
+
+	if err := CheckSpawner(context.Background(), healthy.URL); err != nil {
+		t.Errorf("healthy spawner: %v", err)
+	}
+	if err := CheckSpawner(context.Background(), unhealthy.URL); err == nil {
+		t.Error("no error for an unhealthy spawner")
+	}
+	if err := CheckSpawner(context.Background(), stopped.URL); err == nil {
+		t.Error("no error for an unreachable spawner")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"errors"
 	"fmt"
@@ -9,40 +10,48 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/spf13/pflag"
 
 	"github.com/CARTAvis/go-carta/pkg/config"
+	"github.com/CARTAvis/go-carta/pkg/health"
 	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+	"github.com/CARTAvis/go-carta/pkg/tlsutil"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/session"
 
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/admin"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
 	authoidc "github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth/oidc"
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth/pamwrap"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/metrics"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/proxy"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/scripting"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/sharing"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/spawnerHelpers"
 
 	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/database"
 
 	"encoding/json"
 )
 
+// shutdownCleanupTimeout bounds how long sessions may take to shut down their workers once the grace period is over
+const shutdownCleanupTimeout = 15 * time.Second
+
 var (
 	runtimeSpawnerAddress string
 	runtimeBaseFolder     string
+	runtimeGroupFolders   []config.GroupFolder
 	pamAuth               pamwrap.Authenticator
+	upgrader              *websocket.Upgrader
 )
 
-var upgrader = websocket.Upgrader{
-	// Ignore Origin header
-	CheckOrigin: func(r *http.Request) bool {
-		slog.Debug("Upgrading WebSocket connection", "origin", r.Header.Get("Origin"))
-		return true
-	},
-}
-
 // spaHandler serves static files if they exist, otherwise falls back to index.html
 type spaHandler struct {
 	root string
@@ -83,19 +92,74 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, filepath.Join(h.root, "index.html"))
 }
 
+// normalizeBasePath converts a configured URL prefix to the form "/prefix", or "" if the controller is served at the root
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(strings.TrimSpace(basePath), "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// withBasePath serves a handler that expects paths relative to the root under a URL prefix
+func withBasePath(basePath string, next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	mux := http.NewServeMux()
+	mux.Handle(basePath+"/", http.StripPrefix(basePath, next))
+	mux.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	return mux
+}
+
 func wsHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("Handling WebSocket connection", "remoteAddr", r.RemoteAddr)
-	c, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		slog.Error("Problem with HTTP upgrade", "error", err)
+	if session.Draining() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
-	defer helpers.CloseOrLog(c)
-
 	user, _ := r.Context().Value(session.UserContextKey).(*auth.User)
 
-	s := session.NewSession(c, runtimeSpawnerAddress, runtimeBaseFolder, user)
-	slog.Info("Created new session", "user", user)
+	var s *session.Session
+	if invite := r.URL.Query().Get(sharing.FollowParam); invite != "" {
+		// Followers watch another user's session, so they don't need a data folder of their own
+		leader, ok := session.FindInvite(invite)
+		if !ok {
+			http.Error(w, "Invite not found", http.StatusNotFound)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.Error("Problem with HTTP upgrade", "error", err)
+			return
+		}
+		defer helpers.CloseOrLog(c)
+
+		s, err = session.NewFollowerSession(c, r.RemoteAddr, leader, invite, user)
+		if err != nil {
+			slog.Warn("Could not follow session", "user", user, "leaderSessionId", leader.ID, "error", err)
+			closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+			_ = c.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+			return
+		}
+	} else {
+		baseFolder, err := session.ResolveBaseFolder(runtimeBaseFolder, runtimeGroupFolders, user)
+		if err != nil {
+			slog.Error("Could not resolve base folder", "user", user, "error", err)
+			http.Error(w, "No data folder is available for this user", http.StatusForbidden)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.Error("Problem with HTTP upgrade", "error", err)
+			return
+		}
+		defer helpers.CloseOrLog(c)
+
+		s = session.NewSession(c, r.RemoteAddr, runtimeSpawnerAddress, baseFolder, user)
+		slog.Info("Created new session", "user", user, "sessionId", s.ID)
+	}
+	c := s.WebSocket
 
 	// Send messages back to client through websocket
 	s.HandleConnection()
@@ -139,6 +203,14 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Client disconnected")
 }
 
+// metricsHandler serves the controller's metrics in the Prometheus text exposition format
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WriteText(w); err != nil {
+		slog.Error("Error writing metrics", "error", err)
+	}
+}
+
 func withAuth(a auth.Authenticator, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, err := a.AuthenticateHTTP(w, r)
@@ -215,6 +287,7 @@ func pamLoginHandler(p pamwrap.Authenticator) http.Handler {
 			}
 
 			user, err := p.AuthenticateCredentials(r.Context(), username, password)
+			auth.RecordLogin(auth.SourcePAM, err)
 			if err != nil {
 				slog.Error("PAM login failed", "username", username, "error", err)
 				w.WriteHeader(http.StatusUnauthorized)
@@ -227,7 +300,7 @@ func pamLoginHandler(p pamwrap.Authenticator) http.Handler {
 			}
 			slog.Info("About to set PAM session cookie", "username", user.Username)
 
-			if err := pamwrap.SetSessionCookie(w, user.Username); err != nil {
+			if err := pamwrap.SetSessionCookie(w, r, user.Username); err != nil {
 				slog.Error("Failed to set PAM session cookie", "username", user.Username, "error", err)
 				http.Error(w, "Session error", http.StatusInternalServerError)
 				return
@@ -238,8 +311,8 @@ func pamLoginHandler(p pamwrap.Authenticator) http.Handler {
 				slog.Info("Set-Cookie", "value", c)
 			}
 
-			slog.Info("Cookie set, redirecting", "to", "/")
-			http.Redirect(w, r, "/", http.StatusFound)
+			slog.Info("Cookie set, redirecting", "to", auth.Path("/"))
+			http.Redirect(w, r, auth.Path("/"), http.StatusFound)
 
 			return
 
@@ -251,6 +324,154 @@ func pamLoginHandler(p pamwrap.Authenticator) http.Handler {
 	})
 }
 
+var dashboardTmpl *template.Template
+
+// dashboardHandler serves a page where users can see their own sessions and the status of their workers, and stop a
+// session or restart its backend if it is stuck
+func dashboardHandler() http.Handler {
+	type workerData struct {
+		Role     string
+		WorkerId string
+		Pid      int
+		Status   string
+		Healthy  bool
+	}
+
+	type sessionData struct {
+		session.Summary
+		Workers []workerData
+	}
+
+	type pageData struct {
+		Title           string
+		Heading         string
+		User            *auth.User
+		Sessions        []sessionData
+		FrontendAddress string
+		LogoutAddress   string
+		Message         string
+		Error           string
+	}
+
+	doneMessages := map[string]string{
+		"stop":    "The session was stopped.",
+		"restart": "The backend was restarted and the session's images were reopened.",
+	}
+
+	render := func(w http.ResponseWriter, status int, user *auth.User, message, errMessage string) {
+		data := pageData{
+			Title:           "CARTA Dashboard",
+			Heading:         "CARTA Dashboard",
+			User:            user,
+			FrontendAddress: auth.Path("/"),
+			Message:         message,
+			Error:           errMessage,
+		}
+		if pamAuth != nil || oidcAuth != nil {
+			data.LogoutAddress = auth.Path("/api/auth/logout")
+		}
+
+		for _, s := range session.ForUser(user) {
+			details := s.Details()
+			sd := sessionData{Summary: details.Summary}
+			for _, info := range details.Workers {
+				// Depending on the allocation strategy, workers may hold several files, including the shared worker
+				var files []string
+				for _, file := range details.Files {
+					if file.WorkerId == info.WorkerId {
+						files = append(files, file.File)
+					}
+				}
+				worker := workerData{Role: strings.Join(files, ", "), WorkerId: info.WorkerId}
+				if info.WorkerId == s.Info.WorkerId {
+					worker.Role = "Shared"
+					if len(files) > 0 {
+						worker.Role += ": " + strings.Join(files, ", ")
+					}
+				}
+
+				status, err := spawnerHelpers.GetWorkerStatus(info.WorkerId, runtimeSpawnerAddress)
+				switch {
+				case err != nil:
+					slog.Warn("Failed to get worker status", "workerId", info.WorkerId, "error", err)
+					worker.Status = "Unknown"
+				case !status.Alive && status.ExitedCleanly:
+					worker.Status = "Exited"
+				case !status.Alive:
+					worker.Status = "Crashed"
+				case !status.IsReachable:
+					worker.Status = "Not responding"
+				default:
+					worker.Status = "Running"
+					worker.Healthy = true
+				}
+				worker.Pid = status.Pid
+				sd.Workers = append(sd.Workers, worker)
+			}
+			data.Sessions = append(data.Sessions, sd)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		_ = dashboardTmpl.Execute(w, data)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := r.Context().Value(session.UserContextKey).(*auth.User)
+
+		switch r.Method {
+
+		case http.MethodGet:
+			render(w, http.StatusOK, user, doneMessages[r.URL.Query().Get("done")], "")
+
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Bad form", http.StatusBadRequest)
+				return
+			}
+
+			// Users may only manage their own sessions
+			id := r.Form.Get("session")
+			var s *session.Session
+			for _, candidate := range session.ForUser(user) {
+				if candidate.ID == id {
+					s = candidate
+				}
+			}
+			if s == nil {
+				render(w, http.StatusNotFound, user, "", "Session not found")
+				return
+			}
+
+			action := r.Form.Get("action")
+			var err error
+			switch action {
+			case "stop":
+				slog.Info("User stopping session", "username", user.Username, "sessionId", s.ID)
+				err = s.Terminate("Session stopped by user")
+			case "restart":
+				slog.Info("User restarting backend", "username", user.Username, "sessionId", s.ID)
+				err = s.RestartBackend("Backend restarted by user")
+			default:
+				render(w, http.StatusBadRequest, user, "", "Unknown action")
+				return
+			}
+			if err != nil {
+				slog.Error("Dashboard action failed", "action", action, "sessionId", s.ID, "error", err)
+				render(w, http.StatusInternalServerError, user, "", "The request could not be completed")
+				return
+			}
+
+			// Redirect so that reloading the page doesn't repeat the action
+			http.Redirect(w, r, auth.Path("/dashboard?done="+action), http.StatusSeeOther)
+
+		default:
+			slog.Warn("Ignoring unsupported method", "method", r.Method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
 var oidcAuth *authoidc.OIDCAuthenticator
 
 func main() {
@@ -265,7 +486,7 @@ func main() {
 	pflag.Int("port", 8081, "TCP server port")
 	pflag.String("hostname", "", "Hostname to listen on")
 	pflag.String("spawner_address", "", "Address of the process spawner")
-	pflag.String("base_folder", "", "Base folder for data")
+	pflag.String("base_folder", "", "Base folder for data, which may contain {username} and {home}")
 	pflag.String("frontend_dir", "", "Directory with carta_frontend")
 	pflag.String("auth_mode", "none", "Authentication mode: none|pam|oidc|both")
 	pflag.String("override", "", "Override simple config values (string, int, bool) as comma-separated key:value pairs (e.g., controller.port:9000,log_level:debug)")
@@ -302,13 +523,33 @@ func main() {
 	pamLoginTmpl = template.Must(
 		template.ParseFS(templates, "templates/pam_login.html"),
 	)
+	dashboardTmpl = template.Must(
+		template.ParseFS(templates, "templates/dashboard.html"),
+	)
 
 	runtimeSpawnerAddress = cfg.Controller.SpawnerAddress
 	if runtimeSpawnerAddress == "" {
-		runtimeSpawnerAddress = fmt.Sprintf("http://%s:%d", cfg.Spawner.Hostname, cfg.Spawner.Port)
+		scheme := "http"
+		if cfg.Spawner.TLS.Enabled() {
+			scheme = "https"
+		}
+		runtimeSpawnerAddress = fmt.Sprintf("%s://%s:%d", scheme, cfg.Spawner.Hostname, cfg.Spawner.Port)
 	}
 
-	runtimeBaseFolder = cfg.Controller.BaseFolder
+	runtimeBaseFolder = strings.TrimSpace(cfg.Controller.BaseFolder)
+	runtimeGroupFolders = cfg.Controller.GroupFolders
+	auth.BasePath = normalizeBasePath(cfg.Controller.BasePath)
+	if err := session.Configure(cfg.Controller.Session); err != nil {
+		slog.Error("Invalid session configuration", "error", err)
+		os.Exit(1)
+	}
+	if runtimeBaseFolder == "" && len(cfg.Controller.Session.AllowedRoots) == 0 {
+		slog.Warn("File access is not restricted for users without a group folder, set base_folder or allowed_roots to restrict it")
+	}
+	upgrader = session.NewUpgrader(cfg.Controller.AllowedOrigins)
+	if cfg.Controller.Metrics.PerUser {
+		session.EnableUserMetrics()
+	}
 
 	var authenticator auth.Authenticator
 
@@ -338,31 +579,48 @@ func main() {
 			os.Exit(1)
 		}
 		pamAuth = p
+		oidcAuth = authoidc.New(cfg.Controller.OIDC)
 		authenticator = auth.Multi(
 			p,
-			authoidc.New(cfg.Controller.OIDC),
+			oidcAuth,
 		)
 	default:
 		slog.Error("Unknown config option", "authMode", cfg.Controller.AuthMode)
 		os.Exit(1)
 	}
 
-	// Default baseFolder to $HOME if unset
-	if len(strings.TrimSpace(cfg.Controller.BaseFolder)) == 0 {
-		dirname, err := os.UserHomeDir()
-		if err != nil {
-			dirname = "/"
-		}
-		cfg.Controller.BaseFolder = dirname
-		slog.Debug("Using default base folder", "dirname", dirname)
+	// Dependencies that must be available before the controller can serve users
+	readinessChecks := []health.Check{
+		{Name: "spawner", Run: func(ctx context.Context) error {
+			return spawnerHelpers.CheckSpawner(ctx, runtimeSpawnerAddress)
+		}},
+	}
+	if oidcAuth != nil {
+		readinessChecks = append(readinessChecks, health.Check{Name: "oidc", Run: oidcAuth.CheckDiscovery})
 	}
 
+	// The auth API handles missing and expired logins itself, so it isn't wrapped with the authenticator
+	authAPI := auth.API{
+		OnLogout: func(u *auth.User) {
+			n := session.TerminateLogin(u.LoginID, "Logged out")
+			slog.Info("Ended sessions for login", "username", u.Username, "sessions", n)
+		},
+	}
+	if pamAuth != nil {
+		authAPI.Managers = append(authAPI.Managers, pamAuth)
+	}
+	if oidcAuth != nil {
+		authAPI.Managers = append(authAPI.Managers, oidcAuth)
+	}
+	http.Handle("/api/auth/", noCache(http.StripPrefix("/api/auth", authAPI.Router())))
+
 	if cfg.Controller.DBConnectionString != "" {
 		slog.Debug("Database connection string provided", "db_conn_string", cfg.Controller.DBConnectionString)
 		db := database.DbConfig{
 			ConnString: cfg.Controller.DBConnectionString,
 		}
 		db.InitDb()
+		readinessChecks = append(readinessChecks, health.Check{Name: "database", Run: db.Ping})
 		http.Handle(
 			"/api/database/",
 			noCache(
@@ -372,6 +630,36 @@ func main() {
 		slog.Debug("Defaulting to backend's filesystem-based state-saving")
 	}
 
+	if len(cfg.Controller.AdminGroups) > 0 {
+		slog.Info("Enabling admin API", "adminGroups", cfg.Controller.AdminGroups)
+		adminCfg := admin.AdminConfig{
+			AllowedGroups: cfg.Controller.AdminGroups,
+		}
+		http.Handle(
+			"/api/admin/",
+			noCache(
+				withAuth(authenticator,
+					http.StripPrefix("/api/admin", adminCfg.Router()))))
+	} else {
+		slog.Debug("No admin groups configured, admin API is disabled")
+	}
+
+	sharingCfg := sharing.SharingConfig{}
+	http.Handle(
+		"/api/sharing/",
+		noCache(
+			withAuth(authenticator,
+				http.StripPrefix("/api/sharing", sharingCfg.Router()))))
+
+	scriptingCfg := scripting.ScriptingConfig{
+		Timeout: cfg.Controller.ScriptingTimeout,
+	}
+	http.Handle(
+		"/api/scripting/",
+		noCache(
+			withAuth(authenticator,
+				http.StripPrefix("/api/scripting", scriptingCfg.Router()))))
+
 	// If a frontend directory is provided, serve carta_frontend from there
 	if cfg.Controller.FrontendDir != "" {
 		info, err := os.Stat(cfg.Controller.FrontendDir)
@@ -381,6 +669,11 @@ func main() {
 		}
 
 		slog.Info("Serving carta_frontend", "dirname", cfg.Controller.FrontendDir)
+		frontendIndex := filepath.Join(cfg.Controller.FrontendDir, "index.html")
+		readinessChecks = append(readinessChecks, health.Check{Name: "frontend", Run: func(ctx context.Context) error {
+			_, err := os.Stat(frontendIndex)
+			return err
+		}})
 		fs := http.FileServer(http.Dir(cfg.Controller.FrontendDir))
 
 		if oidcAuth != nil && (cfg.Controller.AuthMode == config.AuthOIDC || cfg.Controller.AuthMode == config.AuthBoth) {
@@ -406,17 +699,19 @@ func main() {
 		slog.Info("No --frontendDir supplied: controller will *not* serve the frontend (only /carta WebSocket).")
 	}
 
+	http.Handle("/dashboard", noCache(withAuth(authenticator, dashboardHandler())))
+
 	cfgHandler := func(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
 		cfg := map[string]string{
-			"dashboardAddress": "/dashboard", // no dashboard ... causes redirect
-			"apiAddress":       "/api",
+			"dashboardAddress": auth.Path("/dashboard"),
+			"apiAddress":       auth.Path("/api"),
 			//"tokenRefreshAddress":  "/api/auth/refresh",
-			"logoutAddress": "/api/auth/logout",
-			"authPath":      "/api/auth/refresh",
+			"logoutAddress": auth.Path("/api/auth/logout"),
+			"authPath":      auth.Path("/api/auth/refresh"),
 		}
 
 		if err := json.NewEncoder(w).Encode(cfg); err != nil {
@@ -425,11 +720,88 @@ func main() {
 	}
 	http.Handle("/config", http.HandlerFunc(cfgHandler))
 
+	// Health endpoints are used by load balancers and supervisors, so they don't require authentication
+	http.Handle("GET /healthz", health.LivenessHandler())
+	http.Handle("GET /readyz", health.ReadinessHandler(health.DefaultTimeout, readinessChecks...))
+
+	if cfg.Controller.Metrics.Enabled {
+		http.Handle("GET /metrics", noCache(http.HandlerFunc(metricsHandler)))
+	}
+
 	addr := fmt.Sprintf("%s:%d", cfg.Controller.Hostname, cfg.Controller.Port)
 
-	slog.Info("Server listening", "addr", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		logger.Error("Server error", "error", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	trustedProxies, err := proxy.ParseTrustedProxies(cfg.Controller.TrustedProxies)
+	if err != nil {
+		slog.Error("Invalid trusted proxies", "error", err)
 		os.Exit(1)
 	}
+	server := &http.Server{
+		Addr:    addr,
+		Handler: trustedProxies.Middleware(withBasePath(auth.BasePath, http.DefaultServeMux)),
+	}
+
+	var certs *tlsutil.Reloader
+	if cfg.Controller.TLS.Enabled() {
+		certs, err = tlsutil.NewReloader(cfg.Controller.TLS)
+		if err != nil {
+			slog.Error("Failed to load TLS configuration", "error", err)
+			os.Exit(1)
+		}
+		if err := certs.Watch(ctx); err != nil {
+			slog.Warn("Certificates will not be reloaded automatically", "error", err)
+		}
+		server.TLSConfig = certs.ServerConfig()
+	}
+
+	// Present our own certificate to the spawner, in case it requires client certificates
+	if certs != nil || cfg.Controller.SpawnerCAFile != "" {
+		spawnerTLS := &tls.Config{MinVersion: tls.VersionTLS12}
+		if certs != nil {
+			spawnerTLS.GetClientCertificate = certs.ClientCertificate
+		}
+		if cfg.Controller.SpawnerCAFile != "" {
+			pool, err := tlsutil.LoadCertPool(cfg.Controller.SpawnerCAFile)
+			if err != nil {
+				slog.Error("Failed to load spawner CA bundle", "error", err)
+				os.Exit(1)
+			}
+			spawnerTLS.RootCAs = pool
+		}
+		spawnerHelpers.SetTLSConfig(spawnerTLS)
+	}
+
+	go func() {
+		slog.Info("Server listening", "addr", addr, "tls", certs != nil)
+		var err error
+		if certs != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Wait for interrupt
+	<-ctx.Done()
+	stop()
+	slog.Info("Signal received, draining sessions", "gracePeriod", cfg.Controller.ShutdownGracePeriod)
+
+	// Stop accepting connections straight away. WebSocket connections have been hijacked from the server, so they
+	// aren't affected by this and are drained separately
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Controller.ShutdownGracePeriod+shutdownCleanupTimeout)
+	defer cancel()
+	go func() {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("HTTP server shutdown error", "error", err)
+		}
+	}()
+
+	session.Drain(shutdownCtx, cfg.Controller.ShutdownGracePeriod)
+	slog.Info("Controller exited gracefully")
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/auth"
+	"github.com/CARTAvis/go-carta/services/carta-ctl/internal/session"
+)
+
+// connectSession opens a session for a user over a real WebSocket connection, without a backend
+func connectSession(t *testing.T, user *auth.User) *session.Session {
+	t.Helper()
+	sessions := make(chan *session.Session, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = c.Close() }()
+		s := session.NewSession(c, r.RemoteAddr, "", "", user)
+		defer s.HandleDisconnect()
+		sessions <- s
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	// The client reads so that it answers the close frame when its session is stopped
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return <-sessions
+}
+
+func dashboardRequest(t *testing.T, user *auth.User, method string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	var r *http.Request
+	if method == http.MethodPost {
+		r = httptest.NewRequest(method, "/dashboard", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, "/dashboard?"+form.Encode(), nil)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), session.UserContextKey, user))
+	w := httptest.NewRecorder()
+	dashboardHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestDashboardOnlyManagesOwnSessions(t *testing.T) {
+	dashboardTmpl = template.Must(template.ParseFS(templates, "templates/dashboard.html"))
+	alice := &auth.User{Username: "alice", Source: auth.SourcePAM}
+	bob := &auth.User{Username: "bob", Source: auth.SourcePAM}
+	// The same username from another identity source is a different user
+	otherAlice := &auth.User{Username: "alice", Source: auth.SourceOIDC}
+	own := connectSession(t, alice)
+	other := connectSession(t, bob)
+	connectSession(t, otherAlice)
+
+	w := dashboardRequest(t, alice, http.MethodGet, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d for the dashboard", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, own.ID) || strings.Count(body, "<h3>Session ") != 1 {
+		t.Errorf("dashboard doesn't list only the user's own session:\n%s", body)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		session string
+		action  string
+		want    int
+	}{
+		{"OtherUsersSession", other.ID, "stop", http.StatusNotFound},
+		{"UnknownSession", "missing", "stop", http.StatusNotFound},
+		{"UnknownAction", own.ID, "delete", http.StatusBadRequest},
+		// There is no backend to restart
+		{"FailedRestart", own.ID, "restart", http.StatusInternalServerError},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := dashboardRequest(t, alice, http.MethodPost, url.Values{"session": {tt.session}, "action": {tt.action}})
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+	if _, ok := session.Get(other.ID); !ok {
+		t.Fatal("another user's session was stopped")
+	}
+
+	w = dashboardRequest(t, alice, http.MethodPost, url.Values{"session": {own.ID}, "action": {"stop"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != auth.Path("/dashboard?done=stop") {
+		t.Fatalf("got status %d redirecting to %q after stopping the session", w.Code, w.Header().Get("Location"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(session.ForUser(alice)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session was not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if body := dashboardRequest(t, alice, http.MethodGet, url.Values{"done": {"stop"}}).Body.String(); !strings.Contains(body, "The session was stopped.") {
+		t.Errorf("dashboard doesn't confirm the stop:\n%s", body)
+	}
+
+	if w := dashboardRequest(t, alice, http.MethodDelete, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for DELETE", w.Code)
+	}
+}
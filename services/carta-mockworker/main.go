@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	"github.com/CARTAvis/go-carta/pkg/mockworker"
+	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+)
+
+func main() {
+	// The spawner passes the same flags that it passes to carta_backend, most of which don't apply here
+	pflag.CommandLine.ParseErrorsAllowlist.UnknownFlags = true
+
+	pflag.Int("port", 0, "WebSocket port. If this is 0, a free port is chosen")
+	pflag.String("base", "", "Top level folder (default: $HOME)")
+	pflag.String("script", "", "Path to a JSON file with scripted responses")
+	pflag.Int("tile_size", 256, "Width and height of synthetic raster tiles")
+	pflag.Duration("delay", 0, "Delay added before every response")
+	pflag.Int("crash_after", 0, "Crash after receiving this many messages (0 disables)")
+	pflag.String("crash_on", "", "Comma-separated event types that trigger a crash when received (e.g. OPEN_FILE)")
+	pflag.Float64("malformed_rate", 0, "Probability (0-1) of replacing a response with a malformed frame")
+	pflag.Uint64("seed", 1, "Seed for fault injection")
+	pflag.String("log_level", "info", "Log level (debug|info|warn|error)")
+	pflag.Parse()
+
+	logger := helpers.NewLogger("carta-mockworker", pflag.Lookup("log_level").Value.String())
+	slog.SetDefault(logger)
+
+	port, _ := pflag.CommandLine.GetInt("port")
+	baseFolder, _ := pflag.CommandLine.GetString("base")
+	scriptPath, _ := pflag.CommandLine.GetString("script")
+	tileSize, _ := pflag.CommandLine.GetInt("tile_size")
+	crashOnNames, _ := pflag.CommandLine.GetString("crash_on")
+
+	opts := mockworker.Options{
+		BaseFolder: baseFolder,
+		TileSize:   tileSize,
+		OnCrash: func() {
+			// Mimic the exit status of a segfault
+			os.Exit(139)
+		},
+	}
+	opts.Faults.Delay, _ = pflag.CommandLine.GetDuration("delay")
+	opts.Faults.CrashAfter, _ = pflag.CommandLine.GetInt("crash_after")
+	opts.Faults.MalformedRate, _ = pflag.CommandLine.GetFloat64("malformed_rate")
+	opts.Faults.Seed, _ = pflag.CommandLine.GetUint64("seed")
+
+	for name := range strings.SplitSeq(crashOnNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		value, ok := cartaDefinitions.EventType_value[strings.ToUpper(name)]
+		if !ok {
+			slog.Error("Unknown event type", "eventType", name)
+			os.Exit(2)
+		}
+		opts.Faults.CrashOn = append(opts.Faults.CrashOn, cartaDefinitions.EventType(value))
+	}
+
+	if scriptPath != "" {
+		script, err := mockworker.LoadScript(scriptPath)
+		if err != nil {
+			slog.Error("Failed to load script", "path", scriptPath, "error", err)
+			os.Exit(1)
+		}
+		opts.Script = script
+	}
+
+	if opts.BaseFolder == "" {
+		dirname, err := os.UserHomeDir()
+		if err != nil {
+			dirname = "/"
+		}
+		opts.BaseFolder = dirname
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		slog.Error("Failed to listen", "error", err)
+		os.Exit(1)
+	}
+	defer helpers.CloseOrLog(listener)
+
+	// The spawner waits for this line to detect that the worker is ready, so it matches carta_backend's output
+	fmt.Printf("Listening on port %d with top level folder %s\n", listener.Addr().(*net.TCPAddr).Port, opts.BaseFolder)
+
+	w := mockworker.New(opts)
+	if err := w.Serve(listener); err != nil {
+		slog.Error("Failed to serve", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/pflag"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/CARTAvis/go-carta/pkg/capture"
+	"github.com/CARTAvis/go-carta/pkg/cartaDefinitions"
+	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+)
+
+// Maximum length of a decoded message printed in a diff
+const maxPrintedLength = 2000
+
+type responseKey struct {
+	eventType cartaDefinitions.EventType
+	requestId uint32
+}
+
+func readCapture(path string) ([]capture.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer helpers.CloseOrLog(f)
+
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []capture.Record
+	for {
+		record, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			// Captures of sessions that were still running may end in a partial record
+			slog.Warn("Stopped reading capture early", "error", err, "records", len(records))
+			return records, nil
+		}
+		records = append(records, record)
+	}
+}
+
+func describe(record capture.Record) string {
+	msg, err := record.Decode()
+	if err != nil {
+		return fmt.Sprintf("<%d bytes, not decoded: %v>", len(record.Message)-8, err)
+	}
+	text := prototext.MarshalOptions{}.Format(msg)
+	if len(text) > maxPrintedLength {
+		text = text[:maxPrintedLength] + "..."
+	}
+	return text
+}
+
+func dump(records []capture.Record) {
+	if len(records) == 0 {
+		return
+	}
+	start := records[0].Time
+	for _, record := range records {
+		prefix, err := record.Prefix()
+		if err != nil {
+			fmt.Printf("%10.3fs %-20s %-16s <invalid message: %v>\n", record.Time.Sub(start).Seconds(), record.Direction, record.WorkerName, err)
+			continue
+		}
+		fmt.Printf("%10.3fs %-20s %-16s %s requestId=%d %d bytes\n", record.Time.Sub(start).Seconds(), record.Direction, record.WorkerName, prefix.EventType, prefix.RequestId, len(record.Message)-8)
+	}
+}
+
+// replay sends the recorded client messages for one worker to a live worker, preserving the original timing scaled
+// by speed, and collects everything the worker sends back until settle has elapsed after the last message
+func replay(ctx context.Context, records []capture.Record, workerAddress string, speed float64, settle time.Duration) ([]capture.Record, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, workerAddress, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to worker at %s: %w", workerAddress, err)
+	}
+	defer helpers.CloseOrLog(conn)
+
+	var mu sync.Mutex
+	var responses []capture.Record
+	readDone := make(chan struct{})
+
+	go func() {
+		defer close(readDone)
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType == websocket.TextMessage && string(message) == "PING" {
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("PONG"))
+				continue
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			mu.Lock()
+			responses = append(responses, capture.Record{Time: time.Now(), Direction: capture.WorkerToController, Message: message})
+			mu.Unlock()
+		}
+	}()
+
+	var previous time.Time
+	for _, record := range records {
+		if speed > 0 && !previous.IsZero() {
+			time.Sleep(time.Duration(float64(record.Time.Sub(previous)) / speed))
+		}
+		previous = record.Time
+
+		slog.Debug("Sending message", "eventType", record.EventType(), "requestId", record.RequestId())
+		if err := conn.WriteMessage(websocket.BinaryMessage, record.Message); err != nil {
+			return nil, fmt.Errorf("error sending message: %w", err)
+		}
+	}
+
+	slog.Info("Finished sending messages, waiting for responses", "settle", settle)
+	select {
+	case <-time.After(settle):
+	case <-readDone:
+		slog.Warn("Worker closed the connection")
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return slices.Clone(responses), nil
+}
+
+func groupByKey(records []capture.Record, ignored map[cartaDefinitions.EventType]bool) (map[responseKey][]capture.Record, []responseKey) {
+	groups := make(map[responseKey][]capture.Record)
+	var order []responseKey
+	for _, record := range records {
+		prefix, err := record.Prefix()
+		if err != nil || ignored[prefix.EventType] {
+			continue
+		}
+		key := responseKey{prefix.EventType, prefix.RequestId}
+		if _, exists := groups[key]; !exists {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], record)
+	}
+	return groups, order
+}
+
+func equalMessages(a, b capture.Record) bool {
+	msgA, errA := a.Decode()
+	msgB, errB := b.Decode()
+	if errA != nil || errB != nil {
+		return bytes.Equal(a.Message, b.Message)
+	}
+	return proto.Equal(msgA, msgB)
+}
+
+// diff compares the recorded responses with the replayed ones, matching them by event type and request ID, and
+// returns the number of differences found
+func diff(expected, actual []capture.Record, ignored map[cartaDefinitions.EventType]bool) int {
+	expectedGroups, order := groupByKey(expected, ignored)
+	actualGroups, actualOrder := groupByKey(actual, ignored)
+	for _, key := range actualOrder {
+		if _, exists := expectedGroups[key]; !exists {
+			order = append(order, key)
+		}
+	}
+
+	differences := 0
+	for _, key := range order {
+		want, got := expectedGroups[key], actualGroups[key]
+		for i := 0; i < max(len(want), len(got)); i++ {
+			label := fmt.Sprintf("%s requestId=%d #%d", key.eventType, key.requestId, i+1)
+			switch {
+			case i >= len(got):
+				fmt.Printf("--- missing %s\n%s\n", label, describe(want[i]))
+			case i >= len(want):
+				fmt.Printf("+++ unexpected %s\n%s\n", label, describe(got[i]))
+			case !equalMessages(want[i], got[i]):
+				fmt.Printf("--- recorded %s\n%s\n+++ replayed %s\n%s\n", label, describe(want[i]), label, describe(got[i]))
+			default:
+				continue
+			}
+			differences++
+		}
+	}
+	return differences
+}
+
+func parseEventTypes(names string) (map[cartaDefinitions.EventType]bool, error) {
+	eventTypes := make(map[cartaDefinitions.EventType]bool)
+	for name := range strings.SplitSeq(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		value, ok := cartaDefinitions.EventType_value[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		eventTypes[cartaDefinitions.EventType(value)] = true
+	}
+	return eventTypes, nil
+}
+
+func main() {
+	pflag.String("capture", "", "Path to the capture file")
+	pflag.String("worker", "", "WebSocket address of the worker to replay against (e.g. ws://localhost:3002)")
+	pflag.String("worker_name", "shared-worker", "Name of the recorded worker whose traffic should be replayed")
+	pflag.Float64("speed", 0, "Replay speed relative to the recording. 0 sends messages as fast as possible")
+	pflag.Duration("settle", 5*time.Second, "How long to wait for responses after the last message has been sent")
+	pflag.String("ignore", "", "Comma-separated event types to leave out of the diff (e.g. RASTER_TILE_DATA,RASTER_TILE_SYNC)")
+	pflag.Bool("dump", false, "Print a summary of every record in the capture instead of replaying it")
+	pflag.String("log_level", "info", "Log level (debug|info|warn|error)")
+	pflag.Parse()
+
+	logger := helpers.NewLogger("carta-replay", pflag.Lookup("log_level").Value.String())
+	slog.SetDefault(logger)
+
+	capturePath, _ := pflag.CommandLine.GetString("capture")
+	workerAddress, _ := pflag.CommandLine.GetString("worker")
+	workerName, _ := pflag.CommandLine.GetString("worker_name")
+	speed, _ := pflag.CommandLine.GetFloat64("speed")
+	settle, _ := pflag.CommandLine.GetDuration("settle")
+	ignoreNames, _ := pflag.CommandLine.GetString("ignore")
+	dumpOnly, _ := pflag.CommandLine.GetBool("dump")
+
+	if capturePath == "" {
+		slog.Error("No capture file supplied")
+		os.Exit(2)
+	}
+
+	records, err := readCapture(capturePath)
+	if err != nil {
+		slog.Error("Failed to read capture", "path", capturePath, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Read capture", "path", capturePath, "records", len(records))
+
+	if dumpOnly {
+		dump(records)
+		return
+	}
+
+	if workerAddress == "" {
+		slog.Error("No worker address supplied")
+		os.Exit(2)
+	}
+
+	ignored, err := parseEventTypes(ignoreNames)
+	if err != nil {
+		slog.Error("Invalid ignore list", "error", err)
+		os.Exit(2)
+	}
+
+	var requests, expected []capture.Record
+	for _, record := range records {
+		if record.WorkerName != workerName {
+			continue
+		}
+		switch record.Direction {
+		case capture.ControllerToWorker:
+			requests = append(requests, record)
+		case capture.WorkerToController:
+			expected = append(expected, record)
+		}
+	}
+	if len(requests) == 0 {
+		slog.Error("Capture contains no messages for worker", "workerName", workerName)
+		os.Exit(1)
+	}
+	slog.Info("Replaying capture", "workerName", workerName, "requests", len(requests), "expectedResponses", len(expected))
+
+	actual, err := replay(context.Background(), requests, workerAddress, speed, settle)
+	if err != nil {
+		slog.Error("Replay failed", "error", err)
+		os.Exit(1)
+	}
+
+	differences := diff(expected, actual, ignored)
+	slog.Info("Replay complete", "recordedResponses", len(expected), "replayedResponses", len(actual), "differences", differences)
+	if differences > 0 {
+		os.Exit(1)
+	}
+}
@@ -17,7 +17,9 @@ import (
 	"github.com/spf13/pflag"
 
 	"github.com/CARTAvis/go-carta/pkg/config"
+	"github.com/CARTAvis/go-carta/pkg/health"
 	helpers "github.com/CARTAvis/go-carta/pkg/shared"
+	"github.com/CARTAvis/go-carta/pkg/tlsutil"
 	"github.com/CARTAvis/go-carta/services/carta-spawn/internal/httpHelpers"
 	"github.com/CARTAvis/go-carta/services/carta-spawn/internal/processHelpers"
 )
@@ -177,6 +179,16 @@ func main() {
 		httpHelpers.WriteOutput(w, output)
 	})
 
+	// Health endpoints for load balancers and supervisors. The spawner is ready when it can start workers
+	r.Method(http.MethodGet, "/healthz", health.LivenessHandler())
+	r.Method(http.MethodGet, "/readyz", health.ReadinessHandler(health.DefaultTimeout, health.Check{
+		Name: "worker_exec",
+		Run: func(ctx context.Context) error {
+			_, err := exec.LookPath(cfg.Spawner.WorkerExec)
+			return err
+		},
+	}))
+
 	// Stop a specific worker
 	r.Delete("/worker/{id}", func(w http.ResponseWriter, r *http.Request) {
 		workerId := chi.URLParam(r, "id")
@@ -205,10 +217,29 @@ func main() {
 		Addr:    fmt.Sprintf("%s:%d", cfg.Spawner.Hostname, cfg.Spawner.Port),
 		Handler: r,
 	}
+	tlsEnabled := cfg.Spawner.TLS.Enabled()
+	if tlsEnabled {
+		certs, err := tlsutil.NewReloader(cfg.Spawner.TLS)
+		if err != nil {
+			slog.Error("Failed to load TLS configuration", "error", err)
+			os.Exit(1)
+		}
+		if err := certs.Watch(ctx); err != nil {
+			slog.Warn("Certificates will not be reloaded automatically", "error", err)
+		}
+		server.TLSConfig = certs.ServerConfig()
+	}
+
 	// Run server in background
 	go func() {
-		slog.Info("Spawner listening", "hostname", cfg.Spawner.Hostname, "port", cfg.Spawner.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Info("Spawner listening", "hostname", cfg.Spawner.Hostname, "port", cfg.Spawner.Port, "tls", tlsEnabled)
+		var err error
+		if tlsEnabled {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			slog.Error("ListenAndServe error", "error", err)
 			os.Exit(1)
 		}